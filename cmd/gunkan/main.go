@@ -7,6 +7,7 @@ package main
 
 import (
 	"github.com/jfsmig/object-storage/internal/cmd-blob-client"
+	"github.com/jfsmig/object-storage/internal/cmd-data-client"
 	"github.com/jfsmig/object-storage/internal/cmd-index-client"
 	"github.com/jfsmig/object-storage/pkg/gunkan"
 	"github.com/spf13/cobra"
@@ -30,8 +31,13 @@ func main() {
 	kvCmd.Use = "kv"
 	kvCmd.Aliases = []string{}
 
+	dataCmd := cmd_data_client.MainCommand()
+	dataCmd.Use = "data"
+	dataCmd.Aliases = []string{}
+
 	rootCmd.AddCommand(blobCmd)
 	rootCmd.AddCommand(kvCmd)
+	rootCmd.AddCommand(dataCmd)
 	if err := rootCmd.Execute(); err != nil {
 		gunkan.Logger.Fatal().Err(err).Msg("Command error")
 	}
@@ -0,0 +1,23 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_client
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func MainCommand() *cobra.Command {
+	client := &cobra.Command{
+		Use:     "cli",
+		Aliases: []string{"client"},
+		Short:   "Client of the data gates",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cobra.ErrSubCommandRequired
+		},
+	}
+	client.AddCommand(PresignCommand())
+	return client
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"github.com/spf13/cobra"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// Must match the routes of the data gate
+const prefixData = "/v1/part/"
+
+func PresignCommand() *cobra.Command {
+	var keysPath, keyId, method, url string
+	var params []string
+	var ttl time.Duration
+
+	cmd := &cobra.Command{
+		Use:     "presign",
+		Aliases: []string{"sign"},
+		Short:   "Mint a time-limited URL to a part: BUCKET/CONTENT/PART",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("Missing part: BUCKET/CONTENT/PART")
+			}
+			method = strings.ToUpper(method)
+			if method != "GET" && method != "PUT" {
+				return errors.New("Only GET and PUT may be signed")
+			}
+
+			keys, err := gunkan.LoadPresignKeys(keysPath)
+			if err != nil {
+				return err
+			}
+			if keyId == "" && len(keys) == 1 {
+				for k := range keys {
+					keyId = k
+				}
+			}
+			secret, ok := keys[keyId]
+			if !ok {
+				return errors.New("Unknown key, see --key")
+			}
+
+			if url == "" {
+				lb, err := gunkan.NewBalancerDefault()
+				if err != nil {
+					return err
+				}
+				if url, err = lb.PollDataGate(); err != nil {
+					return err
+				}
+			}
+
+			signed := neturl.Values{}
+			for _, p := range params {
+				tokens := strings.SplitN(p, "=", 2)
+				if len(tokens) != 2 {
+					return errors.New("Invalid parameter, see --param")
+				}
+				signed.Add(tokens[0], tokens[1])
+			}
+
+			path := prefixData + strings.TrimPrefix(args[0], "/")
+			q := gunkan.Presign(keyId, secret, method, path, signed, time.Now().Add(ttl))
+			fmt.Printf("http://%s%s?%s\n", url, path, q.Encode())
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&keysPath, "keys", "", "Path to the keys file of the data gates")
+	cmd.Flags().StringVar(&keyId, "key", "", "Id of the key to sign with, optional when the file has only one")
+	cmd.Flags().StringVar(&method, "method", "GET", "Method granted by the URL, GET or PUT")
+	cmd.Flags().DurationVar(&ttl, "ttl", time.Hour, "Validity of the URL")
+	cmd.Flags().StringArrayVar(&params, "param", nil, "Query parameter K=V signed with the URL, e.g. versionId=V")
+	cmd.Flags().StringVar(&url, "url", "", "IP:PORT endpoint of the data gate, polled in Consul when empty")
+	return cmd
+}
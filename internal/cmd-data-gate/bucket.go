@@ -0,0 +1,350 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	errBucketPurging = errors.New("Bucket being deleted")
+)
+
+// The value stored in the index for each bucket, in gunkan.IndexBaseBuckets
+type bucketRecord struct {
+	// Default policy of the parts uploaded without HeaderNameObjectPolicy
+	Policy string `json:"policy,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	CTime  int64  `json:"ctime,omitempty"`
+	// Set by a forced delete, until all the parts have been purged
+	Purging bool `json:"purging,omitempty"`
+	// Keep the previous versions of the parts
+	Versioning bool `json:"versioning,omitempty"`
+	// Lifecycle rules, applied by the lifecycle worker
+	Rules []lifecycleRule `json:"rules,omitempty"`
+}
+
+type bucketItem struct {
+	Name string `json:"name"`
+	bucketRecord
+}
+
+type bucketListReply struct {
+	Buckets   []bucketItem `json:"buckets"`
+	Truncated bool         `json:"truncated"`
+	Marker    string       `json:"marker,omitempty"`
+}
+
+func (srv *service) loadBucket(ctx context.Context, bucket string) (*bucketRecord, error) {
+	value, err := srv.loadValue(ctx, gunkan.BK(gunkan.IndexBaseBuckets, bucket))
+	if err != nil {
+		return nil, err
+	}
+	var rec bucketRecord
+	if err = json.Unmarshal([]byte(value), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (srv *service) saveBucket(ctx context.Context, bucket string, rec *bucketRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return srv.index.Put(ctx, gunkan.BK(gunkan.IndexBaseBuckets, bucket), string(b))
+}
+
+func (srv *service) handleBucket() ghttp.RequestHandler {
+	return func(ctx *ghttp.RequestContext) {
+		pre := time.Now()
+		bucket := ctx.Req.URL.Path[len(prefixBucket):]
+		if bucket == "" && ctx.Method() == "GET" {
+			srv.handleBucketList(ctx)
+		} else if !gunkan.ValidateBucketName(bucket) {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid bucket name")
+		} else if _, ok := ctx.Req.URL.Query()["lifecycle"]; ok {
+			srv.handleBucketLifecycle(ctx, bucket)
+		} else {
+			switch ctx.Method() {
+			case "GET", "HEAD":
+				srv.handleBucketGet(ctx, bucket)
+			case "PUT":
+				srv.handleBucketPut(ctx, bucket)
+			case "DELETE":
+				srv.handleBucketDel(ctx, bucket)
+			default:
+				ctx.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}
+		srv.timeBucket.Observe(time.Since(pre).Seconds())
+	}
+}
+
+func (srv *service) handleBucketGet(ctx *ghttp.RequestContext, bucket string) {
+	rec, err := srv.loadBucket(ctx.Req.Context(), bucket)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	ctx.SetHeader(HeaderNameObjectPolicy, rec.Policy)
+	ctx.SetHeader(HeaderNameBucketOwner, rec.Owner)
+	ctx.SetHeader(HeaderNameBucketPurging, strconv.FormatBool(rec.Purging))
+	ctx.SetHeader(HeaderNameBucketVersioning, strconv.FormatBool(rec.Versioning))
+	ctx.SetHeader("Last-Modified", time.Unix(rec.CTime, 0).UTC().Format(http.TimeFormat))
+	if ctx.Method() == "HEAD" {
+		ctx.ReplySuccess()
+		return
+	}
+	ctx.WriteHeader(http.StatusOK)
+	ctx.JSON(bucketItem{Name: bucket, bucketRecord: *rec})
+}
+
+// Create the bucket, or update the default policy of an existing one, as
+// mentioned in the HeaderNameObjectPolicy header. An empty policy resets it.
+// The owner is only set at the creation, the versioning is only changed when
+// HeaderNameBucketVersioning is present.
+func (srv *service) handleBucketPut(ctx *ghttp.RequestContext, bucket string) {
+	name := ctx.Req.Header.Get(HeaderNameObjectPolicy)
+	if name != "" {
+		if _, err := srv.lookupPolicy(name); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	versioning, errVersioning := strconv.ParseBool(ctx.Req.Header.Get(HeaderNameBucketVersioning))
+	if errVersioning != nil && ctx.Req.Header.Get(HeaderNameBucketVersioning) != "" {
+		ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid versioning")
+		return
+	}
+
+	rec, err := srv.loadBucket(ctx.Req.Context(), bucket)
+	created := err == gunkan.ErrNotFound
+	if created {
+		rec = &bucketRecord{
+			Owner: ctx.Req.Header.Get(HeaderNameBucketOwner),
+			CTime: time.Now().Unix(),
+		}
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	} else if rec.Purging {
+		ctx.ReplyCodeError(http.StatusConflict, errBucketPurging)
+		return
+	}
+
+	rec.Policy = name
+	if errVersioning == nil {
+		rec.Versioning = versioning
+	}
+	if err = srv.saveBucket(ctx.Req.Context(), bucket, rec); err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if created {
+		ctx.WriteHeader(http.StatusCreated)
+	} else {
+		ctx.ReplySuccess()
+	}
+}
+
+// Delete an empty bucket. With force=true, a non-empty bucket is flagged and
+// its parts are purged in the background, the record being removed last.
+func (srv *service) handleBucketDel(ctx *ghttp.RequestContext, bucket string) {
+	force, _ := strconv.ParseBool(ctx.Req.URL.Query().Get("force"))
+
+	rec, err := srv.loadBucket(ctx.Req.Context(), bucket)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	if rec.Purging {
+		ctx.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	page, err := srv.list(ctx.Req.Context(), listRequest{bucket: bucket, max: 1})
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	history, err := srv.hasVersions(ctx.Req.Context(), bucket)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if len(page.Items) == 0 && !history {
+		err = srv.index.Delete(ctx.Req.Context(), gunkan.BK(gunkan.IndexBaseBuckets, bucket))
+		if err != nil {
+			ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		} else {
+			ctx.ReplySuccess()
+		}
+		return
+	}
+	if !force {
+		ctx.ReplyCodeErrorMsg(http.StatusConflict, "Bucket not empty")
+		return
+	}
+
+	rec.Purging = true
+	if err = srv.saveBucket(ctx.Req.Context(), bucket, rec); err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	go srv.purgeBucket(context.Background(), bucket)
+	ctx.WriteHeader(http.StatusAccepted)
+}
+
+func (srv *service) handleBucketList(ctx *ghttp.RequestContext) {
+	q := ctx.Req.URL.Query()
+	max := uint32(defaultListMax)
+	if smax := q.Get("max"); smax != "" {
+		max64, err := strconv.ParseUint(smax, 10, 32)
+		if err != nil || max64 == 0 {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid max")
+			return
+		}
+		max = uint32(max64)
+	}
+	if max > gunkan.ListHardMax {
+		max = gunkan.ListHardMax
+	}
+
+	rep, err := srv.listBuckets(ctx.Req.Context(), q.Get("m"), max)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	ctx.SetHeader(HeaderNameListTruncated, strconv.FormatBool(rep.Truncated))
+	if rep.Truncated {
+		ctx.SetHeader(HeaderNameListMarker, url.QueryEscape(rep.Marker))
+	}
+	ctx.WriteHeader(http.StatusOK)
+	ctx.JSON(rep)
+}
+
+// Page through the bucket records, skipping the deleted ones
+func (srv *service) listBuckets(ctx context.Context, marker string, max uint32) (*bucketListReply, error) {
+	rep := bucketListReply{Buckets: make([]bucketItem, 0)}
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseBuckets, marker), max-uint32(len(rep.Buckets))+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return &rep, nil
+		}
+		for _, key := range keys {
+			rec, err := srv.loadBucket(ctx, key)
+			if err == gunkan.ErrNotFound {
+				marker = key
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if uint32(len(rep.Buckets)) >= max {
+				rep.Truncated = true
+				rep.Marker = marker
+				return &rep, nil
+			}
+			rep.Buckets = append(rep.Buckets, bucketItem{Name: key, bucketRecord: *rec})
+			marker = key
+		}
+	}
+}
+
+// Delete all the parts of the bucket and their history, then the bucket record. The parts
+// uploaded concurrently are refused while the bucket is flagged. A part deleted
+// meanwhile is skipped, a part replaced meanwhile leaves the purge to its next
+// attempt, see runBucketPurges().
+func (srv *service) purgeBucket(ctx context.Context, bucket string) {
+	if _, running := srv.purges.LoadOrStore(bucket, true); running {
+		return
+	}
+	defer srv.purges.Delete(bucket)
+
+	logger := gunkan.Logger.With().Str("bucket", bucket).Logger()
+	logger.Info().Msg("Bucket purge started")
+	marker := ""
+	changed := false
+	for {
+		page, err := srv.list(ctx, listRequest{bucket: bucket, marker: marker, max: defaultListMax})
+		if err != nil {
+			logger.Warn().Err(err).Msg("Bucket purge interrupted")
+			return
+		}
+		for _, item := range page.Items {
+			id := gunkan.PartId{Bucket: bucket, Content: item.Content, PartId: item.Part}
+			err = srv.deletePart(ctx, id)
+			if err == gunkan.ErrPrecondition {
+				changed = true
+			} else if err != nil && err != gunkan.ErrNotFound {
+				logger.Warn().Str("part", id.Encode()).Err(err).Msg("Bucket purge interrupted")
+				return
+			}
+			marker = id.IndexKey().Key
+		}
+		if !page.Truncated {
+			break
+		}
+	}
+	if changed {
+		logger.Info().Msg("Bucket purge postponed, parts changed")
+		return
+	}
+	if err := srv.purgeVersions(ctx, bucket); err != nil {
+		logger.Warn().Err(err).Msg("Bucket purge interrupted")
+		return
+	}
+	if err := srv.index.Delete(ctx, gunkan.BK(gunkan.IndexBaseBuckets, bucket)); err != nil {
+		logger.Warn().Err(err).Msg("Bucket purge interrupted")
+		return
+	}
+	logger.Info().Msg("Bucket purge done")
+}
+
+// Periodically resume the purges interrupted by a failure or by a restart of
+// the service
+func (srv *service) runBucketPurges(ctx context.Context) {
+	for {
+		srv.resumeBucketPurges(ctx)
+		select {
+		case <-time.After(bucketPurgePeriod):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Resume the purges of the flagged buckets, unless they already run on this gate
+func (srv *service) resumeBucketPurges(ctx context.Context) {
+	marker := ""
+	for {
+		rep, err := srv.listBuckets(ctx, marker, defaultListMax)
+		if err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Bucket purges not resumed")
+			return
+		}
+		for _, b := range rep.Buckets {
+			if b.Purging {
+				srv.purgeBucket(ctx, b.Name)
+			}
+		}
+		if !rep.Truncated {
+			return
+		}
+		marker = rep.Marker
+	}
+}
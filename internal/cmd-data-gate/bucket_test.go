@@ -0,0 +1,116 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketLifecycle(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+prefixBucket+"b", nil)
+	req.Header.Set(HeaderNameBucketOwner, "alice")
+	rep, err := http.DefaultClient.Do(req)
+	if err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("create", err, rep)
+	}
+	testCall(t, "PUT", ts.URL+prefixBucket+"b", nil, http.StatusNoContent)
+	testCall(t, "PUT", ts.URL+prefixBucket+"empty", nil, http.StatusCreated)
+	rep = testCall(t, "HEAD", ts.URL+prefixBucket+"b", nil, http.StatusNoContent)
+	if rep.Header.Get(HeaderNameBucketOwner) != "alice" {
+		t.Fatal("Unexpected owner", rep.Header.Get(HeaderNameBucketOwner))
+	}
+
+	rep = testCall(t, "GET", ts.URL+prefixBucket+"?max=1", nil, http.StatusOK)
+	var list bucketListReply
+	err = json.NewDecoder(rep.Body).Decode(&list)
+	rep.Body.Close()
+	if err != nil || len(list.Buckets) != 1 || list.Buckets[0].Name != "b" || !list.Truncated {
+		t.Fatal("Unexpected list", err, list)
+	}
+
+	testCall(t, "PUT", ts.URL+prefixData+"b/c/0", strings.NewReader("hello"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/d/0", strings.NewReader("world"), http.StatusCreated)
+	testCall(t, "DELETE", ts.URL+prefixBucket+"empty", nil, http.StatusNoContent)
+	testCall(t, "DELETE", ts.URL+prefixBucket+"b", nil, http.StatusConflict)
+	testCall(t, "DELETE", ts.URL+prefixBucket+"b?force=true", nil, http.StatusAccepted)
+
+	for i := 0; ; i++ {
+		rep, err = http.Head(ts.URL + prefixBucket + "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.StatusCode == http.StatusNotFound {
+			break
+		}
+		if i > 100 {
+			t.Fatal("Purge too long")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testCall(t, "GET", ts.URL+prefixData+"b/c/0", nil, http.StatusNotFound)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
+
+// An index where the conditional deletions fail as if the key had changed
+type changingIndex struct {
+	*memIndex
+	changes int
+}
+
+func (idx *changingIndex) CompareAndDelete(ctx context.Context, key gunkan.BaseKey, version uint64) error {
+	if idx.changes > 0 {
+		idx.changes--
+		return gunkan.ErrPrecondition
+	}
+	return idx.memIndex.CompareAndDelete(ctx, key, version)
+}
+
+func TestBucketPurgeRetry(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	testCall(t, "PUT", ts.URL+prefixBucket+"b", nil, http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/c/0", strings.NewReader("hello"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/d/0", strings.NewReader("world"), http.StatusCreated)
+
+	ctx := context.Background()
+	rec, err := srv.loadBucket(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Purging = true
+	if err = srv.saveBucket(ctx, "b", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// A part changed during the purge postpones the removal of the bucket
+	srv.index = &changingIndex{srv.index.(*memIndex), 1}
+	srv.purgeBucket(ctx, "b")
+	testCall(t, "HEAD", ts.URL+prefixBucket+"b", nil, http.StatusNoContent)
+
+	srv.resumeBucketPurges(ctx)
+	testCall(t, "HEAD", ts.URL+prefixBucket+"b", nil, http.StatusNotFound)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// readCache keeps the content of the parts recently read. The small parts are
+// kept in memory, the large ones in files of a local directory, each tier
+// being bounded in size and managed as a LRU.
+//
+// Entries are keyed by the part id and the ETag and MTime of its record, so
+// that a new version of the part never hits the entries of the previous one.
+// The entries of a part are also dropped when it is overwritten or deleted
+// through this gate, to reclaim the space early.
+type readCache struct {
+	lock      sync.Mutex
+	threshold int64
+	mem       cacheTier
+	disk      cacheTier
+	dir       string
+	seq       uint64
+}
+
+type cacheTier struct {
+	max   int64
+	used  int64
+	lru   *list.List
+	byKey map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	part string
+	size int64
+	// Set for the entries in memory
+	data []byte
+	// Set for the entries on disk
+	path string
+}
+
+func newCacheTier(max int64) cacheTier {
+	return cacheTier{max: max, lru: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+// The disk tier is disabled when dir is empty or diskMax is zero. The files
+// left in dir by a previous run are removed.
+func newReadCache(memMax, diskMax, threshold int64, dir string) (*readCache, error) {
+	c := &readCache{
+		threshold: threshold,
+		mem:       newCacheTier(memMax),
+		disk:      newCacheTier(0),
+	}
+	if dir != "" && diskMax > 0 {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(dir, "*.cache"))
+		for _, path := range leftovers {
+			_ = os.Remove(path)
+		}
+		c.dir = dir
+		c.disk.max = diskMax
+	}
+	return c, nil
+}
+
+func cacheKey(id gunkan.PartId, rec *partRecord) string {
+	return id.Encode() + "," + rec.ETag + "," + strconv.FormatInt(rec.MTime, 10)
+}
+
+// Returns a stream on the cached content, if any
+func (c *readCache) get(key string) (io.ReadCloser, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elt, ok := c.mem.byKey[key]; ok {
+		c.mem.lru.MoveToFront(elt)
+		return ioutil.NopCloser(bytes.NewReader(elt.Value.(*cacheEntry).data)), true
+	}
+	if elt, ok := c.disk.byKey[key]; ok {
+		e := elt.Value.(*cacheEntry)
+		f, err := os.Open(e.path)
+		if err != nil {
+			gunkan.Logger.Warn().Str("path", e.path).Err(err).Msg("Cache entry lost")
+			c.disk.remove(elt)
+			return nil, false
+		}
+		c.disk.lru.MoveToFront(elt)
+		return f, true
+	}
+	return nil, false
+}
+
+// Wrap the stream on the content of a part, so that the content is kept in
+// the cache once entirely read. Parts too large for their tier are not cached.
+func (c *readCache) fill(part, key string, size int64, r io.ReadCloser) io.ReadCloser {
+	f := &cacheFiller{cache: c, in: r, entry: cacheEntry{key: key, part: part, size: size}}
+	switch {
+	case size <= c.threshold && size <= c.mem.max:
+		f.buf = bytes.NewBuffer(make([]byte, 0, size))
+	case size > c.threshold && size <= c.disk.max:
+		c.lock.Lock()
+		c.seq++
+		f.entry.path = filepath.Join(c.dir, fmt.Sprintf("%016x.cache", c.seq))
+		c.lock.Unlock()
+		file, err := os.Create(f.entry.path + ".tmp")
+		if err != nil {
+			gunkan.Logger.Warn().Str("path", f.entry.path).Err(err).Msg("Cache entry creation")
+			return r
+		}
+		f.file = file
+	default:
+		return r
+	}
+	return f
+}
+
+// Drop all the cached versions of a part
+func (c *readCache) invalidate(part string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, tier := range []*cacheTier{&c.mem, &c.disk} {
+		for elt := tier.lru.Front(); elt != nil; {
+			next := elt.Next()
+			if elt.Value.(*cacheEntry).part == part {
+				tier.remove(elt)
+			}
+			elt = next
+		}
+	}
+}
+
+func (c *readCache) insert(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tier := &c.mem
+	if e.path != "" {
+		tier = &c.disk
+	}
+	// Another reader filled the entry in the meantime
+	if _, ok := tier.byKey[e.key]; ok {
+		tier.drop(e)
+		return
+	}
+	for tier.used+e.size > tier.max && tier.lru.Len() > 0 {
+		tier.remove(tier.lru.Back())
+	}
+	tier.byKey[e.key] = tier.lru.PushFront(e)
+	tier.used += e.size
+}
+
+func (t *cacheTier) remove(elt *list.Element) {
+	e := t.lru.Remove(elt).(*cacheEntry)
+	delete(t.byKey, e.key)
+	t.used -= e.size
+	t.drop(e)
+}
+
+func (t *cacheTier) drop(e *cacheEntry) {
+	if e.path != "" {
+		_ = os.Remove(e.path)
+	}
+}
+
+// cacheFiller copies the content read into a buffer or a file, and inserts
+// the entry in the cache when the expected size has been reached.
+type cacheFiller struct {
+	cache   *readCache
+	in      io.ReadCloser
+	entry   cacheEntry
+	buf     *bytes.Buffer
+	file    *os.File
+	written int64
+	failed  bool
+	done    bool
+}
+
+func (f *cacheFiller) Read(b []byte) (int, error) {
+	n, err := f.in.Read(b)
+	if n > 0 && !f.failed {
+		var errCopy error
+		if f.buf != nil {
+			_, errCopy = f.buf.Write(b[:n])
+		} else {
+			_, errCopy = f.file.Write(b[:n])
+		}
+		f.written += int64(n)
+		f.failed = errCopy != nil || f.written > f.entry.size
+	}
+	if err == io.EOF {
+		f.commit()
+	}
+	return n, err
+}
+
+func (f *cacheFiller) commit() {
+	if f.done {
+		return
+	}
+	f.done = true
+	ok := !f.failed && f.written == f.entry.size
+	if f.buf != nil {
+		if ok {
+			f.entry.data = f.buf.Bytes()
+			f.cache.insert(&f.entry)
+		}
+		return
+	}
+	err := f.file.Close()
+	if ok && err == nil {
+		err = os.Rename(f.entry.path+".tmp", f.entry.path)
+	}
+	if ok && err == nil {
+		f.cache.insert(&f.entry)
+	} else {
+		_ = os.Remove(f.entry.path + ".tmp")
+	}
+}
+
+// A stream closed before its end leaves nothing in the cache
+func (f *cacheFiller) Close() error {
+	f.failed = f.failed || !f.done
+	f.commit()
+	return f.in.Close()
+}
+
+func (srv *service) invalidateCache(id gunkan.PartId) {
+	if srv.cache != nil {
+		srv.cache.invalidate(id.Encode())
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gunkan-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newReadCache(100, 1000, 10, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(key string, data []byte) bool {
+		r, hit := c.get(key)
+		if !hit {
+			r = c.fill("p"+key[:1], key, int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)))
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(got, data) {
+			t.Fatal(key, "data differs")
+		}
+		return hit
+	}
+
+	small := make([]byte, 8)
+	large := make([]byte, 500)
+	if read("a1", small) || !read("a1", small) {
+		t.Fatal("Unexpected memory hit/miss")
+	}
+	if read("b1", large) || !read("b1", large) {
+		t.Fatal("Unexpected disk hit/miss")
+	}
+
+	// The least recently used entries are evicted, and a new version of a
+	// part misses
+	read("c1", large)
+	read("d1", large)
+	if read("b1", large) {
+		t.Fatal("Entry should have been evicted")
+	}
+	if read("a2", small) {
+		t.Fatal("New version should miss")
+	}
+
+	c.invalidate("pa")
+	if read("a1", small) {
+		t.Fatal("Entry should have been invalidated")
+	}
+
+	// A stream closed early is not cached
+	r := c.fill("pe", "e1", int64(len(small)), ioutil.NopCloser(bytes.NewReader(small)))
+	r.Close()
+	if _, hit := c.get("e1"); hit {
+		t.Fatal("Partial entry cached")
+	}
+}
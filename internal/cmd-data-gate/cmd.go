@@ -41,10 +41,13 @@ func MainCommand() *cobra.Command {
 			}
 			httpService := ghttp.NewHttpApi(cfg.addrAnnounce, infoString)
 			httpService.Route(routeList, ghttp.Get(srv.handleList()))
-			httpService.Route(prefixData, srv.handlePart())
+			httpService.Route(prefixData, srv.withPresign(srv.handlePart()))
+			httpService.Route(prefixBucket, srv.handleBucket())
+			httpService.Route(prefixUpload, srv.handleUpload())
+			httpService.Route(routeVersions, ghttp.Get(srv.handleVersions()))
 			err = http.ListenAndServe(cfg.addrBind, httpService.Handler())
 			if err != nil {
-				return errors.New(fmt.Sprintf("HTTP error [%s]", cfg.addrBind, err.Error()))
+				return errors.New(fmt.Sprintf("HTTP error [%s]: %s", cfg.addrBind, err.Error()))
 			}
 			return nil
 		},
@@ -53,8 +56,36 @@ func MainCommand() *cobra.Command {
 	const (
 		publicUsage = "Public address of the service."
 		tlsUsage    = "Path to a directory with the TLS configuration"
+		chunkUsage  = "Size of the slices of data sent to the blob stores"
+		queueUsage  = "Number of chunks a blob store may lag before being abandoned"
+		policyUsage = "Path to a JSON file declaring the storage policies"
+		segUsage    = "Size of the segments of the large parts"
+		ttlUsage    = "Age of the abandoned multipart uploads to reclaim, 0 to keep them"
+		foUsage     = "Delay to retry on another blob store an upload failing at its start"
+		cMemUsage   = "Size of the memory tier of the read cache, 0 to disable it"
+		cDiskUsage  = "Size of the disk tier of the read cache, 0 to disable it"
+		cDirUsage   = "Directory of the disk tier of the read cache"
+		cThrUsage   = "Size of the largest parts cached in memory, the others go on disk"
+		lcUsage     = "Period of the lifecycle worker, 0 to disable it"
+		lcRateUsage = "Max number of deletions per second by the lifecycle worker, 0 for no limit"
+		psKeysUsage = "Path to the keys of the pre-signed URLs, one 'KEYID SECRET' per line"
+		psReqUsage  = "Refuse the part requests without a valid signature, the other routes are not protected"
 	)
 	server.Flags().StringVar(&cfg.dirConfig, "tls", "", tlsUsage)
 	server.Flags().StringVar(&cfg.addrAnnounce, "pub", "", publicUsage)
+	server.Flags().IntVar(&cfg.chunkSize, "chunk", defaultChunkSize, chunkUsage)
+	server.Flags().UintVar(&cfg.sinkQueue, "queue", defaultSinkQueue, queueUsage)
+	server.Flags().Int64Var(&cfg.segmentSize, "segment", defaultSegmentSize, segUsage)
+	server.Flags().DurationVar(&cfg.uploadTTL, "upload-ttl", defaultUploadTTL, ttlUsage)
+	server.Flags().DurationVar(&cfg.failoverDelay, "failover", defaultFailoverDelay, foUsage)
+	server.Flags().Int64Var(&cfg.cacheMem, "cache-mem", 0, cMemUsage)
+	server.Flags().Int64Var(&cfg.cacheDisk, "cache-disk", 0, cDiskUsage)
+	server.Flags().StringVar(&cfg.cacheDir, "cache-dir", "", cDirUsage)
+	server.Flags().Int64Var(&cfg.cacheThreshold, "cache-threshold", defaultCacheThreshold, cThrUsage)
+	server.Flags().StringVar(&cfg.policiesPath, "policies", "", policyUsage)
+	server.Flags().DurationVar(&cfg.lifecyclePeriod, "lifecycle", defaultLifecyclePeriod, lcUsage)
+	server.Flags().Float64Var(&cfg.lifecycleRate, "lifecycle-rate", defaultLifecycleRate, lcRateUsage)
+	server.Flags().StringVar(&cfg.presignKeysPath, "presign-keys", "", psKeysUsage)
+	server.Flags().BoolVar(&cfg.presignRequired, "presign-required", false, psReqUsage)
 	return server
 }
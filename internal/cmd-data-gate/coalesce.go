@@ -0,0 +1,278 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// coalescer shares a single fetch of a part among the concurrent GET requests
+// for the same version of it.
+//
+// Each fetch (a flight) is pumped by a goroutine that keeps the last `window`
+// chunks read. The pump runs at the pace of the fastest reader, and a reader
+// lagging behind the chunks kept is detached: it goes on with its own stream,
+// skipped to where it was. A request may only join a flight that still holds
+// the first chunk of the part.
+type coalescer struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+	chunk   int
+	window  int
+}
+
+type flight struct {
+	c    *coalescer
+	key  string
+	open func() (io.ReadCloser, error)
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// The chunks kept, chunks[0] being the base-th chunk of the part
+	chunks [][]byte
+	base   int
+	// The index of the next chunk the fastest reader will consume
+	front   int
+	readers int
+	opened  bool
+	done    bool
+	err     error
+}
+
+type flightReader struct {
+	f      *flight
+	next   int
+	buf    []byte
+	offset int64
+	// Set once the reader has been detached from the flight
+	own io.ReadCloser
+}
+
+func newCoalescer(chunk, window int) *coalescer {
+	return &coalescer{flights: make(map[string]*flight), chunk: chunk, window: window}
+}
+
+// Returns a stream on the content identified by key, sharing the flight in
+// progress if possible, else starting a new one with open. joined tells if a
+// flight was shared.
+func (c *coalescer) join(key string, open func() (io.ReadCloser, error)) (r io.ReadCloser, joined bool, err error) {
+	c.lock.Lock()
+	f := c.flights[key]
+	if f != nil {
+		f.lock.Lock()
+		if f.base == 0 && !f.done && f.readers > 0 {
+			joined = true
+		} else {
+			f.lock.Unlock()
+		}
+	}
+	if !joined {
+		f = &flight{c: c, key: key, open: open}
+		f.cond = sync.NewCond(&f.lock)
+		c.flights[key] = f
+		f.lock.Lock()
+		go f.pump()
+	}
+	f.readers++
+	c.lock.Unlock()
+
+	// Fail early when the part is not readable at all
+	for !f.opened && f.err == nil {
+		f.cond.Wait()
+	}
+	if !f.opened {
+		f.readers--
+		err = f.err
+		f.lock.Unlock()
+		return nil, joined, err
+	}
+	f.lock.Unlock()
+	return &flightReader{f: f}, joined, nil
+}
+
+func (c *coalescer) forget(f *flight) {
+	c.lock.Lock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	c.lock.Unlock()
+}
+
+func (f *flight) pump() {
+	defer f.c.forget(f)
+
+	in, err := f.open()
+	f.lock.Lock()
+	if err != nil {
+		f.err = err
+		f.done = true
+		f.cond.Broadcast()
+		f.lock.Unlock()
+		return
+	}
+	f.opened = true
+	f.cond.Broadcast()
+	f.lock.Unlock()
+	defer in.Close()
+
+	for {
+		f.lock.Lock()
+		for f.readers > 0 && f.base+len(f.chunks)-f.front >= f.c.window {
+			f.cond.Wait()
+		}
+		if f.readers <= 0 {
+			// All the readers left
+			f.done = true
+			f.lock.Unlock()
+			return
+		}
+		f.lock.Unlock()
+
+		buf := make([]byte, f.c.chunk)
+		n, err := io.ReadFull(in, buf)
+
+		f.lock.Lock()
+		if n > 0 {
+			f.chunks = append(f.chunks, buf[:n])
+			if len(f.chunks) > f.c.window {
+				f.chunks = f.chunks[1:]
+				f.base++
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			f.done = true
+		} else if err != nil {
+			f.err = err
+			f.done = true
+		}
+		done, base := f.done, f.base
+		f.cond.Broadcast()
+		f.lock.Unlock()
+
+		if done {
+			return
+		}
+		if base == 1 {
+			// Not joinable anymore
+			f.c.forget(f)
+		}
+	}
+}
+
+func (r *flightReader) Read(b []byte) (int, error) {
+	if r.own != nil {
+		n, err := r.own.Read(b)
+		r.offset += int64(n)
+		return n, err
+	}
+
+	if len(r.buf) == 0 {
+		f := r.f
+		f.lock.Lock()
+		for {
+			if r.next < f.base {
+				f.readers--
+				f.cond.Broadcast()
+				f.lock.Unlock()
+				if err := r.detach(); err != nil {
+					return 0, err
+				}
+				return r.Read(b)
+			}
+			if r.next < f.base+len(f.chunks) {
+				r.buf = f.chunks[r.next-f.base]
+				r.next++
+				if r.next > f.front {
+					f.front = r.next
+					f.cond.Broadcast()
+				}
+				break
+			}
+			if f.done {
+				err := f.err
+				f.lock.Unlock()
+				if err == nil {
+					err = io.EOF
+				}
+				return 0, err
+			}
+			f.cond.Wait()
+		}
+		f.lock.Unlock()
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Open a stream of its own for a reader too slow for its flight
+func (r *flightReader) detach() error {
+	own, err := r.f.open()
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(ioutil.Discard, own, r.offset); err != nil {
+		_ = own.Close()
+		return err
+	}
+	r.own = own
+	return nil
+}
+
+func (r *flightReader) Close() error {
+	if r.own != nil {
+		return r.own.Close()
+	}
+	if r.f != nil {
+		r.f.lock.Lock()
+		r.f.readers--
+		r.f.cond.Broadcast()
+		r.f.lock.Unlock()
+		r.f = nil
+	}
+	return nil
+}
+
+// Open a stream on the data of a part, through the read cache and the
+// coalescer when they are enabled. The fetch of the data is shared by the
+// requests, it is not bound to the context of any of them.
+func (srv *service) openPart(ctx context.Context, id gunkan.PartId, policy storagePolicy, rec *partRecord) (io.ReadCloser, error) {
+	key := cacheKey(id, rec)
+	if srv.cache != nil {
+		if r, ok := srv.cache.get(key); ok {
+			srv.cacheHits.Inc()
+			return r, nil
+		}
+		srv.cacheMisses.Inc()
+	}
+
+	if srv.coalescer == nil {
+		r, err := srv.getSegmented(ctx, policy, rec)
+		if err == nil && srv.cache != nil {
+			r = srv.cache.fill(id.Encode(), key, rec.Size, r)
+		}
+		return r, err
+	}
+
+	open := func() (io.ReadCloser, error) {
+		r, err := srv.getSegmented(context.Background(), policy, rec)
+		if err == nil && srv.cache != nil {
+			r = srv.cache.fill(id.Encode(), key, rec.Size, r)
+		}
+		return r, err
+	}
+	r, joined, err := srv.coalescer.join(key, open)
+	if joined {
+		srv.getCoalesced.Inc()
+	}
+	return r, err
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Blocks the first read until the gate is closed
+type gatedReader struct {
+	gate chan struct{}
+	in   io.Reader
+}
+
+func (r *gatedReader) Read(b []byte) (int, error) {
+	<-r.gate
+	return r.in.Read(b)
+}
+
+func TestCoalescer(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	c := newCoalescer(100, 20)
+
+	var opened int32
+	gate := make(chan struct{})
+	open := func() (io.ReadCloser, error) {
+		atomic.AddInt32(&opened, 1)
+		return ioutil.NopCloser(&gatedReader{gate: gate, in: bytes.NewReader(data)}), nil
+	}
+	check := func(r io.ReadCloser) {
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Error("data differs", err)
+		}
+	}
+
+	// Concurrent readers share the fetch
+	readers := make([]io.ReadCloser, 0)
+	for i := 0; i < 5; i++ {
+		r, joined, err := c.join("k", open)
+		if err != nil || joined != (i > 0) {
+			t.Fatal(i, joined, err)
+		}
+		readers = append(readers, r)
+	}
+	close(gate)
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.ReadCloser) {
+			defer wg.Done()
+			check(r)
+		}(r)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&opened) != 1 {
+		t.Fatal("Unexpected fetches", opened)
+	}
+
+	// A slow reader goes on with a fetch of its own
+	c = newCoalescer(10, 4)
+	fast, _, _ := c.join("k", open)
+	slow, joined, _ := c.join("k", open)
+	if !joined {
+		t.Fatal("Flight not shared")
+	}
+	check(fast)
+	check(slow)
+	if atomic.LoadInt32(&opened) != 3 {
+		t.Fatal("Unexpected fetches", opened)
+	}
+}
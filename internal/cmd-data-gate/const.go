@@ -7,15 +7,103 @@ package cmd_data_gate
 
 import (
 	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"time"
 )
 
 const (
-	routeList  = "/v1/list"
-	prefixData = "/v1/part/"
-	infoString = "gunkan/data-gate-" + gunkan.VersionString
+	routeList     = "/v1/list"
+	prefixData    = "/v1/part/"
+	prefixBucket  = "/v1/bucket/"
+	prefixUpload  = "/v1/upload/"
+	routeVersions = "/v1/versions"
+	infoString    = "gunkan/data-gate-" + gunkan.VersionString
 )
 
 const (
 	HeaderPrefixCommon     = "X-gk-"
 	HeaderNameObjectPolicy = HeaderPrefixCommon + "obj-policy"
+	HeaderNameObjectClass  = HeaderPrefixCommon + "obj-class"
+	// An HTTP date after which the part is deleted
+	HeaderNameObjectExpires = HeaderPrefixCommon + "obj-expires"
+	// Followed by the name of a user metadata
+	HeaderPrefixMeta = HeaderPrefixCommon + "meta-"
+	// The tags as a query string, e.g. "k1=v1&k2=v2"
+	HeaderNameTagging = HeaderPrefixCommon + "tagging"
+
+	HeaderNameListTruncated = HeaderPrefixCommon + "list-truncated"
+	HeaderNameListMarker    = HeaderPrefixCommon + "list-marker"
+	HeaderNameUploadId      = HeaderPrefixCommon + "upload-id"
+
+	HeaderNameBucketOwner   = HeaderPrefixCommon + "bucket-owner"
+	HeaderNameBucketPurging = HeaderPrefixCommon + "bucket-purging"
+	// "true" or "false", for the versioning of the bucket
+	HeaderNameBucketVersioning = HeaderPrefixCommon + "bucket-versioning"
+	HeaderNameVersionId        = HeaderPrefixCommon + "version-id"
+
+	// The part to copy, as BUCKET/CONTENT/PART
+	HeaderNameCopySource = HeaderPrefixCommon + "copy-source"
+	// "copy" (the default) or "replace"
+	HeaderNameMetadataDirective = HeaderPrefixCommon + "metadata-directive"
+)
+
+const (
+	directiveCopy    = "copy"
+	directiveReplace = "replace"
+)
+
+const (
+	policySingle     = "single"
+	policyReplicated = "replicated"
+	policyErasure    = "ec"
+)
+
+const (
+	// Size of the slices of data pushed to the blob stores
+	defaultChunkSize = 1024 * 1024
+
+	// Size of the segments of the large parts
+	defaultSegmentSize = 1024 * 1024 * 1024
+
+	// Number of chunks a blob store may lag behind the fastest one
+	defaultSinkQueue = 8
+
+	// Number of entries in a page of listing, when not specified
+	defaultListMax = 1000
+
+	// Number of part records fetched at once when listing
+	parallelismList = 8
+
+	// Same limit as S3
+	uploadMaxParts = 10000
+
+	// Number of times a part is published again when a concurrent write
+	// replaced the record it was about to replace
+	publishRetries = 3
+
+	// Age of the multipart uploads reclaimed by the janitor
+	defaultUploadTTL = 24 * time.Hour
+
+	uploadJanitorPeriod = 10 * time.Minute
+
+	// Delay between two attempts to finish the interrupted bucket purges
+	bucketPurgePeriod = 10 * time.Minute
+
+	// Delay to fail an upload over another blob store
+	defaultFailoverDelay = 5 * time.Second
+
+	// Size of the largest parts kept in the memory tier of the read cache
+	defaultCacheThreshold = 1024 * 1024
+
+	// Number of chunks a reader may lag behind the fastest reader of the same
+	// part before being served by a fetch of its own
+	coalesceWindow = 16
+
+	// Limits of the user metadata and the tags of a part, the same as S3
+	metaMaxSize = 2048
+	tagsMax     = 10
+	tagKeyMax   = 128
+	tagValueMax = 256
+
+	defaultLifecyclePeriod = time.Hour
+	defaultLifecycleRate   = 100
 )
@@ -0,0 +1,156 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errSourceChanged = errors.New("Source changed during the copy")
+
+// Server-side copy of a part, triggered by a PUT with the copy-source header.
+// When the target keeps the policy of the source, the BLOB's are shared and
+// reference counted. Otherwise the data is read and written again with the
+// policy of the target.
+func (srv *service) handleBlobCopy(ctx *ghttp.RequestContext, id gunkan.PartId, source string) {
+	srcId, err := parsePartId(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	directive := ctx.Req.Header.Get(HeaderNameMetadataDirective)
+	if directive == "" {
+		directive = directiveCopy
+	}
+	if directive != directiveCopy && directive != directiveReplace {
+		ctx.ReplyCodeError(http.StatusBadRequest, errors.New("Invalid metadata directive"))
+		return
+	}
+
+	src, srcVersion, err := srv.loadPartVersion(ctx.Req.Context(), srcId)
+	if err == nil && src.expired(time.Now()) {
+		err = gunkan.ErrNotFound
+	}
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	srcPolicy, err := policyOfRecord(src)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusInternalServerError, err)
+		return
+	}
+
+	name := ""
+	expires := src.Expires
+	md := partMetadata{Meta: src.Meta, Tags: src.Tags}
+	if directive == directiveReplace {
+		name = ctx.Req.Header.Get(HeaderNameObjectPolicy)
+		if expires, err = parseExpires(ctx); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+		if md, err = parseMetadata(ctx.Req.Header); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	policy, err := srv.resolvePolicy(ctx.Req.Context(), id.Bucket, name)
+	if err == errInvalidPolicy {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	} else if err == errBucketPurging {
+		ctx.ReplyCodeError(http.StatusConflict, err)
+		return
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if directive == directiveCopy {
+		policy = srcPolicy
+	}
+
+	var rec partRecord
+	shared := policy.String() == src.Policy
+	if shared {
+		rec = *src
+		rec.Upload = ""
+		rec.Version = 0
+		err = srv.shareSource(ctx.Req.Context(), srcId, srcVersion, rec.allBlobs())
+	} else {
+		err = srv.copyData(ctx.Req.Context(), id, &rec, src, srcPolicy, policy)
+	}
+	if err == errSourceChanged || err == errBlobReleased {
+		ctx.ReplyCodeError(http.StatusConflict, err)
+		return
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	rec.MTime = time.Now().Unix()
+	rec.Expires = expires
+	md.applyTo(&rec)
+	if err = srv.publishPart(ctx.Req.Context(), id, &rec); err != nil {
+		if shared {
+			srv.releaseBlobs(context.Background(), rec.allBlobs())
+		} else {
+			srv.deleteBlobs(context.Background(), rec.allBlobs())
+		}
+		srv.replyPublishError(ctx, err)
+		return
+	}
+	srv.replyPublished(ctx, &rec)
+}
+
+// Share the BLOB's of the source, then check the source still references
+// them: a source replaced or deleted meanwhile may have released them before
+// they were shared.
+func (srv *service) shareSource(ctx context.Context, srcId gunkan.PartId, version uint64, blobs []blobRecord) error {
+	if err := srv.shareBlobs(ctx, blobs); err != nil {
+		return err
+	}
+	_, current, err := srv.loadValueVersion(ctx, srcId.IndexKey())
+	if err == nil && current != version {
+		err = errSourceChanged
+	} else if err == gunkan.ErrNotFound {
+		err = errSourceChanged
+	}
+	if err != nil {
+		srv.releaseBlobs(context.Background(), blobs)
+	}
+	return err
+}
+
+// Read the data of the source and write it with the policy of the target
+func (srv *service) copyData(ctx context.Context, id gunkan.PartId, rec, src *partRecord, srcPolicy, policy storagePolicy) error {
+	r, err := srv.getSegmented(ctx, srcPolicy, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	blobid := gunkan.BlobId{Bucket: id.Bucket, Content: id.Content, PartId: id.PartId}
+	in := newDigestReader(r)
+	if err = srv.putSegmented(ctx, policy, rec, blobid, in, src.Size); err != nil {
+		return err
+	}
+	if in.size != src.Size {
+		srv.deleteBlobs(context.Background(), rec.allBlobs())
+		return errors.New("Source truncated")
+	}
+	rec.Policy = policy.String()
+	rec.Size = in.size
+	rec.ETag = in.etag()
+	return nil
+}
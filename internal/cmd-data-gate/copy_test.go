@@ -0,0 +1,140 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	copyTo := func(target, source, directive, policy string, expected int) {
+		req, _ := http.NewRequest("PUT", ts.URL+prefixData+target, nil)
+		req.Header.Set(HeaderNameCopySource, source)
+		req.Header.Set(HeaderNameMetadataDirective, directive)
+		req.Header.Set(HeaderNameObjectPolicy, policy)
+		rep, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep.Body.Close()
+		if rep.StatusCode != expected {
+			t.Fatal("copy", target, rep.StatusCode, rep.Header.Get("X-Error"))
+		}
+	}
+	check := func(target string) {
+		rep := testCall(t, "GET", ts.URL+prefixData+target, nil, http.StatusOK)
+		got, _ := ioutil.ReadAll(rep.Body)
+		rep.Body.Close()
+		if string(got) != "hello" {
+			t.Fatal("Unexpected content", target, string(got))
+		}
+	}
+
+	testCall(t, "PUT", ts.URL+prefixData+"b/src/0", strings.NewReader("hello"), http.StatusCreated)
+	copyTo("b/dst/0", "b/src/0", "", "", http.StatusCreated)
+	copyTo("b/other/0", "b/src/0", directiveReplace, policySingle, http.StatusCreated)
+	copyTo("b/none/0", "b/missing/0", "", "", http.StatusNotFound)
+	copyTo("b/none/0", "b/src/0", "move", "", http.StatusBadRequest)
+	used := len(stores[0].blobs)
+
+	// The shared BLOB's survive the deletion of the source
+	testCall(t, "DELETE", ts.URL+prefixData+"b/src/0", nil, http.StatusNoContent)
+	check("b/dst/0")
+	check("b/other/0")
+	if len(stores[0].blobs) != used {
+		t.Fatal("Shared BLOB deleted")
+	}
+
+	testCall(t, "DELETE", ts.URL+prefixData+"b/dst/0", nil, http.StatusNoContent)
+	testCall(t, "DELETE", ts.URL+prefixData+"b/other/0", nil, http.StatusNoContent)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	srv, _ := newTestService(1)
+	ctx := context.Background()
+	blobs := []blobRecord{{Url: "127.0.0.1:6000", Real: "shared"}}
+
+	// The concurrent copies do not lose references
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.shareBlobs(ctx, blobs); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refs, _, err := srv.loadBlobRefs(ctx, blobs[0]); err != nil || refs != 17 {
+		t.Fatal(refs, err)
+	}
+
+	// A BLOB being removed cannot be shared
+	_ = srv.index.Put(ctx, blobRefKey(blobs[0]), "0")
+	if err := srv.shareBlobs(ctx, blobs); err != errBlobReleased {
+		t.Fatal(err)
+	}
+}
+
+// Of the concurrent copies onto the same part, each BLOB shared is released
+// once, by the write that replaced it or by the write that lost the race
+func TestCopyConcurrent(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	testCall(t, "PUT", ts.URL+prefixData+"b/src/0", strings.NewReader("hello"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/dst/0", strings.NewReader("world"), http.StatusCreated)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("PUT", ts.URL+prefixData+"b/dst/0", nil)
+			req.Header.Set(HeaderNameCopySource, "b/src/0")
+			rep, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rep.Body.Close()
+			if rep.StatusCode != http.StatusCreated && rep.StatusCode != http.StatusConflict {
+				t.Error("copy", rep.StatusCode, rep.Header.Get("X-Error"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	testCall(t, "DELETE", ts.URL+prefixData+"b/dst/0", nil, http.StatusNoContent)
+	rep := testCall(t, "GET", ts.URL+prefixData+"b/src/0", nil, http.StatusOK)
+	got, _ := ioutil.ReadAll(rep.Body)
+	rep.Body.Close()
+	if string(got) != "hello" {
+		t.Fatal("Unexpected content", string(got))
+	}
+	testCall(t, "DELETE", ts.URL+prefixData+"b/src/0", nil, http.StatusNoContent)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
@@ -6,10 +6,11 @@
 package cmd_data_gate
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
 	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -30,117 +31,237 @@ func (srv *service) handlePart() ghttp.RequestHandler {
 		case "DELETE":
 			srv.handleBlobDel(ctx, id)
 			srv.timeDel.Observe(time.Since(pre).Seconds())
+		case "POST":
+			if _, ok := ctx.Req.URL.Query()["metadata"]; ok {
+				srv.handleBlobMetadata(ctx, id)
+				srv.timePut.Observe(time.Since(pre).Seconds())
+			} else {
+				ctx.WriteHeader(http.StatusMethodNotAllowed)
+			}
 		default:
 			ctx.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	}
 }
 
-func (srv *service) handleList() ghttp.RequestHandler {
-	h := func(ctx *ghttp.RequestContext) {
-		// Unpack request attributes
-		q := ctx.Req.URL.Query()
-		bucket := q.Get("b")
-		smax := q.Get("max")
-		marker := q.Get("m")
-
-		if !gunkan.ValidateBucketName(bucket) || !gunkan.ValidateContentName(marker) {
-			ctx.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		max64, err := strconv.ParseUint(smax, 10, 32)
-		if err != nil {
-			ctx.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		max32 := uint32(max64)
-
-		// Query the index about a slice of items
-		addr, err := srv.lb.PollIndexGate()
-		if err != nil {
-			ctx.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+func (srv *service) handleBlobDel(ctx *ghttp.RequestContext, tail string) {
+	id, err := parsePartId(tail)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
 
-		client, err := gunkan.DialIndexGrpc(addr, srv.config.dirConfig)
-		if err != nil {
-			ctx.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	version, set, err := parseVersionId(ctx)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	if set {
+		err = srv.deleteVersion(ctx.Req.Context(), id, version)
+	} else {
+		version, err = srv.deleteLatest(ctx.Req.Context(), id)
+	}
 
-		tab, err := client.List(ctx.Req.Context(), gunkan.BK(bucket, marker), max32)
-		if err != nil {
-			ctx.ReplyError(err)
-			return
+	if err == gunkan.ErrNotFound {
+		ctx.ReplyError(err)
+	} else if err == gunkan.ErrPrecondition {
+		ctx.ReplyCodeErrorMsg(http.StatusConflict, "Part changed during the deletion")
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+	} else {
+		if version != 0 {
+			ctx.SetHeader(HeaderNameVersionId, strconv.FormatUint(version, 10))
 		}
+		ctx.ReplySuccess()
+	}
+}
 
-		if len(tab) <= 0 {
-			ctx.WriteHeader(http.StatusNoContent)
-		} else {
-			for _, item := range tab {
-				fmt.Println(item)
-			}
-		}
+// Remove the part from the index, then release its BLOB's unless they belong
+// to a version in the history. The removal fails with gunkan.ErrPrecondition
+// when the part changed since it was loaded, so that the BLOB's are released
+// once, by the single deletion that succeeded.
+func (srv *service) deletePart(ctx context.Context, id gunkan.PartId) error {
+	rec, version, err := srv.loadPartVersion(ctx, id)
+	if err != nil {
+		return err
 	}
-	return func(ctx *ghttp.RequestContext) {
-		pre := time.Now()
-		h(ctx)
-		srv.timeList.Observe(time.Since(pre).Seconds())
+	if err = srv.index.CompareAndDelete(ctx, id.IndexKey(), version); err != nil {
+		return err
 	}
+	srv.invalidateCache(id)
+	if rec.Version == 0 {
+		srv.releaseBlobs(ctx, rec.allBlobs())
+	}
+	return nil
 }
 
-func (srv *service) handleBlobDel(ctx *ghttp.RequestContext, blobid string) {
-	ctx.WriteHeader(http.StatusNotImplemented)
-}
+func (srv *service) handleBlobGet(ctx *ghttp.RequestContext, tail string) {
+	id, err := parsePartId(tail)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
 
-func (srv *service) handleBlobGet(ctx *ghttp.RequestContext, blobid string) {
-	ctx.WriteHeader(http.StatusNotImplemented)
-}
+	var rec *partRecord
+	version, set, err := parseVersionId(ctx)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	} else if set {
+		rec, err = srv.loadVersion(ctx.Req.Context(), id, version)
+		if err == nil && rec.Deleted {
+			err = gunkan.ErrNotFound
+		}
+	} else {
+		rec, err = srv.loadPart(ctx.Req.Context(), id)
+	}
+	if err == nil && rec.expired(time.Now()) {
+		err = gunkan.ErrNotFound
+	}
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
 
-func (srv *service) handleBlobPut(ctx *ghttp.RequestContext, tail string) {
-	var err error
-	var policy string
+	policy, err := policyOfRecord(rec)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusInternalServerError, err)
+		return
+	}
 
-	// Unpack the object name
-	tokens := strings.Split(tail, "/")
-	if len(tokens) != 3 {
-		ctx.ReplyCodeError(http.StatusBadRequest, errors.New("3 tokens expected"))
+	ctx.SetHeader(HeaderNameObjectPolicy, rec.Policy)
+	if rec.Class != "" {
+		ctx.SetHeader(HeaderNameObjectClass, rec.Class)
+	}
+	ctx.SetHeader("ETag", rec.ETag)
+	if rec.Version != 0 {
+		ctx.SetHeader(HeaderNameVersionId, strconv.FormatUint(rec.Version, 10))
+	}
+	rec.setMetadataHeaders(ctx)
+	ctx.SetHeader("Last-Modified", time.Unix(rec.MTime, 0).UTC().Format(http.TimeFormat))
+	ctx.SetHeader("Content-Length", strconv.FormatInt(rec.Size, 10))
+	ctx.SetHeader("Content-Type", "octet/stream")
+	if ctx.Method() == "HEAD" {
+		ctx.WriteHeader(http.StatusOK)
 		return
 	}
 
-	var id gunkan.BlobId
-	id.Bucket = tokens[0]
-	id.Content = tokens[1]
-	id.PartId = tokens[2]
+	r, err := srv.openPart(ctx.Req.Context(), id, policy, rec)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	defer r.Close()
 
-	// Locate the storage policy
-	policy = ctx.Req.Header.Get(HeaderNameObjectPolicy)
-	if policy == "" {
-		policy = "single"
+	ctx.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(ctx.Output(), r); err != nil {
+		ctx.Err = err
 	}
+}
 
-	// Find a set of backends
-	// FIXME(jfsmig): Dumb implementation that only accept the "SINGLE COPY" policy
-	var url string
-	url, err = srv.lb.PollBlobStore()
+func (srv *service) handleBlobPut(ctx *ghttp.RequestContext, tail string) {
+	id, err := parsePartId(tail)
 	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	if source := ctx.Req.Header.Get(HeaderNameCopySource); source != "" {
+		srv.handleBlobCopy(ctx, id, source)
+		return
+	}
+	expires, err := parseExpires(ctx)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	md, err := parseMetadata(ctx.Req.Header)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	// Locate the storage policy
+	name := ctx.Req.Header.Get(HeaderNameObjectPolicy)
+	policy, err := srv.resolvePolicy(ctx.Req.Context(), id.Bucket, name)
+	if err == errInvalidPolicy {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	} else if err == errBucketPurging {
+		ctx.ReplyCodeError(http.StatusConflict, err)
+		return
+	} else if err != nil {
 		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
 		return
 	}
 
-	var realid string
-	var client gunkan.BlobClient
-	client, err = gunkan.DialBlob(url)
+	var rec partRecord
+	blobid := gunkan.BlobId{Bucket: id.Bucket, Content: id.Content, PartId: id.PartId}
+	in := newDigestReader(ctx.Input())
+	err = srv.putSegmented(ctx.Req.Context(), policy, &rec, blobid, in, ctx.Req.ContentLength)
 	if err != nil {
-		ctx.ReplyCodeError(http.StatusInternalServerError, err)
+		srv.replyUploadError(ctx, in, err)
 		return
 	}
 
-	realid, err = client.Put(ctx.Req.Context(), id, ctx.Input())
-	if err != nil {
-		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+	rec.Policy = policy.String()
+	rec.Size = in.size
+	rec.ETag = in.etag()
+	rec.MTime = time.Now().Unix()
+	rec.Expires = expires
+	md.applyTo(&rec)
+	if err = srv.publishPart(ctx.Req.Context(), id, &rec); err != nil {
+		srv.deleteBlobs(context.Background(), rec.allBlobs())
+		srv.replyPublishError(ctx, err)
 		return
 	}
-	ctx.SetHeader(HeaderPrefixCommon+"part-read-id", realid)
+	srv.replyPublished(ctx, &rec)
+}
+
+// The client is blamed for a body shorter than its Content-Length, the
+// storage for any other failure
+func (srv *service) replyUploadError(ctx *ghttp.RequestContext, in *digestReader, err error) {
+	if in.truncated(ctx.Req.ContentLength) {
+		ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Body truncated")
+	} else {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+	}
+}
+
+func (srv *service) replyPublishError(ctx *ghttp.RequestContext, err error) {
+	if err == gunkan.ErrPrecondition {
+		ctx.ReplyCodeErrorMsg(http.StatusConflict, "Part changed during the write")
+	} else {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+	}
+}
+
+func (srv *service) replyPublished(ctx *ghttp.RequestContext, rec *partRecord) {
+	ctx.SetHeader(HeaderNameObjectPolicy, rec.Policy)
+	if rec.Class != "" {
+		ctx.SetHeader(HeaderNameObjectClass, rec.Class)
+	}
+	ctx.SetHeader("ETag", rec.ETag)
+	if rec.Version != 0 {
+		ctx.SetHeader(HeaderNameVersionId, strconv.FormatUint(rec.Version, 10))
+	}
 	ctx.WriteHeader(http.StatusCreated)
 }
+
+// Unpack a part name made of at least 3 tokens: BUCKET/CONTENT/PART
+// The content name may contain slashes, not the bucket name nor the part id.
+func parsePartId(tail string) (gunkan.PartId, error) {
+	var id gunkan.PartId
+	first := strings.IndexByte(tail, '/')
+	last := strings.LastIndexByte(tail, '/')
+	if first < 0 || first == last {
+		return id, errors.New("3 tokens expected")
+	}
+
+	id.Bucket = tail[:first]
+	id.Content = tail[first+1 : last]
+	id.PartId = tail[last+1:]
+	if !gunkan.ValidateBucketName(id.Bucket) || !gunkan.ValidateContentName(id.Content) || id.PartId == "" || strings.IndexByte(id.PartId, ',') >= 0 {
+		return id, errors.New("Invalid part name")
+	}
+	return id, nil
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lifecycle worker periodically deletes:
+//  - the parts whose HeaderNameObjectExpires date has passed, found through
+//    the gunkan.IndexBaseExpiry base where each expiring part has an entry
+//    sorted by date;
+//  - the parts matching a rule of their bucket with an age in Days;
+//  - the non-current versions matching a rule with NoncurrentDays, the age
+//    of a version counting from the time it was replaced.
+// The deletions are paced and each one is logged. Each data gate runs its own
+// worker: the deletions are conditional, so that the workers of several gates
+// deleting the same part add a single delete marker, and the workers removing
+// the same version release its BLOB's once.
+
+const secondsPerDay = 24 * 3600
+
+type lifecycleRule struct {
+	Prefix string `json:"prefix,omitempty"`
+	// Age in days of the latest versions to delete, 0 to keep them
+	Days int `json:"days,omitempty"`
+	// Days since the versions became non-current, 0 to keep them
+	NoncurrentDays int `json:"noncurrent_days,omitempty"`
+}
+
+type lifecycleConfig struct {
+	Rules []lifecycleRule `json:"rules"`
+}
+
+func (cfg *lifecycleConfig) validate() error {
+	for _, r := range cfg.Rules {
+		if r.Days < 0 || r.NoncurrentDays < 0 || (r.Days == 0 && r.NoncurrentDays == 0) {
+			return errors.New("Invalid lifecycle rule")
+		}
+	}
+	return nil
+}
+
+// The key of the entry of an expiring part, sorted by date
+func expiryKey(id gunkan.PartId, expires int64) gunkan.BaseKey {
+	return gunkan.BK(gunkan.IndexBaseExpiry, fmt.Sprintf("%016X,%s,%s", expires, id.Bucket, id.IndexKey().Key))
+}
+
+func parseExpiryKey(key string) (gunkan.PartId, int64, error) {
+	var id gunkan.PartId
+	tokens := strings.SplitN(key, ",", 3)
+	if len(tokens) != 3 {
+		return id, 0, errors.New("Invalid expiry key")
+	}
+	expires, err := strconv.ParseInt(tokens[0], 16, 64)
+	if err != nil {
+		return id, 0, err
+	}
+	id.Bucket = tokens[1]
+	id.Content, id.PartId = splitIndexKey(tokens[2])
+	return id, expires, nil
+}
+
+// Returns the expiration date of a new part, as a Unix time, 0 if none
+func parseExpires(ctx *ghttp.RequestContext) (int64, error) {
+	s := ctx.Req.Header.Get(HeaderNameObjectExpires)
+	if s == "" {
+		return 0, nil
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, errors.New("Invalid expiration date")
+	}
+	return t.Unix(), nil
+}
+
+func (rec *partRecord) expired(now time.Time) bool {
+	return rec.Expires != 0 && rec.Expires <= now.Unix()
+}
+
+// Register the part for its expiration, before it is published
+func (srv *service) scheduleExpiry(ctx context.Context, id gunkan.PartId, rec *partRecord) error {
+	if rec.Expires == 0 {
+		return nil
+	}
+	return srv.index.Put(ctx, expiryKey(id, rec.Expires), "1")
+}
+
+func (srv *service) handleBucketLifecycle(ctx *ghttp.RequestContext, bucket string) {
+	rec, err := srv.loadBucket(ctx.Req.Context(), bucket)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	switch ctx.Method() {
+	case "GET":
+		ctx.WriteHeader(http.StatusOK)
+		ctx.JSON(lifecycleConfig{Rules: rec.Rules})
+		return
+	case "PUT":
+		var cfg lifecycleConfig
+		if err = json.NewDecoder(ctx.Input()).Decode(&cfg); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+		if err = cfg.validate(); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+		rec.Rules = cfg.Rules
+	case "DELETE":
+		rec.Rules = nil
+	default:
+		ctx.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err = srv.saveBucket(ctx.Req.Context(), bucket, rec); err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	ctx.ReplySuccess()
+}
+
+func (srv *service) runLifecycle(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(srv.config.lifecyclePeriod):
+		case <-ctx.Done():
+			return
+		}
+		if err := srv.applyLifecycle(ctx, time.Now()); err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Lifecycle worker")
+		}
+	}
+}
+
+// lifecyclePass paces the deletions of one pass of the worker
+type lifecyclePass struct {
+	srv  *service
+	now  time.Time
+	pace <-chan time.Time
+}
+
+func (p *lifecyclePass) wait(ctx context.Context) error {
+	if p.pace == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-p.pace:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run one pass of the lifecycle worker, as if it was now
+func (srv *service) applyLifecycle(ctx context.Context, now time.Time) error {
+	p := lifecyclePass{srv: srv, now: now}
+	if srv.config.lifecycleRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / srv.config.lifecycleRate))
+		defer ticker.Stop()
+		p.pace = ticker.C
+	}
+
+	if err := p.expireParts(ctx); err != nil {
+		return err
+	}
+	marker := ""
+	for {
+		rep, err := srv.listBuckets(ctx, marker, defaultListMax)
+		if err != nil {
+			return err
+		}
+		for _, b := range rep.Buckets {
+			for _, rule := range b.Rules {
+				if err = p.applyRule(ctx, b.Name, rule); err != nil {
+					return err
+				}
+			}
+		}
+		if !rep.Truncated {
+			return nil
+		}
+		marker = rep.Marker
+	}
+}
+
+// Delete the parts whose expiration date has passed
+func (p *lifecyclePass) expireParts(ctx context.Context) error {
+	limit := fmt.Sprintf("%016X", p.now.Unix())
+	marker := ""
+	for {
+		keys, err := p.srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseExpiry, marker), defaultListMax)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			if key > limit {
+				return nil
+			}
+			marker = key
+			id, expires, err := parseExpiryKey(key)
+			if err != nil {
+				gunkan.Logger.Warn().Str("key", key).Err(err).Msg("Lifecycle")
+				continue
+			}
+			// The entry is stale when the part has been overwritten
+			rec, err := p.srv.loadPart(ctx, id)
+			if err != nil && err != gunkan.ErrNotFound {
+				return err
+			}
+			if rec != nil && rec.Expires == expires {
+				if err = p.deleteLatest(ctx, id, "expires"); err != nil {
+					return err
+				}
+			}
+			if err = p.srv.index.Delete(ctx, gunkan.BK(gunkan.IndexBaseExpiry, key)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *lifecyclePass) applyRule(ctx context.Context, bucket string, rule lifecycleRule) error {
+	if rule.Days > 0 {
+		deadline := p.now.Unix() - int64(rule.Days)*secondsPerDay
+		req := listRequest{bucket: bucket, prefix: rule.Prefix, max: defaultListMax}
+		for {
+			page, err := p.srv.list(ctx, req)
+			if err != nil {
+				return err
+			}
+			for _, item := range page.Items {
+				if item.MTime <= deadline {
+					id := gunkan.PartId{Bucket: bucket, Content: item.Content, PartId: item.Part}
+					if err = p.deleteLatest(ctx, id, "days"); err != nil {
+						return err
+					}
+				}
+			}
+			if !page.Truncated {
+				break
+			}
+			req.marker = page.Marker
+		}
+	}
+
+	if rule.NoncurrentDays > 0 {
+		deadline := p.now.Unix() - int64(rule.NoncurrentDays)*secondsPerDay
+		// The history lists the versions of a part from the newest, a
+		// version became non-current when the previous item was saved.
+		var newer *versionItem
+		marker := ""
+		for {
+			page, err := p.srv.listVersions(ctx, bucket, rule.Prefix, marker, defaultListMax)
+			if err != nil {
+				return err
+			}
+			for i := range page.Items {
+				item := &page.Items[i]
+				if newer != nil && newer.Content == item.Content && newer.Part == item.Part && newer.MTime <= deadline {
+					id := gunkan.PartId{Bucket: bucket, Content: item.Content, PartId: item.Part}
+					if err = p.deleteVersion(ctx, id, item.Version); err != nil {
+						return err
+					}
+				}
+				newer = item
+			}
+			if !page.Truncated {
+				return nil
+			}
+			marker = page.Marker
+		}
+	}
+	return nil
+}
+
+func (p *lifecyclePass) deleteLatest(ctx context.Context, id gunkan.PartId, reason string) error {
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+	_, err := p.srv.deleteLatest(ctx, id)
+	if err == gunkan.ErrNotFound || err == gunkan.ErrPrecondition {
+		// Deleted by another worker, or written again
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.srv.lifecycleExpired.Inc()
+	gunkan.Logger.Info().Str("part", id.Encode()).Str("reason", reason).Msg("Lifecycle expiration")
+	return nil
+}
+
+func (p *lifecyclePass) deleteVersion(ctx context.Context, id gunkan.PartId, version uint64) error {
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+	err := p.srv.deleteVersion(ctx, id, version)
+	if err == gunkan.ErrNotFound || err == gunkan.ErrPrecondition {
+		// Removed by another worker
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.srv.lifecycleNoncurrent.Inc()
+	gunkan.Logger.Info().Str("part", id.Encode()).Uint64("version", version).Str("reason", "noncurrent").Msg("Lifecycle expiration")
+	return nil
+}
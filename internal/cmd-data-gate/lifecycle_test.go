@@ -0,0 +1,85 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	srv, _ := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+prefixBucket+"b", nil)
+	req.Header.Set(HeaderNameBucketVersioning, "true")
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("bucket", err, rep)
+	}
+	testCall(t, "PUT", ts.URL+prefixBucket+"b?lifecycle", strings.NewReader(`{"rules":[{"days":-1}]}`), http.StatusBadRequest)
+	testCall(t, "PUT", ts.URL+prefixBucket+"b?lifecycle",
+		strings.NewReader(`{"rules":[{"prefix":"tmp/","days":1},{"noncurrent_days":1}]}`), http.StatusNoContent)
+
+	testCall(t, "PUT", ts.URL+prefixData+"b/tmp/a/0", strings.NewReader("a"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/keep/0", strings.NewReader("old"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixData+"b/keep/0", strings.NewReader("new"), http.StatusCreated)
+
+	req, _ = http.NewRequest("PUT", ts.URL+prefixData+"x/expiring/0", strings.NewReader("x"))
+	req.Header.Set(HeaderNameObjectExpires, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("expiring", err, rep)
+	}
+	testCall(t, "GET", ts.URL+prefixData+"x/expiring/0", nil, http.StatusOK)
+
+	if err := srv.applyLifecycle(context.Background(), time.Now().Add(50*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	testCall(t, "GET", ts.URL+prefixData+"b/tmp/a/0", nil, http.StatusNotFound)
+	testCall(t, "GET", ts.URL+prefixData+"b/keep/0", nil, http.StatusOK)
+	testCall(t, "GET", ts.URL+prefixData+"x/expiring/0", nil, http.StatusNotFound)
+
+	// Only the latest version of "keep" is left in its history
+	page, err := srv.listVersions(context.Background(), "b", "keep", "", 10)
+	if err != nil || len(page.Items) != 1 {
+		t.Fatal("Unexpected history", err, page)
+	}
+}
+
+func TestLifecycleConcurrent(t *testing.T) {
+	srv, _ := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+prefixBucket+"b", nil)
+	req.Header.Set(HeaderNameBucketVersioning, "true")
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("bucket", err, rep)
+	}
+	testCall(t, "PUT", ts.URL+prefixBucket+"b?lifecycle", strings.NewReader(`{"rules":[{"days":1}]}`), http.StatusNoContent)
+	testCall(t, "PUT", ts.URL+prefixData+"b/a/0", strings.NewReader("a"), http.StatusCreated)
+
+	// The workers of several gates add a single delete marker
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.applyLifecycle(context.Background(), time.Now().Add(50*time.Hour)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	page, err := srv.listVersions(context.Background(), "b", "a", "", 10)
+	if err != nil || len(page.Items) != 2 || !page.Items[0].Deleted || page.Items[1].Deleted {
+		t.Fatal("Unexpected history", err, page)
+	}
+}
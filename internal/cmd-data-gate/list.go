@@ -0,0 +1,243 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"fmt"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Greater than any valid UTF-8 suffix: a marker made of a common prefix
+// followed by lastRune skips all the keys starting with that prefix.
+const lastRune = "\U0010FFFF"
+
+type listItem struct {
+	Content string `json:"content"`
+	Part    string `json:"part"`
+	Size    int64  `json:"size"`
+	ETag    string `json:"etag"`
+	MTime   int64  `json:"mtime"`
+	Policy  string `json:"policy"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type listReply struct {
+	Items    []listItem `json:"items"`
+	Prefixes []string   `json:"prefixes,omitempty"`
+
+	// Set when the listing stopped because of the max number of entries.
+	// Marker is then the value of the "m" parameter to get the next page.
+	Truncated bool   `json:"truncated"`
+	Marker    string `json:"marker,omitempty"`
+}
+
+type listRequest struct {
+	bucket    string
+	marker    string
+	prefix    string
+	delimiter string
+	max       uint32
+	// Only the parts with all these tags are listed
+	tags map[string]string
+}
+
+// One entry of a page of the index, either a part or a common prefix
+type listEntry struct {
+	key    string
+	prefix string
+	rec    *partRecord
+	err    error
+}
+
+func (srv *service) handleList() ghttp.RequestHandler {
+	h := func(ctx *ghttp.RequestContext) {
+		q := ctx.Req.URL.Query()
+		req := listRequest{
+			bucket:    q.Get("b"),
+			marker:    q.Get("m"),
+			prefix:    q.Get("prefix"),
+			delimiter: q.Get("delimiter"),
+			max:       defaultListMax,
+		}
+		if !gunkan.ValidateBucketName(req.bucket) {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid bucket name")
+			return
+		}
+		if smax := q.Get("max"); smax != "" {
+			max64, err := strconv.ParseUint(smax, 10, 32)
+			if err != nil || max64 == 0 {
+				ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid max")
+				return
+			}
+			req.max = uint32(max64)
+		}
+		if req.max > gunkan.ListHardMax {
+			req.max = gunkan.ListHardMax
+		}
+		var err error
+		if req.tags, err = parseTagFilter(q["tag"]); err != nil {
+			ctx.ReplyCodeError(http.StatusBadRequest, err)
+			return
+		}
+
+		rep, err := srv.list(ctx.Req.Context(), req)
+		if err != nil {
+			ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+			return
+		}
+
+		ctx.SetHeader(HeaderNameListTruncated, strconv.FormatBool(rep.Truncated))
+		if rep.Truncated {
+			ctx.SetHeader(HeaderNameListMarker, url.QueryEscape(rep.Marker))
+		}
+		if q.Get("format") == "json" || ctx.Req.Header.Get("Accept") == "application/json" {
+			ctx.SetHeader("Content-Type", "application/json")
+			ctx.WriteHeader(http.StatusOK)
+			ctx.JSON(rep)
+		} else {
+			ctx.SetHeader("Content-Type", "text/plain")
+			ctx.WriteHeader(http.StatusOK)
+			rep.writeText(ctx)
+		}
+	}
+	return func(ctx *ghttp.RequestContext) {
+		pre := time.Now()
+		h(ctx)
+		srv.timeList.Observe(time.Since(pre).Seconds())
+	}
+}
+
+// One line per entry, the name last because it may contain spaces.
+// E.g. "PRE photos/2020/" then "OBJ 1234 <etag> <mtime> photos/index.html,0"
+func (rep *listReply) writeText(ctx *ghttp.RequestContext) {
+	for _, p := range rep.Prefixes {
+		fmt.Fprintf(ctx.Output(), "PRE %s\n", p)
+	}
+	for _, item := range rep.Items {
+		fmt.Fprintf(ctx.Output(), "OBJ %d %s %d %s,%s\n", item.Size, item.ETag, item.MTime, item.Content, item.Part)
+	}
+}
+
+func (srv *service) list(ctx context.Context, req listRequest) (*listReply, error) {
+	rep := listReply{Items: make([]listItem, 0)}
+	count := uint32(0)
+
+	marker := req.marker
+	if marker < req.prefix {
+		marker = req.prefix
+	}
+
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(req.bucket, marker), req.max-count+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return &rep, nil
+		}
+
+		entries, end := req.filter(keys)
+		srv.loadEntries(ctx, req.bucket, entries)
+
+		for _, e := range entries {
+			if e.err == gunkan.ErrNotFound {
+				// Deleted part
+				marker = e.key
+				continue
+			} else if e.err != nil {
+				return nil, e.err
+			}
+			if e.rec != nil && !e.rec.hasTags(req.tags) {
+				marker = e.key
+				continue
+			}
+			if count >= req.max {
+				rep.Truncated = true
+				rep.Marker = marker
+				return &rep, nil
+			}
+			count++
+			if e.rec == nil {
+				rep.Prefixes = append(rep.Prefixes, e.prefix)
+				marker = e.prefix + lastRune
+			} else {
+				content, part := splitIndexKey(e.key)
+				rep.Items = append(rep.Items, listItem{
+					Content: content,
+					Part:    part,
+					Size:    e.rec.Size,
+					ETag:    e.rec.ETag,
+					MTime:   e.rec.MTime,
+					Policy:  e.rec.Policy,
+					Tags:    e.rec.Tags,
+				})
+				marker = e.key
+			}
+		}
+		if end {
+			return &rep, nil
+		}
+	}
+}
+
+// Keep the keys of the page that match the prefix, and stop at the first
+// common prefix because the next keys sharing it must be skipped. end tells
+// no key after the page can match anymore.
+func (req *listRequest) filter(keys []string) (entries []listEntry, end bool) {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, req.prefix) {
+			return entries, true
+		}
+		if req.delimiter != "" {
+			content, _ := splitIndexKey(key)
+			rest := content[len(req.prefix):]
+			if i := strings.Index(rest, req.delimiter); i >= 0 {
+				prefix := req.prefix + rest[:i+len(req.delimiter)]
+				return append(entries, listEntry{key: key, prefix: prefix}), false
+			}
+		}
+		entries = append(entries, listEntry{key: key})
+	}
+	return entries, false
+}
+
+// Fetch the records of the parts in parallel
+func (srv *service) loadEntries(ctx context.Context, bucket string, entries []listEntry) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelismList)
+	for i := range entries {
+		if entries[i].prefix != "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e *listEntry) {
+			defer wg.Done()
+			content, part := splitIndexKey(e.key)
+			e.rec, e.err = srv.loadPart(ctx, gunkan.PartId{Bucket: bucket, Content: content, PartId: part})
+			<-sem
+		}(&entries[i])
+	}
+	wg.Wait()
+}
+
+// The part identifiers have no comma, the content names may have
+func splitIndexKey(key string) (content, part string) {
+	i := strings.LastIndexByte(key, ',')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
@@ -0,0 +1,220 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// An in-process index, with the semantics of the index gate
+type memIndex struct {
+	sync.Mutex
+	kv  map[gunkan.BaseKey]string
+	ver map[gunkan.BaseKey]uint64
+}
+
+func newMemIndex() *memIndex {
+	return &memIndex{kv: make(map[gunkan.BaseKey]string), ver: make(map[gunkan.BaseKey]uint64)}
+}
+
+// The caller holds the lock
+func (idx *memIndex) set(key gunkan.BaseKey, value string) {
+	idx.kv[key] = value
+	idx.ver[key]++
+}
+
+func (idx *memIndex) Put(ctx context.Context, key gunkan.BaseKey, value string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.set(key, value)
+	return nil
+}
+
+func (idx *memIndex) Get(ctx context.Context, key gunkan.BaseKey) (string, error) {
+	v, _, err := idx.GetVersion(ctx, key)
+	return v, err
+}
+
+func (idx *memIndex) GetVersion(ctx context.Context, key gunkan.BaseKey) (string, uint64, error) {
+	idx.Lock()
+	defer idx.Unlock()
+	if v, ok := idx.kv[key]; ok {
+		return v, idx.ver[key], nil
+	}
+	return "", 0, gunkan.ErrNotFound
+}
+
+func (idx *memIndex) Delete(ctx context.Context, key gunkan.BaseKey) error {
+	return idx.Put(ctx, key, "")
+}
+
+func (idx *memIndex) PutIfAbsent(ctx context.Context, key gunkan.BaseKey, value string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	if idx.kv[key] != "" {
+		return gunkan.ErrPrecondition
+	}
+	idx.set(key, value)
+	return nil
+}
+
+func (idx *memIndex) CompareAndSwap(ctx context.Context, key gunkan.BaseKey, version uint64, value string) error {
+	if version == 0 {
+		return status.Error(codes.InvalidArgument, "Missing version")
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	if idx.kv[key] == "" || idx.ver[key] != version {
+		return gunkan.ErrPrecondition
+	}
+	idx.set(key, value)
+	return nil
+}
+
+func (idx *memIndex) CompareAndDelete(ctx context.Context, key gunkan.BaseKey, version uint64) error {
+	return idx.CompareAndSwap(ctx, key, version, "")
+}
+
+func (idx *memIndex) BatchPut(ctx context.Context, keys []gunkan.BaseKey, values []string) ([]error, error) {
+	errs := make([]error, len(keys))
+	for i, k := range keys {
+		errs[i] = idx.Put(ctx, k, values[i])
+	}
+	return errs, nil
+}
+
+func (idx *memIndex) BatchDelete(ctx context.Context, keys []gunkan.BaseKey) ([]error, error) {
+	errs := make([]error, len(keys))
+	for i, k := range keys {
+		errs[i] = idx.Delete(ctx, k)
+	}
+	return errs, nil
+}
+
+func (idx *memIndex) BatchGet(ctx context.Context, keys []gunkan.BaseKey) ([]string, []error, error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	for i, k := range keys {
+		values[i], errs[i] = idx.Get(ctx, k)
+	}
+	return values, errs, nil
+}
+
+func (idx *memIndex) Scan(ctx context.Context, base string, opts gunkan.IndexScanOptions) (gunkan.IndexIterator, error) {
+	idx.Lock()
+	keys := make([]string, 0)
+	for k, v := range idx.kv {
+		if k.Base == base && v != "" {
+			keys = append(keys, k.Key)
+		}
+	}
+	idx.Unlock()
+	sort.Strings(keys)
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	it := memIterator{}
+	scanner := gunkan.NewIndexScanner(opts)
+	for _, k := range keys {
+		item, emit, done := scanner.Feed(k)
+		if done {
+			break
+		}
+		if emit {
+			it.items = append(it.items, item)
+		}
+	}
+	return &it, nil
+}
+
+type memIterator struct {
+	items []gunkan.IndexItem
+	item  gunkan.IndexItem
+}
+
+func (it *memIterator) Next() bool {
+	if len(it.items) == 0 {
+		return false
+	}
+	it.item, it.items = it.items[0], it.items[1:]
+	return true
+}
+
+func (it *memIterator) Item() gunkan.IndexItem { return it.item }
+func (it *memIterator) Err() error             { return nil }
+func (it *memIterator) Close()                 {}
+
+func (idx *memIndex) List(ctx context.Context, marker gunkan.BaseKey, max uint32) ([]string, error) {
+	idx.Lock()
+	defer idx.Unlock()
+	keys := make([]string, 0)
+	for k := range idx.kv {
+		if k.Base == marker.Base && k.Key > marker.Key {
+			keys = append(keys, k.Key)
+		}
+	}
+	sort.Strings(keys)
+	if uint32(len(keys)) > max {
+		keys = keys[:max]
+	}
+	return keys, nil
+}
+
+func TestList(t *testing.T) {
+	srv, _ := newTestService(1)
+	for _, c := range []string{"a/1", "a/2", "b", "c/x/1", "c/y", "d"} {
+		id := gunkan.PartId{Bucket: "bk", Content: c, PartId: "0"}
+		if err := srv.savePart(context.Background(), id, &partRecord{Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = srv.index.Delete(context.Background(), gunkan.BK("bk", "b,0"))
+
+	type page struct {
+		items    []string
+		prefixes []string
+		marker   string
+	}
+	check := func(req listRequest, expected ...page) {
+		for _, exp := range expected {
+			rep, err := srv.list(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var items []string
+			for _, item := range rep.Items {
+				items = append(items, item.Content)
+			}
+			if !reflect.DeepEqual(items, exp.items) || !reflect.DeepEqual(rep.Prefixes, exp.prefixes) {
+				t.Fatal(req, "unexpected page", items, rep.Prefixes)
+			}
+			if rep.Truncated != (exp.marker != "") || rep.Marker != exp.marker {
+				t.Fatal(req, "unexpected marker", rep.Truncated, rep.Marker)
+			}
+			req.marker = rep.Marker
+		}
+	}
+
+	check(listRequest{bucket: "bk", max: 10},
+		page{items: []string{"a/1", "a/2", "c/x/1", "c/y", "d"}})
+	check(listRequest{bucket: "bk", max: 2},
+		// The deleted parts are skipped by the marker
+		page{items: []string{"a/1", "a/2"}, marker: "b,0"},
+		page{items: []string{"c/x/1", "c/y"}, marker: "c/y,0"},
+		page{items: []string{"d"}})
+	check(listRequest{bucket: "bk", max: 2, delimiter: "/"},
+		page{prefixes: []string{"a/", "c/"}, marker: "c/" + lastRune},
+		page{items: []string{"d"}})
+	check(listRequest{bucket: "bk", max: 10, prefix: "c/", delimiter: "/"},
+		page{items: []string{"c/y"}, prefixes: []string{"c/x/"}})
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"errors"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The user metadata of a part come from the HeaderPrefixMeta headers, their
+// names are kept in lower case. The tags come from the HeaderNameTagging
+// header, as an URL-encoded query string "k1=v1&k2=v2". Both are kept in the
+// record of the part, within the limits of S3.
+
+var (
+	errInvalidMetadata = errors.New("Invalid metadata")
+	errInvalidTags     = errors.New("Invalid tags")
+)
+
+type partMetadata struct {
+	Meta map[string]string
+	Tags map[string]string
+}
+
+func parseTags(encoded string) (map[string]string, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	q, err := url.ParseQuery(encoded)
+	if err != nil || len(q) > tagsMax {
+		return nil, errInvalidTags
+	}
+	tags := make(map[string]string, len(q))
+	for k, v := range q {
+		if k == "" || len(k) > tagKeyMax || len(v) != 1 || len(v[0]) > tagValueMax {
+			return nil, errInvalidTags
+		}
+		tags[k] = v[0]
+	}
+	return tags, nil
+}
+
+func encodeTags(tags map[string]string) string {
+	q := url.Values{}
+	for k, v := range tags {
+		q.Set(k, v)
+	}
+	return q.Encode()
+}
+
+// Collect the user metadata and the tags of a request
+func parseMetadata(h http.Header) (partMetadata, error) {
+	var md partMetadata
+	prefix := http.CanonicalHeaderKey(HeaderPrefixMeta)
+	total := 0
+	for k, v := range h {
+		if !strings.HasPrefix(k, prefix) || len(k) == len(prefix) {
+			continue
+		}
+		if md.Meta == nil {
+			md.Meta = make(map[string]string)
+		}
+		name := strings.ToLower(k[len(prefix):])
+		md.Meta[name] = v[0]
+		total += len(name) + len(v[0])
+	}
+	if total > metaMaxSize {
+		return md, errInvalidMetadata
+	}
+	var err error
+	md.Tags, err = parseTags(h.Get(HeaderNameTagging))
+	return md, err
+}
+
+func (md partMetadata) applyTo(rec *partRecord) {
+	rec.Meta = md.Meta
+	rec.Tags = md.Tags
+}
+
+func (rec *partRecord) setMetadataHeaders(ctx *ghttp.RequestContext) {
+	for k, v := range rec.Meta {
+		ctx.SetHeader(HeaderPrefixMeta+k, v)
+	}
+	if len(rec.Tags) > 0 {
+		ctx.SetHeader(HeaderNameTagging, encodeTags(rec.Tags))
+	}
+}
+
+// Tells if all the tags of the filter are present with the same value
+func (rec *partRecord) hasTags(filter map[string]string) bool {
+	for k, v := range filter {
+		if tag, ok := rec.Tags[k]; !ok || tag != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Replace the metadata and the tags of the part, without rewriting its data.
+// Only the given version is changed, the latest one by default. The records
+// are replaced on the condition they did not change since they were loaded,
+// the request failing with a conflict when it raced with another write.
+func (srv *service) handleBlobMetadata(ctx *ghttp.RequestContext, tail string) {
+	id, err := parsePartId(tail)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	md, err := parseMetadata(ctx.Req.Header)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	version, set, err := parseVersionId(ctx)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	current, currentVersion, err := srv.loadPartVersion(ctx.Req.Context(), id)
+	if err != nil && err != gunkan.ErrNotFound {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	rec := current
+	if set && (current == nil || current.Version != version) {
+		rec = nil
+	} else if current == nil {
+		err = gunkan.ErrNotFound
+	}
+	var entry uint64
+	if err == nil && (rec == nil || rec.Version != 0) {
+		var history *partRecord
+		if rec != nil {
+			version = rec.Version
+		}
+		history, entry, err = srv.loadVersionEntry(ctx.Req.Context(), id, version)
+		if rec == nil {
+			rec = history
+		}
+		if err == nil && history.Deleted {
+			err = gunkan.ErrNotFound
+		}
+	}
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+
+	md.applyTo(rec)
+	if rec == current {
+		err = srv.swapPart(ctx.Req.Context(), id, rec, currentVersion)
+	}
+	if err == nil && rec.Version != 0 {
+		err = srv.swapVersion(ctx.Req.Context(), id, rec, entry)
+	}
+	if err == gunkan.ErrPrecondition {
+		ctx.ReplyCodeErrorMsg(http.StatusConflict, "Part changed during the update")
+		return
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	rec.setMetadataHeaders(ctx)
+	ctx.ReplySuccess()
+}
+
+// Parse the "tag" parameters of a listing, each one as "KEY=VALUE"
+func parseTagFilter(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	filter := make(map[string]string, len(values))
+	for _, v := range values {
+		i := strings.IndexByte(v, '=')
+		if i <= 0 {
+			return nil, errInvalidTags
+		}
+		filter[v[:i]] = v[i+1:]
+	}
+	return filter, nil
+}
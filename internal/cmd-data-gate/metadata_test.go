@@ -0,0 +1,106 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	srv, _ := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	call := func(method, url string, body io.Reader, h map[string]string, expected int) *http.Response {
+		req, _ := http.NewRequest(method, url, body)
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		rep, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep.Body.Close()
+		if rep.StatusCode != expected {
+			t.Fatal(method, url, rep.StatusCode, rep.Header.Get("X-Error"))
+		}
+		return rep
+	}
+	part := ts.URL + prefixData + "b/c/0"
+
+	call("PUT", part, strings.NewReader("a"), map[string]string{HeaderNameTagging: "%%"}, http.StatusBadRequest)
+	call("PUT", part, strings.NewReader("a"), map[string]string{
+		HeaderPrefixMeta + "Color": "blue",
+		HeaderNameTagging:          "env=prod&team=x",
+	}, http.StatusCreated)
+	call("PUT", ts.URL+prefixData+"b/d/0", strings.NewReader("b"), map[string]string{HeaderNameTagging: "env=dev"}, http.StatusCreated)
+
+	rep := call("HEAD", part, nil, nil, http.StatusOK)
+	if rep.Header.Get(HeaderPrefixMeta+"color") != "blue" || rep.Header.Get(HeaderNameTagging) != "env=prod&team=x" {
+		t.Fatal("Unexpected metadata", rep.Header)
+	}
+
+	// A metadata-only update replaces the metadata and keeps the data
+	call("POST", part+"?metadata", nil, map[string]string{HeaderPrefixMeta + "Shape": "round", HeaderNameTagging: "env=dev"}, http.StatusNoContent)
+	rep = call("HEAD", part, nil, nil, http.StatusOK)
+	if rep.Header.Get(HeaderPrefixMeta+"color") != "" || rep.Header.Get(HeaderPrefixMeta+"shape") != "round" || rep.Header.Get("Content-Length") != "1" {
+		t.Fatal("Unexpected metadata", rep.Header)
+	}
+
+	list, err := srv.list(context.Background(), listRequest{bucket: "b", max: 10, tags: map[string]string{"env": "dev"}})
+	if err != nil || len(list.Items) != 2 {
+		t.Fatal("Unexpected listing", err, list)
+	}
+	call("POST", ts.URL+prefixData+"b/d/0?metadata", nil, nil, http.StatusNoContent)
+	list, err = srv.list(context.Background(), listRequest{bucket: "b", max: 10, tags: map[string]string{"env": "dev"}})
+	if err != nil || len(list.Items) != 1 || list.Items[0].Content != "c" {
+		t.Fatal("Unexpected listing", err, list)
+	}
+	call("GET", ts.URL+routeList+"?b=b&tag=env", nil, nil, http.StatusBadRequest)
+}
+
+// An index where a write happens right before each conditional one
+type racingIndex struct {
+	*memIndex
+	race func()
+}
+
+func (idx *racingIndex) CompareAndSwap(ctx context.Context, key gunkan.BaseKey, version uint64, value string) error {
+	idx.race()
+	return idx.memIndex.CompareAndSwap(ctx, key, version, value)
+}
+
+func TestMetadataConflict(t *testing.T) {
+	srv, _ := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	part := ts.URL + prefixData + "b/c/0"
+	testCall(t, "PUT", part, strings.NewReader("a"), http.StatusCreated)
+
+	// The update racing with an overwrite of the part does not restore the
+	// record it loaded
+	idx := srv.index.(*memIndex)
+	overwritten, _ := idx.Get(context.Background(), gunkan.BK("b", "c,0"))
+	srv.index = &racingIndex{idx, func() {
+		_ = idx.Put(context.Background(), gunkan.BK("b", "c,0"), overwritten)
+	}}
+	req, _ := http.NewRequest("POST", part+"?metadata", nil)
+	req.Header.Set(HeaderPrefixMeta+"Color", "red")
+	rep, err := http.DefaultClient.Do(req)
+	if err != nil || rep.StatusCode != http.StatusConflict {
+		t.Fatal("Unexpected reply", err, rep)
+	}
+	rep = testCall(t, "HEAD", part, nil, http.StatusOK)
+	if rep.Header.Get(HeaderPrefixMeta+"color") != "" {
+		t.Fatal("Unexpected metadata", rep.Header)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidPolicy = errors.New("Invalid storage policy")
+)
+
+// storagePolicy tells how the data of a part is spread on the blob stores.
+type storagePolicy interface {
+	// Returns the canonical name of the policy, as saved in the part record
+	String() string
+
+	// Stream the data to the blob stores and report the outcome per BLOB in
+	// the record, with any layout information required to read the data back.
+	// An error is returned if the part cannot be considered as durable.
+	put(ctx context.Context, srv *service, rec *partRecord, id gunkan.BlobId, data io.Reader, size int64) error
+
+	// Open a stream on the data of a part previously stored with the policy
+	get(ctx context.Context, srv *service, rec *partRecord) (io.ReadCloser, error)
+
+	// Returns how many consecutive BlobId.Position a call to put consumes
+	width() uint
+}
+
+// Parse a policy name as sent in the HeaderNameObjectPolicy header. Accepted
+// forms are "single", "replicated:N" and "replicated:N:W", with N the number
+// of copies and W the number of copies required to acknowledge the upload,
+// and "ec:K+M" or "ec:K+M:W" for K data fragments and M parity fragments.
+// By default W is a majority of N for replicated policies, and K+1 for
+// erasure-coded ones.
+func parsePolicy(name string) (storagePolicy, error) {
+	tokens := strings.Split(name, ":")
+	switch tokens[0] {
+	case policySingle:
+		if len(tokens) != 1 {
+			return nil, errInvalidPolicy
+		}
+		return &replicatedPolicy{copies: 1, quorum: 1}, nil
+	case policyReplicated:
+		return parseReplicatedPolicy(tokens[1:])
+	case policyErasure:
+		return parseErasurePolicy(tokens[1:])
+	default:
+		return nil, errInvalidPolicy
+	}
+}
+
+func parseReplicatedPolicy(args []string) (storagePolicy, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errInvalidPolicy
+	}
+	copies, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil || copies < 1 {
+		return nil, errInvalidPolicy
+	}
+	quorum := copies/2 + 1
+	if len(args) == 2 {
+		quorum, err = strconv.ParseUint(args[1], 10, 8)
+		if err != nil || quorum < 1 || quorum > copies {
+			return nil, errInvalidPolicy
+		}
+	}
+	return &replicatedPolicy{copies: uint(copies), quorum: uint(quorum)}, nil
+}
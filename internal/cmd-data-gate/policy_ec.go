@@ -0,0 +1,337 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	helpers_ec "github.com/jfsmig/object-storage/internal/helpers-ec"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	errTooFewFragments = errors.New("Too few fragments available")
+)
+
+// Split the data in stripes of K cells, and write each cell along with the M
+// parity cells of its stripe on K+M distinct blob stores. The i-th fragment is
+// stored with BlobId.Position shifted by i, and its blobRecord.Position is i.
+type erasurePolicy struct {
+	k, m      uint
+	quorum    uint
+	placement gunkan.Placement
+	coder     *helpers_ec.Coder
+}
+
+func newErasurePolicy(k, m, quorum uint) (*erasurePolicy, error) {
+	if k < 1 || quorum < k || quorum > k+m {
+		return nil, errInvalidPolicy
+	}
+	coder, err := helpers_ec.NewCoder(int(k), int(m))
+	if err != nil {
+		return nil, errInvalidPolicy
+	}
+	return &erasurePolicy{k: k, m: m, quorum: quorum, coder: coder}, nil
+}
+
+// By default, one fragment may be lost right after the upload
+func defaultErasureQuorum(k, m uint) uint {
+	if m > 0 {
+		return k + 1
+	}
+	return k
+}
+
+func parseErasurePolicy(args []string) (storagePolicy, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errInvalidPolicy
+	}
+	km := strings.Split(args[0], "+")
+	if len(km) != 2 {
+		return nil, errInvalidPolicy
+	}
+	k, err := strconv.ParseUint(km[0], 10, 8)
+	if err != nil {
+		return nil, errInvalidPolicy
+	}
+	m, err := strconv.ParseUint(km[1], 10, 8)
+	if err != nil {
+		return nil, errInvalidPolicy
+	}
+
+	quorum := defaultErasureQuorum(uint(k), uint(m))
+	if len(args) == 2 {
+		w, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil {
+			return nil, errInvalidPolicy
+		}
+		quorum = uint(w)
+	}
+	return newErasurePolicy(uint(k), uint(m), quorum)
+}
+
+func (p *erasurePolicy) String() string {
+	if p.quorum == defaultErasureQuorum(p.k, p.m) {
+		return fmt.Sprintf("%s:%d+%d", policyErasure, p.k, p.m)
+	}
+	return fmt.Sprintf("%s:%d+%d:%d", policyErasure, p.k, p.m, p.quorum)
+}
+
+func (p *erasurePolicy) width() uint {
+	return p.k + p.m
+}
+
+func (p *erasurePolicy) put(ctx context.Context, srv *service, rec *partRecord, id gunkan.BlobId, data io.Reader, size int64) error {
+	width := int(p.k + p.m)
+	urls, err := srv.lb.PollBlobStoresPlaced(uint(width), p.placement)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The last stripe is padded with zeroes, so that all the fragments have
+	// the same size, known in advance when the size of the part is.
+	cell := srv.config.chunkSize
+	stripe := int64(p.k) * int64(cell)
+	fragment := int64(-1)
+	if size >= 0 {
+		fragment = ((size + stripe - 1) / stripe) * int64(cell)
+	}
+
+	ids := make([]gunkan.BlobId, width)
+	for i := range ids {
+		ids[i] = id
+		ids[i].Position = id.Position + uint(i)
+	}
+	group := srv.newSinkGroup(ctx, urls, ids, fragment, p.quorum, p.placement)
+
+	for {
+		buf := make([]byte, stripe)
+		n, errRead := io.ReadFull(data, buf)
+		if n > 0 {
+			shards := make([][]byte, width)
+			for i := 0; i < int(p.k); i++ {
+				shards[i] = buf[i*cell : (i+1)*cell]
+			}
+			for i := int(p.k); i < width; i++ {
+				shards[i] = make([]byte, cell)
+			}
+			if err = p.coder.Encode(shards); err != nil {
+				break
+			}
+			if err = group.push(ctx, shards); err != nil {
+				break
+			}
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		} else if errRead != nil {
+			err = errRead
+			break
+		}
+	}
+
+	if err != nil {
+		group.abort(err)
+	}
+	blobs, succeeded := group.close()
+	for i := range blobs {
+		blobs[i].Position = uint(i)
+	}
+	if err == nil && succeeded < p.quorum {
+		err = errQuorumNotReached
+	}
+	if err != nil {
+		srv.deleteBlobs(context.Background(), blobs)
+		return err
+	}
+	if succeeded < uint(width) {
+		srv.putDegraded.Inc()
+	}
+	rec.Blobs = blobs
+	rec.Cell = cell
+	return nil
+}
+
+func (p *erasurePolicy) get(ctx context.Context, srv *service, rec *partRecord) (io.ReadCloser, error) {
+	if rec.Cell <= 0 {
+		return nil, errInvalidPolicy
+	}
+	r := &ecReader{
+		ctx:       ctx,
+		srv:       srv,
+		policy:    p,
+		cell:      rec.Cell,
+		remaining: rec.storedSize(),
+		frags:     make([]ecFragment, p.k+p.m),
+	}
+	for _, b := range rec.Blobs {
+		if b.ok() && b.Position < p.k+p.m {
+			r.frags[b.Position].blob = b
+			r.frags[b.Position].known = true
+		}
+	}
+
+	// Fail early when the part is not readable at all
+	if err := r.ensureOpen(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+type ecFragment struct {
+	blob   blobRecord
+	known  bool
+	failed bool
+	r      io.ReadCloser
+}
+
+// ecReader decodes the stripes of an erasure-coded part. It reads from K
+// fragments at once, preferably the data fragments, and replaces a fragment
+// that fails by another one skipped to the current stripe.
+type ecReader struct {
+	ctx    context.Context
+	srv    *service
+	policy *erasurePolicy
+	cell   int
+
+	// Bytes of the part not served yet, padding excluded
+	remaining int64
+	// Bytes consumed so far on each fragment
+	offset int64
+
+	frags []ecFragment
+	buf   []byte
+}
+
+func (r *ecReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+		if err := r.nextStripe(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *ecReader) Close() error {
+	for i := range r.frags {
+		r.drop(i)
+	}
+	return nil
+}
+
+func (r *ecReader) drop(i int) {
+	if r.frags[i].r != nil {
+		_ = r.frags[i].r.Close()
+		r.frags[i].r = nil
+	}
+}
+
+// Open a fragment and skip it to the current stripe
+func (r *ecReader) open(i int) bool {
+	f := &r.frags[i]
+	client, err := r.srv.dialBlob(f.blob.Url)
+	if err == nil {
+		f.r, err = client.Get(r.ctx, f.blob.Real)
+	}
+	if err == nil && r.offset > 0 {
+		_, err = io.CopyN(ioutil.Discard, f.r, r.offset)
+	}
+	if err != nil {
+		gunkan.Logger.Info().Str("url", f.blob.Url).Str("real", f.blob.Real).Err(err).Msg("Fragment unavailable")
+		r.drop(i)
+		f.failed = true
+		return false
+	}
+	return true
+}
+
+// Make sure K fragments are open, trying the data fragments first
+func (r *ecReader) ensureOpen() error {
+	opened := 0
+	for i := range r.frags {
+		if r.frags[i].r != nil {
+			opened++
+		}
+	}
+	for i := range r.frags {
+		if opened >= int(r.policy.k) {
+			return nil
+		}
+		f := &r.frags[i]
+		if f.r != nil || f.failed || !f.known {
+			continue
+		}
+		if r.open(i) {
+			opened++
+		}
+	}
+	if opened < int(r.policy.k) {
+		return errTooFewFragments
+	}
+	return nil
+}
+
+func (r *ecReader) nextStripe() error {
+	width := int(r.policy.k + r.policy.m)
+	shards := make([][]byte, width)
+
+	got := 0
+	for got < int(r.policy.k) {
+		if err := r.ensureOpen(); err != nil {
+			return err
+		}
+		for i := range r.frags {
+			f := &r.frags[i]
+			if f.r == nil || shards[i] != nil {
+				continue
+			}
+			buf := make([]byte, r.cell)
+			if _, err := io.ReadFull(f.r, buf); err != nil {
+				gunkan.Logger.Info().Str("url", f.blob.Url).Str("real", f.blob.Real).Err(err).Msg("Fragment broken")
+				r.drop(i)
+				f.failed = true
+				continue
+			}
+			shards[i] = buf
+			got++
+		}
+	}
+	r.offset += int64(r.cell)
+
+	for i := 0; i < int(r.policy.k); i++ {
+		if shards[i] == nil {
+			if err := r.policy.coder.Reconstruct(shards); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	stripe := make([]byte, 0, int(r.policy.k)*r.cell)
+	for i := 0; i < int(r.policy.k); i++ {
+		stripe = append(stripe, shards[i]...)
+	}
+	if int64(len(stripe)) > r.remaining {
+		stripe = stripe[:r.remaining]
+	}
+	r.remaining -= int64(len(stripe))
+	r.buf = stripe
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+var errStoreDown = errors.New("Blob store down")
+
+// An in-process blob store, that may be turned down
+type memBlobStore struct {
+	sync.Mutex
+	down  bool
+	blobs map[string][]byte
+}
+
+func (s *memBlobStore) isDown() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.down
+}
+
+type memBlobClient struct {
+	store *memBlobStore
+}
+
+func (c *memBlobClient) Put(ctx context.Context, id gunkan.BlobId, data io.Reader) (string, error) {
+	return c.PutN(ctx, id, data, -1)
+}
+
+func (c *memBlobClient) PutN(ctx context.Context, id gunkan.BlobId, data io.Reader, size int64) (string, error) {
+	// Like a refused connection, nothing is read
+	if c.store.isDown() {
+		return "", errStoreDown
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return "", err
+	}
+	if size >= 0 && int64(len(b)) != size {
+		return "", io.ErrUnexpectedEOF
+	}
+	c.store.Lock()
+	defer c.store.Unlock()
+	if c.store.down {
+		return "", errStoreDown
+	}
+	real := fmt.Sprintf("%s-%d", id.Encode(), len(c.store.blobs))
+	c.store.blobs[real] = b
+	return real, nil
+}
+
+func (c *memBlobClient) Get(ctx context.Context, real string) (io.ReadCloser, error) {
+	c.store.Lock()
+	defer c.store.Unlock()
+	if c.store.down {
+		return nil, errStoreDown
+	}
+	b, ok := c.store.blobs[real]
+	if !ok {
+		return nil, gunkan.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (c *memBlobClient) Delete(ctx context.Context, real string) error {
+	c.store.Lock()
+	defer c.store.Unlock()
+	delete(c.store.blobs, real)
+	return nil
+}
+
+func (c *memBlobClient) List(ctx context.Context, max uint) ([]gunkan.BlobListItem, error) {
+	return nil, nil
+}
+
+func (c *memBlobClient) ListAfter(ctx context.Context, max uint, marker string) ([]gunkan.BlobListItem, error) {
+	return nil, nil
+}
+
+// A balancer that always polls the in-process blob stores
+type memBalancer struct {
+	urls []string
+}
+
+func (b *memBalancer) PollDataGate() (string, error) { return "", gunkan.ErrNotFound }
+
+func (b *memBalancer) PollIndexGate() (string, error) { return "", gunkan.ErrNotFound }
+
+func (b *memBalancer) PollBlobStore() (string, error) { return b.urls[0], nil }
+
+func (b *memBalancer) PollBlobStores(count uint) ([]string, error) {
+	if count > uint(len(b.urls)) {
+		return nil, gunkan.ErrNotFound
+	}
+	return b.urls[:count], nil
+}
+
+func (b *memBalancer) PollBlobStoresPlaced(count uint, placement gunkan.Placement) ([]string, error) {
+	return b.PollBlobStores(count)
+}
+
+func (b *memBalancer) PollBlobStoresExcluding(count uint, placement gunkan.Placement, excluded []string) ([]string, error) {
+	out := make([]string, 0, count)
+	for _, url := range b.urls {
+		avoided := false
+		for _, x := range excluded {
+			avoided = avoided || x == url
+		}
+		if !avoided && uint(len(out)) < count {
+			out = append(out, url)
+		}
+	}
+	if uint(len(out)) < count {
+		return nil, gunkan.ErrNotFound
+	}
+	return out, nil
+}
+
+func newTestService(nbStores int) (*service, []*memBlobStore) {
+	stores := make([]*memBlobStore, nbStores)
+	byUrl := make(map[string]*memBlobStore)
+	lb := memBalancer{}
+	for i := range stores {
+		url := fmt.Sprintf("127.0.0.1:%d", 6000+i)
+		stores[i] = &memBlobStore{blobs: make(map[string][]byte)}
+		byUrl[url] = stores[i]
+		lb.urls = append(lb.urls, url)
+	}
+
+	srv := &service{
+		config: config{chunkSize: 1000, sinkQueue: 4},
+		lb:     &lb,
+		index:  newMemIndex(),
+		dialBlob: func(url string) (gunkan.BlobClient, error) {
+			return &memBlobClient{store: byUrl[url]}, nil
+		},
+		putDegraded: prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+	}
+	return srv, stores
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	const k, m = 4, 2
+	srv, stores := newTestService(k + m)
+	policy, err := parsePolicy("ec:4+2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.String() != "ec:4+2" {
+		t.Fatal("Unexpected canonical name", policy.String())
+	}
+
+	// Not a multiple of the stripe, to check the padding is removed
+	data := make([]byte, 12345)
+	rand.Read(data)
+
+	for _, size := range []int64{int64(len(data)), -1} {
+		var rec partRecord
+		err = policy.put(context.Background(), srv, &rec, gunkan.BlobId{Bucket: "b", Content: "c", PartId: "0"}, bytes.NewReader(data), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Size = int64(len(data))
+
+		// Any m stores down must be tolerated, one more is too many
+		for down := 0; down <= m+1; down++ {
+			for i := range stores {
+				stores[i].down = i < down
+			}
+			r, err := policy.get(context.Background(), srv, &rec)
+			if down > m {
+				if err == nil {
+					t.Fatal("Read should have failed")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(down, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(down, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal(down, "data differs")
+			}
+		}
+		for i := range stores {
+			stores[i].down = false
+		}
+	}
+}
+
+func TestErasureQuorum(t *testing.T) {
+	srv, stores := newTestService(6)
+	policy, _ := parsePolicy("ec:4+2")
+
+	// K+1 fragments are required by default
+	stores[0].down = true
+	var rec partRecord
+	err := policy.put(context.Background(), srv, &rec, gunkan.BlobId{}, bytes.NewReader(make([]byte, 5000)), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores[1].down = true
+	err = policy.put(context.Background(), srv, &rec, gunkan.BlobId{}, bytes.NewReader(make([]byte, 5000)), -1)
+	if err != errQuorumNotReached {
+		t.Fatal("Upload should have failed", err)
+	}
+
+	// The fragments of the failed upload are reclaimed
+	for _, s := range stores[2:] {
+		if len(s.blobs) != 1 {
+			t.Fatal("Orphan fragments")
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"os"
+)
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+
+	placementService = ""
+	placementHost    = "host"
+)
+
+// The declaration of a named policy, as found in the configuration file.
+// E.g. {"name": "cold", "type": "ec", "data": 6, "parity": 3,
+// "compression": "gzip", "placement": "host", "class": "COLD"}
+type policyDefinition struct {
+	Name string `json:"name"`
+
+	// One of "single", "replicated" or "ec"
+	Type string `json:"type"`
+
+	// Number of copies of a replicated policy
+	Copies uint `json:"copies,omitempty"`
+	// Number of data and parity fragments of an erasure-coded policy
+	Data   uint `json:"data,omitempty"`
+	Parity uint `json:"parity,omitempty"`
+	// Number of BLOB's required to acknowledge an upload, 0 for the default
+	Quorum uint `json:"quorum,omitempty"`
+
+	// "gzip" or nothing
+	Compression string `json:"compression,omitempty"`
+	// "host" to spread the BLOB's on distinct hosts, nothing for distinct
+	// blob stores only
+	Placement string `json:"placement,omitempty"`
+	// Free label saved with each part and reported to the clients
+	Class string `json:"class,omitempty"`
+}
+
+// The set of policies a data gate accepts.
+type policyRegistry struct {
+	// Name of the policy applied when neither the request nor the bucket
+	// tells one
+	Default  string             `json:"default"`
+	Policies []policyDefinition `json:"policies"`
+
+	byName map[string]storagePolicy
+}
+
+func loadPolicyRegistry(path string) (*policyRegistry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var reg policyRegistry
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&reg); err != nil {
+		return nil, err
+	}
+
+	reg.byName = make(map[string]storagePolicy)
+	for _, def := range reg.Policies {
+		if def.Name == "" {
+			return nil, errors.New("Unnamed policy")
+		}
+		if _, ok := reg.byName[def.Name]; ok {
+			return nil, fmt.Errorf("Duplicated policy [%s]", def.Name)
+		}
+		p, err := def.build()
+		if err != nil {
+			return nil, fmt.Errorf("Policy [%s]: %s", def.Name, err.Error())
+		}
+		reg.byName[def.Name] = p
+	}
+	if _, ok := reg.byName[reg.Default]; !ok {
+		return nil, fmt.Errorf("Unknown default policy [%s]", reg.Default)
+	}
+	return &reg, nil
+}
+
+// Returns the named policy, or the default policy for an empty name
+func (reg *policyRegistry) lookup(name string) (storagePolicy, error) {
+	if name == "" {
+		name = reg.Default
+	}
+	if p, ok := reg.byName[name]; ok {
+		return p, nil
+	}
+	return nil, errInvalidPolicy
+}
+
+func (def *policyDefinition) build() (storagePolicy, error) {
+	var placement gunkan.Placement
+	switch def.Placement {
+	case placementService:
+	case placementHost:
+		placement.DistinctHosts = true
+	default:
+		return nil, errors.New("Invalid placement")
+	}
+
+	switch def.Compression {
+	case compressionNone, compressionGzip:
+	default:
+		return nil, errors.New("Invalid compression")
+	}
+
+	var base storagePolicy
+	switch def.Type {
+	case policySingle:
+		if def.Copies > 1 || def.Data > 0 || def.Parity > 0 {
+			return nil, errInvalidPolicy
+		}
+		base = &replicatedPolicy{copies: 1, quorum: 1, placement: placement}
+	case policyReplicated:
+		if def.Copies < 1 || def.Quorum > def.Copies {
+			return nil, errInvalidPolicy
+		}
+		p := replicatedPolicy{copies: def.Copies, quorum: def.Quorum, placement: placement}
+		if p.quorum == 0 {
+			p.quorum = p.copies/2 + 1
+		}
+		base = &p
+	case policyErasure:
+		quorum := def.Quorum
+		if quorum == 0 {
+			quorum = defaultErasureQuorum(def.Data, def.Parity)
+		}
+		p, err := newErasurePolicy(def.Data, def.Parity, quorum)
+		if err != nil {
+			return nil, err
+		}
+		p.placement = placement
+		base = p
+	default:
+		return nil, errors.New("Invalid type")
+	}
+
+	return &namedPolicy{
+		name:        def.Name,
+		base:        base,
+		compression: def.Compression,
+		class:       def.Class,
+	}, nil
+}
+
+// namedPolicy adds the optional compression of the data on top of a layout
+// policy. The part records keep the layout, so that the parts remain readable
+// when their named policy is altered or removed from the registry.
+type namedPolicy struct {
+	name        string
+	base        storagePolicy
+	compression string
+	class       string
+}
+
+func (p *namedPolicy) String() string {
+	return p.name
+}
+
+func (p *namedPolicy) put(ctx context.Context, srv *service, rec *partRecord, id gunkan.BlobId, data io.Reader, size int64) error {
+	rec.Layout = p.base.String()
+	rec.Compression = p.compression
+	rec.Class = p.class
+
+	if p.compression != compressionGzip {
+		return p.base.put(ctx, srv, rec, id, data, size)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, data)
+		if err == nil {
+			err = zw.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	zr := &countingReader{in: pr}
+	err := p.base.put(ctx, srv, rec, id, zr, -1)
+	// Unblock the compressor when the upload failed before the end of the data
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	rec.Stored = zr.size
+	return err
+}
+
+func (p *namedPolicy) width() uint {
+	return p.base.width()
+}
+
+func (p *namedPolicy) get(ctx context.Context, srv *service, rec *partRecord) (io.ReadCloser, error) {
+	r, err := p.base.get(ctx, srv, rec)
+	if err != nil || p.compression != compressionGzip {
+		return r, err
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, in: r}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	in io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.in.Close()
+}
+
+// Returns the policy to decode a part, relying only on its record
+func policyOfRecord(rec *partRecord) (storagePolicy, error) {
+	layout := rec.Layout
+	if layout == "" {
+		layout = rec.Policy
+	}
+	base, err := parsePolicy(layout)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Compression == compressionNone {
+		return base, nil
+	}
+	if rec.Compression != compressionGzip {
+		return nil, errors.New("Invalid compression")
+	}
+	return &namedPolicy{name: rec.Policy, base: base, compression: rec.Compression, class: rec.Class}, nil
+}
+
+// Select the policy of a new part: the one explicitly requested, then the
+// default policy of the bucket, then the default policy of the registry.
+// Without registry, the policies are parsed from their name. No new part is
+// accepted in a bucket being purged.
+func (srv *service) resolvePolicy(ctx context.Context, bucket, name string) (storagePolicy, error) {
+	b, err := srv.loadBucket(ctx, bucket)
+	if err == nil {
+		if b.Purging {
+			return nil, errBucketPurging
+		}
+		if name == "" {
+			name = b.Policy
+		}
+	} else if err != gunkan.ErrNotFound {
+		return nil, err
+	}
+	return srv.lookupPolicy(name)
+}
+
+func (srv *service) lookupPolicy(name string) (storagePolicy, error) {
+	if srv.policies != nil {
+		return srv.policies.lookup(name)
+	}
+	if name == "" {
+		name = policySingle
+	}
+	return parsePolicy(name)
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNamedPolicyCompressed(t *testing.T) {
+	srv, stores := newTestService(6)
+	def := policyDefinition{Name: "cold", Type: policyErasure, Data: 4, Parity: 2, Compression: compressionGzip, Class: "COLD"}
+	policy, err := def.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressible enough to be much shorter than the stripe
+	data := bytes.Repeat([]byte("gunkan"), 5000)
+	var rec partRecord
+	err = policy.put(context.Background(), srv, &rec, gunkan.BlobId{}, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Policy = policy.String()
+	rec.Size = int64(len(data))
+	if rec.Layout != "ec:4+2" || rec.Class != "COLD" || rec.Stored <= 0 || rec.Stored >= rec.Size {
+		t.Fatal("Unexpected record", rec)
+	}
+
+	// The part remains readable without the registry
+	stores[0].down = true
+	policy, err = policyOfRecord(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := policy.get(context.Background(), srv, &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"math/rand"
+)
+
+var (
+	errNoReplica = errors.New("No replica available")
+)
+
+// Write the same BLOB on `copies` distinct blob stores, all at once.
+type replicatedPolicy struct {
+	copies    uint
+	quorum    uint
+	placement gunkan.Placement
+}
+
+func (p *replicatedPolicy) String() string {
+	if p.copies == 1 && p.quorum == 1 {
+		return policySingle
+	}
+	if p.quorum == p.copies/2+1 {
+		return fmt.Sprintf("%s:%d", policyReplicated, p.copies)
+	}
+	return fmt.Sprintf("%s:%d:%d", policyReplicated, p.copies, p.quorum)
+}
+
+func (p *replicatedPolicy) put(ctx context.Context, srv *service, rec *partRecord, id gunkan.BlobId, data io.Reader, size int64) error {
+	urls, err := srv.lb.PollBlobStoresPlaced(p.copies, p.placement)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ids := make([]gunkan.BlobId, len(urls))
+	for i := range ids {
+		ids[i] = id
+	}
+	group := srv.newSinkGroup(ctx, urls, ids, size, p.quorum, p.placement)
+
+	// Each chunk is allocated once and shared by all the sinks, that only
+	// read it.
+	chunks := make([][]byte, len(urls))
+	for {
+		chunk := make([]byte, srv.config.chunkSize)
+		n, errRead := io.ReadFull(data, chunk)
+		if n > 0 {
+			for i := range chunks {
+				chunks[i] = chunk[:n]
+			}
+			if err = group.push(ctx, chunks); err != nil {
+				break
+			}
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		} else if errRead != nil {
+			err = errRead
+			break
+		}
+	}
+
+	if err != nil {
+		group.abort(err)
+	}
+	blobs, succeeded := group.close()
+	if err == nil && succeeded < p.quorum {
+		err = errQuorumNotReached
+	}
+	if err != nil {
+		srv.deleteBlobs(context.Background(), blobs)
+		return err
+	}
+	if succeeded < p.copies {
+		srv.putDegraded.Inc()
+	}
+	rec.Blobs = blobs
+	return nil
+}
+
+// All the replicas share the same BlobId
+func (p *replicatedPolicy) width() uint {
+	return 1
+}
+
+// Open the first replica that answers, trying them in a random order so that
+// the load is spread over the blob stores.
+func (p *replicatedPolicy) get(ctx context.Context, srv *service, rec *partRecord) (io.ReadCloser, error) {
+	var err error = errNoReplica
+	for _, i := range rand.Perm(len(rec.Blobs)) {
+		b := rec.Blobs[i]
+		if !b.ok() {
+			continue
+		}
+		var client gunkan.BlobClient
+		var r io.ReadCloser
+		if client, err = srv.dialBlob(b.Url); err != nil {
+			continue
+		}
+		if r, err = client.Get(ctx, b.Real); err != nil {
+			gunkan.Logger.Info().Str("url", b.Url).Str("real", b.Real).Err(err).Msg("Replica unavailable")
+			continue
+		}
+		return r, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"errors"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The part requests may carry the query parameters of a pre-signed URL, see
+// gunkan.Presign(). Such a request is only served when the signature is
+// valid, and when configured so, the requests without signature are refused.
+// A signature covers the query string but not the headers, so the signed
+// requests cannot carry the HeaderPrefixCommon headers that would change the
+// part, e.g. its policy, its expiration or its metadata.
+// Only the part routes are protected: the other routes of the data gate must
+// not be exposed to the holders of pre-signed URLs.
+// The keys are reloaded from their file upon SIGHUP, to rotate them.
+
+func (srv *service) loadPresignKeys() error {
+	keys, err := gunkan.LoadPresignKeys(srv.config.presignKeysPath)
+	if err != nil {
+		return err
+	}
+	srv.presignKeys.Store(keys)
+	return nil
+}
+
+func (srv *service) reloadPresignKeysOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := srv.loadPresignKeys(); err != nil {
+			gunkan.Logger.Warn().Str("path", srv.config.presignKeysPath).Err(err).Msg("Pre-sign keys not reloaded")
+		} else {
+			gunkan.Logger.Info().Str("path", srv.config.presignKeysPath).Msg("Pre-sign keys reloaded")
+		}
+	}
+}
+
+// Tells if the request may be served, with regard to its signature
+func (srv *service) checkPresigned(ctx *ghttp.RequestContext) error {
+	q := ctx.Req.URL.Query()
+	if q.Get(gunkan.PresignParamSignature) == "" {
+		if srv.config.presignRequired {
+			return errors.New("Signature required")
+		}
+		return nil
+	}
+
+	keys, _ := srv.presignKeys.Load().(gunkan.PresignKeys)
+	if keys == nil {
+		return gunkan.ErrPresignInvalid
+	}
+	switch ctx.Method() {
+	case "GET", "HEAD", "PUT":
+	default:
+		return gunkan.ErrPresignInvalid
+	}
+	// A signed PUT only grants the upload of data
+	prefix := http.CanonicalHeaderKey(HeaderPrefixCommon)
+	for k := range ctx.Req.Header {
+		if strings.HasPrefix(k, prefix) {
+			return gunkan.ErrPresignInvalid
+		}
+	}
+	return keys.Verify(ctx.Method(), ctx.Req.URL.Path, q, time.Now())
+}
+
+func (srv *service) withPresign(h ghttp.RequestHandler) ghttp.RequestHandler {
+	return func(ctx *ghttp.RequestContext) {
+		if err := srv.checkPresigned(ctx); err != nil {
+			ctx.ReplyCodeError(http.StatusForbidden, err)
+			return
+		}
+		h(ctx)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresign(t *testing.T) {
+	srv, _ := newTestService(3)
+	srv.config.presignRequired = true
+	srv.presignKeys.Store(gunkan.PresignKeys{"old": []byte("s1"), "new": []byte("s2")})
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	path := prefixData + "b/c/0"
+	signed := func(key, secret, method string, ttl time.Duration) string {
+		q := gunkan.Presign(key, []byte(secret), method, path, nil, time.Now().Add(ttl))
+		return ts.URL + path + "?" + q.Encode()
+	}
+
+	testCall(t, "PUT", ts.URL+path, strings.NewReader("hello"), http.StatusForbidden)
+	testCall(t, "PUT", signed("new", "s2", "PUT", time.Hour), strings.NewReader("hello"), http.StatusCreated)
+	testCall(t, "GET", signed("old", "s1", "GET", time.Hour), nil, http.StatusOK)
+	testCall(t, "HEAD", signed("new", "s2", "GET", time.Hour), nil, http.StatusOK)
+	testCall(t, "DELETE", signed("new", "s2", "GET", time.Hour), nil, http.StatusForbidden)
+	testCall(t, "GET", signed("new", "s1", "GET", time.Hour), nil, http.StatusForbidden)
+	testCall(t, "GET", signed("gone", "s3", "GET", time.Hour), nil, http.StatusForbidden)
+	testCall(t, "GET", signed("new", "s2", "GET", -time.Minute), nil, http.StatusForbidden)
+
+	// The signature covers the query string, the headers changing the part are refused
+	testCall(t, "GET", signed("new", "s2", "GET", time.Hour)+"&versionId=0", nil, http.StatusForbidden)
+	q := gunkan.Presign("new", []byte("s2"), "GET", path, url.Values{"versionId": {"0"}}, time.Now().Add(time.Hour))
+	testCall(t, "GET", ts.URL+path+"?"+q.Encode(), nil, http.StatusNotFound)
+	req, _ := http.NewRequest("PUT", signed("new", "s2", "PUT", time.Hour), strings.NewReader("hello"))
+	req.Header.Set(HeaderNameObjectPolicy, policySingle)
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusForbidden {
+		t.Fatal("signed policy", err, rep)
+	}
+}
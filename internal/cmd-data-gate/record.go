@@ -0,0 +1,243 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash"
+	"io"
+)
+
+// The outcome of the upload of one BLOB on one blob store
+type blobRecord struct {
+	Url      string `json:"url"`
+	Real     string `json:"real,omitempty"`
+	Position uint   `json:"pos"`
+	Error    string `json:"err,omitempty"`
+}
+
+// The value stored in the index for each part
+type partRecord struct {
+	Policy string       `json:"policy"`
+	Size   int64        `json:"size"`
+	ETag   string       `json:"etag"`
+	MTime  int64        `json:"mtime"`
+	Blobs  []blobRecord `json:"blobs"`
+
+	// The layout policy, when Policy is the name of a registered policy
+	Layout      string `json:"layout,omitempty"`
+	Compression string `json:"comp,omitempty"`
+	Class       string `json:"class,omitempty"`
+	// Size of the data in the BLOB's, when it differs from Size
+	Stored int64 `json:"stored,omitempty"`
+
+	// Size of the cells of an erasure-coded part
+	Cell int `json:"cell,omitempty"`
+
+	// Set instead of Blobs when the part has been cut in several segments
+	Segments []segmentRecord `json:"segments,omitempty"`
+
+	// The multipart upload that produced the part
+	Upload string `json:"upload,omitempty"`
+
+	// Set in the versioned buckets, zero for the parts saved without
+	// versioning. Deleted marks a delete marker in the history.
+	Version uint64 `json:"version,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+
+	// Unix time after which the part is deleted, 0 to keep it
+	Expires int64 `json:"expires,omitempty"`
+
+	// User metadata and tags
+	Meta map[string]string `json:"meta,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// One slice of a segmented part, stored like a whole part on its own
+type segmentRecord struct {
+	Size   int64        `json:"size"`
+	Stored int64        `json:"stored,omitempty"`
+	Cell   int          `json:"cell,omitempty"`
+	Blobs  []blobRecord `json:"blobs"`
+}
+
+func (b *blobRecord) ok() bool {
+	return b.Error == ""
+}
+
+// Returns the part as a list of segments, even when it is not segmented
+func (rec *partRecord) segments() []segmentRecord {
+	if len(rec.Segments) > 0 {
+		return rec.Segments
+	}
+	return []segmentRecord{{Size: rec.Size, Stored: rec.Stored, Cell: rec.Cell, Blobs: rec.Blobs}}
+}
+
+// Returns the BLOB's of the part, whatever the segmentation
+func (rec *partRecord) allBlobs() []blobRecord {
+	blobs := rec.Blobs
+	for _, seg := range rec.Segments {
+		blobs = append(blobs, seg.Blobs...)
+	}
+	return blobs
+}
+
+func (rec *partRecord) storedSize() int64 {
+	if rec.Stored > 0 {
+		return rec.Stored
+	}
+	return rec.Size
+}
+
+func (rec *partRecord) encode() (string, error) {
+	b, err := json.Marshal(rec)
+	return string(b), err
+}
+
+func decodePartRecord(s string) (*partRecord, error) {
+	var rec partRecord
+	if err := json.Unmarshal([]byte(s), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Fetch a value from the index.
+// The index stores deletions as empty values, they are reported as missing.
+func (srv *service) loadValue(ctx context.Context, key gunkan.BaseKey) (string, error) {
+	value, err := srv.index.Get(ctx, key)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return "", gunkan.ErrNotFound
+		}
+		return "", err
+	}
+	if value == "" {
+		return "", gunkan.ErrNotFound
+	}
+	return value, nil
+}
+
+// Like loadValue, with the version of the value for the conditional writes
+func (srv *service) loadValueVersion(ctx context.Context, key gunkan.BaseKey) (string, uint64, error) {
+	value, version, err := srv.index.GetVersion(ctx, key)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return "", 0, gunkan.ErrNotFound
+		}
+		return "", 0, err
+	}
+	if value == "" {
+		return "", 0, gunkan.ErrNotFound
+	}
+	return value, version, nil
+}
+
+// Fetch and decode the record of a part
+func (srv *service) loadPart(ctx context.Context, id gunkan.PartId) (*partRecord, error) {
+	value, err := srv.loadValue(ctx, id.IndexKey())
+	if err != nil {
+		return nil, err
+	}
+	return decodePartRecord(value)
+}
+
+// Fetch and decode the record of a part, with its version
+func (srv *service) loadPartVersion(ctx context.Context, id gunkan.PartId) (*partRecord, uint64, error) {
+	value, version, err := srv.loadValueVersion(ctx, id.IndexKey())
+	if err != nil {
+		return nil, 0, err
+	}
+	rec, err := decodePartRecord(value)
+	return rec, version, err
+}
+
+func (srv *service) savePart(ctx context.Context, id gunkan.PartId, rec *partRecord) error {
+	value, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	return srv.index.Put(ctx, id.IndexKey(), value)
+}
+
+// Replace the record of a part, unless it changed since it was loaded
+func (srv *service) swapPart(ctx context.Context, id gunkan.PartId, rec *partRecord, version uint64) error {
+	value, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	return srv.index.CompareAndSwap(ctx, id.IndexKey(), version, value)
+}
+
+// Remove the BLOB's successfully uploaded. The errors are logged but not
+// reported because the BLOB's are not referenced anymore.
+func (srv *service) deleteBlobs(ctx context.Context, blobs []blobRecord) {
+	for _, b := range blobs {
+		if !b.ok() || b.Real == "" {
+			continue
+		}
+		client, err := srv.dialBlob(b.Url)
+		if err == nil {
+			err = client.Delete(ctx, b.Real)
+		}
+		if err != nil {
+			gunkan.Logger.Warn().Str("url", b.Url).Str("real", b.Real).Err(err).Msg("Orphan BLOB")
+		}
+	}
+}
+
+// digestReader computes the size and the MD5 of the data read through it
+type digestReader struct {
+	in   io.Reader
+	md5  hash.Hash
+	size int64
+	// The error of the last read, io.EOF at the end of the data
+	err error
+}
+
+func newDigestReader(in io.Reader) *digestReader {
+	return &digestReader{in: in, md5: md5.New()}
+}
+
+func (r *digestReader) Read(b []byte) (int, error) {
+	n, err := r.in.Read(b)
+	if n > 0 {
+		r.size += int64(n)
+		_, _ = r.md5.Write(b[:n])
+	}
+	r.err = err
+	return n, err
+}
+
+// Tell if the data ended before the expected size, negative when unknown
+func (r *digestReader) truncated(expected int64) bool {
+	if r.err == io.ErrUnexpectedEOF {
+		return true
+	}
+	return r.err == io.EOF && expected >= 0 && r.size < expected
+}
+
+func (r *digestReader) etag() string {
+	return hex.EncodeToString(r.md5.Sum(nil))
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	in   io.Reader
+	size int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.in.Read(b)
+	r.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"strconv"
+)
+
+// The BLOB's shared by several parts, after a server-side copy, have a
+// reference counter in the gunkan.IndexBaseBlobRefs base of the index. A
+// BLOB without counter is referenced by exactly one part. A counter at 0
+// marks a BLOB being removed, that cannot be shared anymore.
+// The counters are only changed with conditional writes, retried when they
+// race with another change.
+
+var errBlobReleased = errors.New("BLOB being removed")
+
+func blobRefKey(b blobRecord) gunkan.BaseKey {
+	return gunkan.BK(gunkan.IndexBaseBlobRefs, b.Url+","+b.Real)
+}
+
+// Returns the references to the BLOB and the version of the counter, 0 when
+// there is no counter
+func (srv *service) loadBlobRefs(ctx context.Context, b blobRecord) (uint64, uint64, error) {
+	value, version, err := srv.loadValueVersion(ctx, blobRefKey(b))
+	if err == gunkan.ErrNotFound {
+		return 1, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	refs, err := strconv.ParseUint(value, 10, 64)
+	return refs, version, err
+}
+
+// Replace the counter, unless it changed since it was loaded at version
+func (srv *service) swapBlobRefs(ctx context.Context, b blobRecord, version, refs uint64) error {
+	key := blobRefKey(b)
+	value := strconv.FormatUint(refs, 10)
+	switch {
+	case version == 0:
+		return srv.index.PutIfAbsent(ctx, key, value)
+	case refs == 1:
+		return srv.index.CompareAndDelete(ctx, key, version)
+	default:
+		return srv.index.CompareAndSwap(ctx, key, version, value)
+	}
+}
+
+// Apply the change to the counter of the BLOB, until it does not race with
+// another one
+func (srv *service) updateBlobRefs(ctx context.Context, b blobRecord, change func(refs uint64) (uint64, error)) error {
+	for {
+		refs, version, err := srv.loadBlobRefs(ctx, b)
+		if err != nil {
+			return err
+		}
+		next, err := change(refs)
+		if err != nil {
+			return err
+		}
+		err = srv.swapBlobRefs(ctx, b, version, next)
+		if err != gunkan.ErrPrecondition {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Add a reference to each BLOB. On error, the references already added are
+// released.
+func (srv *service) shareBlobs(ctx context.Context, blobs []blobRecord) error {
+	for i, b := range blobs {
+		if !b.ok() || b.Real == "" {
+			continue
+		}
+		err := srv.updateBlobRefs(ctx, b, func(refs uint64) (uint64, error) {
+			if refs == 0 {
+				return 0, errBlobReleased
+			}
+			return refs + 1, nil
+		})
+		if err != nil {
+			srv.releaseBlobs(context.Background(), blobs[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop a reference to each BLOB, and remove the BLOB's not referenced anymore.
+// The last reference is replaced by a counter at 0 while the BLOB is removed.
+// Like deleteBlobs, errors are logged and the BLOB's kept when in doubt.
+func (srv *service) releaseBlobs(ctx context.Context, blobs []blobRecord) {
+	unused := make([]blobRecord, 0, len(blobs))
+	for _, b := range blobs {
+		if !b.ok() || b.Real == "" {
+			continue
+		}
+		last := false
+		err := srv.updateBlobRefs(ctx, b, func(refs uint64) (uint64, error) {
+			if refs == 0 {
+				return 0, errBlobReleased
+			}
+			last = refs == 1
+			return refs - 1, nil
+		})
+		if err == nil && last {
+			unused = append(unused, b)
+		} else if err != nil && err != errBlobReleased {
+			gunkan.Logger.Warn().Str("url", b.Url).Str("real", b.Real).Err(err).Msg("BLOB reference")
+		}
+	}
+	srv.deleteBlobs(ctx, unused)
+	for _, b := range unused {
+		if err := srv.index.Delete(ctx, blobRefKey(b)); err != nil {
+			gunkan.Logger.Warn().Str("url", b.Url).Str("real", b.Real).Err(err).Msg("BLOB reference")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bufio"
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+)
+
+// Cut the data in segments of srv.config.segmentSize bytes, each stored with
+// the policy under its own range of BlobId.Position, so that a large part is
+// spread on many blob stores. The size may be unknown (-1). A part that fits
+// in one segment is recorded as if it was not segmented.
+func (srv *service) putSegmented(ctx context.Context, policy storagePolicy, rec *partRecord, id gunkan.BlobId, data io.Reader, size int64) error {
+	segSize := srv.config.segmentSize
+	if segSize <= 0 || (size >= 0 && size <= segSize) {
+		return policy.put(ctx, srv, rec, id, data, size)
+	}
+
+	in := bufio.NewReader(data)
+	segments := make([]segmentRecord, 0)
+	fail := func(err error) error {
+		for _, seg := range segments {
+			srv.deleteBlobs(context.Background(), seg.Blobs)
+		}
+		return err
+	}
+
+	consumed := int64(0)
+	for i := uint(0); ; i++ {
+		// Only the first segment may be empty
+		if i > 0 {
+			if _, err := in.Peek(1); err == io.EOF {
+				break
+			} else if err != nil {
+				return fail(err)
+			}
+		}
+
+		expected := int64(-1)
+		if size >= 0 {
+			expected = size - consumed
+			if expected > segSize {
+				expected = segSize
+			}
+		}
+
+		var sub partRecord
+		segId := id
+		segId.Position = id.Position + i*policy.width()
+		r := &countingReader{in: io.LimitReader(in, segSize)}
+		if err := policy.put(ctx, srv, &sub, segId, r, expected); err != nil {
+			return fail(err)
+		}
+		segments = append(segments, segmentRecord{Size: r.size, Stored: sub.Stored, Cell: sub.Cell, Blobs: sub.Blobs})
+		rec.Layout, rec.Compression, rec.Class = sub.Layout, sub.Compression, sub.Class
+		consumed += r.size
+		if r.size < segSize {
+			break
+		}
+	}
+
+	if len(segments) == 1 {
+		rec.Blobs = segments[0].Blobs
+		rec.Stored = segments[0].Stored
+		rec.Cell = segments[0].Cell
+	} else {
+		rec.Segments = segments
+	}
+	return nil
+}
+
+// Open a stream on the data of a part, segmented or not
+func (srv *service) getSegmented(ctx context.Context, policy storagePolicy, rec *partRecord) (io.ReadCloser, error) {
+	if len(rec.Segments) == 0 {
+		return policy.get(ctx, srv, rec)
+	}
+	r := &segmentReader{ctx: ctx, srv: srv, policy: policy, rec: rec}
+	// Fail early when the first segment is not readable
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// segmentReader chains the segments of a part, opening each one only when
+// the previous is exhausted.
+type segmentReader struct {
+	ctx    context.Context
+	srv    *service
+	policy storagePolicy
+	rec    *partRecord
+	index  int
+	cur    io.ReadCloser
+}
+
+func (r *segmentReader) Read(b []byte) (int, error) {
+	for r.cur != nil {
+		n, err := r.cur.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if err = r.next(); err != nil {
+			return 0, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *segmentReader) Close() error {
+	if r.cur != nil {
+		err := r.cur.Close()
+		r.cur = nil
+		return err
+	}
+	return nil
+}
+
+// Switch to the next segment, cur is left nil after the last one
+func (r *segmentReader) next() error {
+	_ = r.Close()
+	if r.index >= len(r.rec.Segments) {
+		return nil
+	}
+	seg := r.rec.Segments[r.index]
+	sub := *r.rec
+	sub.Segments = nil
+	sub.Size = seg.Size
+	sub.Stored = seg.Stored
+	sub.Cell = seg.Cell
+	sub.Blobs = seg.Blobs
+
+	cur, err := r.policy.get(r.ctx, r.srv, &sub)
+	if err != nil {
+		return err
+	}
+	r.cur = cur
+	r.index++
+	return nil
+}
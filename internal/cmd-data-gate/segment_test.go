@@ -0,0 +1,63 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestSegmentedRoundTrip(t *testing.T) {
+	srv, _ := newTestService(6)
+	srv.config.segmentSize = 5000
+
+	data := make([]byte, 12345)
+	rand.Read(data)
+
+	for _, name := range []string{"replicated:3", "ec:4+2"} {
+		policy, _ := parsePolicy(name)
+		for _, size := range []int64{int64(len(data)), -1} {
+			var rec partRecord
+			err := srv.putSegmented(context.Background(), policy, &rec, gunkan.BlobId{}, bytes.NewReader(data), size)
+			if err != nil {
+				t.Fatal(name, size, err)
+			}
+			if len(rec.Segments) != 3 || len(rec.Blobs) != 0 {
+				t.Fatal(name, size, "unexpected segments", len(rec.Segments))
+			}
+			rec.Size = int64(len(data))
+
+			r, err := srv.getSegmented(context.Background(), policy, &rec)
+			if err != nil {
+				t.Fatal(name, size, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(name, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal(name, size, "data differs")
+			}
+		}
+	}
+
+	// A part that fits in one segment is not segmented, even when its size
+	// is not known in advance.
+	policy, _ := parsePolicy(policySingle)
+	var rec partRecord
+	err := srv.putSegmented(context.Background(), policy, &rec, gunkan.BlobId{}, bytes.NewReader(data[:5000]), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Segments) != 0 || len(rec.Blobs) != 1 {
+		t.Fatal("unexpected segmentation", rec)
+	}
+}
@@ -6,10 +6,14 @@
 package cmd_data_gate
 
 import (
+	"context"
+	"errors"
 	"github.com/jfsmig/object-storage/pkg/gunkan"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,23 +22,125 @@ type config struct {
 	addrBind     string
 	addrAnnounce string
 	dirConfig    string
+
+	chunkSize   int
+	sinkQueue   uint
+	segmentSize int64
+	uploadTTL   time.Duration
+
+	// How long an upload failing before its first byte is retried elsewhere
+	failoverDelay time.Duration
+
+	// The read cache is enabled when any of its tiers has a size
+	cacheMem       int64
+	cacheDisk      int64
+	cacheDir       string
+	cacheThreshold int64
+
+	// Path to the JSON file declaring the named storage policies
+	policiesPath string
+
+	// Period of the lifecycle worker, 0 to disable it, and the max number
+	// of deletions per second it issues, 0 for no limit
+	lifecyclePeriod time.Duration
+	lifecycleRate   float64
+
+	// Path to the keys of the pre-signed URLs, and if the part requests
+	// must be signed
+	presignKeysPath string
+	presignRequired bool
 }
 
 type service struct {
 	config config
 
-	lb gunkan.Balancer
+	lb    gunkan.Balancer
+	index gunkan.IndexClient
+
+	// nil when no registry has been configured
+	policies *policyRegistry
+
+	// nil when the read cache is disabled
+	cache *readCache
+
+	coalescer *coalescer
+
+	// How the blob stores are reached, gunkan.DialBlob unless overridden
+	dialBlob func(url string) (gunkan.BlobClient, error)
+
+	timePut    prometheus.Histogram
+	timeGet    prometheus.Histogram
+	timeDel    prometheus.Histogram
+	timeList   prometheus.Histogram
+	timeBucket prometheus.Histogram
+	timeUpload prometheus.Histogram
+
+	putDegraded prometheus.Counter
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+
+	getCoalesced prometheus.Counter
 
-	timePut  prometheus.Histogram
-	timeGet  prometheus.Histogram
-	timeDel  prometheus.Histogram
-	timeList prometheus.Histogram
+	lifecycleExpired    prometheus.Counter
+	lifecycleNoncurrent prometheus.Counter
+
+	// The last version id given, see newVersion()
+	lastVersion uint64
+
+	// The current gunkan.PresignKeys, nil when none has been configured
+	presignKeys atomic.Value
+
+	// The buckets whose purge runs on this gate
+	purges sync.Map
 }
 
 func newService(cfg config) (*service, error) {
 	var err error
-	srv := service{config: cfg}
+	srv := service{config: cfg, dialBlob: gunkan.DialBlob}
+	if srv.config.chunkSize <= 0 {
+		srv.config.chunkSize = defaultChunkSize
+	}
+	if srv.config.sinkQueue <= 0 {
+		srv.config.sinkQueue = defaultSinkQueue
+	}
+	if srv.config.segmentSize <= 0 {
+		srv.config.segmentSize = defaultSegmentSize
+	}
+
+	if cfg.policiesPath != "" {
+		srv.policies, err = loadPolicyRegistry(cfg.policiesPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.cacheMem > 0 || cfg.cacheDisk > 0 {
+		if srv.config.cacheThreshold <= 0 {
+			srv.config.cacheThreshold = defaultCacheThreshold
+		}
+		srv.cache, err = newReadCache(cfg.cacheMem, cfg.cacheDisk, srv.config.cacheThreshold, cfg.cacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.presignKeysPath != "" {
+		if err = srv.loadPresignKeys(); err != nil {
+			return nil, err
+		}
+		go srv.reloadPresignKeysOnSignal()
+	} else if cfg.presignRequired {
+		return nil, errors.New("Pre-signed URLs required without keys")
+	}
+
+	srv.coalescer = newCoalescer(srv.config.chunkSize, coalesceWindow)
+
 	srv.lb, err = gunkan.NewBalancerDefault()
+	if err != nil {
+		return nil, err
+	}
+
+	srv.index, err = gunkan.DialIndexPooled(cfg.dirConfig)
 
 	buckets := []float64{0.01, 0.02, 0.03, 0.04, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 1, 2, 3, 4, 5, math.Inf(1)}
 
@@ -62,11 +168,59 @@ func newService(cfg config) (*service, error) {
 		Buckets: buckets,
 	})
 
+	srv.timeBucket = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gunkan_bucket_ttlb",
+		Help:    "Repartition of the request times of bucket requests",
+		Buckets: buckets,
+	})
+
+	srv.timeUpload = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gunkan_upload_ttlb",
+		Help:    "Repartition of the request times of multipart upload requests",
+		Buckets: buckets,
+	})
+
+	srv.putDegraded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_part_put_degraded",
+		Help: "Number of parts stored with less BLOB's than their policy requires",
+	})
+
+	srv.cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_part_get_cache_hits",
+		Help: "Number of get requests served by the read cache",
+	})
+
+	srv.cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_part_get_cache_misses",
+		Help: "Number of get requests not found in the read cache",
+	})
+
+	srv.getCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_part_get_coalesced",
+		Help: "Number of get requests served by the fetch of a concurrent request",
+	})
+
+	srv.lifecycleExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_lifecycle_expired",
+		Help: "Number of parts deleted by the lifecycle worker",
+	})
+
+	srv.lifecycleNoncurrent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_lifecycle_noncurrent_deleted",
+		Help: "Number of non-current versions deleted by the lifecycle worker",
+	})
+
 	if err != nil {
 		return nil, err
-	} else {
-		return &srv, nil
 	}
+	if srv.config.lifecyclePeriod > 0 {
+		go srv.runLifecycle(context.Background())
+	}
+	if srv.config.uploadTTL > 0 {
+		go srv.runUploadJanitor(context.Background())
+	}
+	go srv.runBucketPurges(context.Background())
+	return &srv, nil
 }
 
 func (srv *service) isOverloaded(now time.Time) bool {
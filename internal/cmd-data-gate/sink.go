@@ -0,0 +1,224 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSinkTooSlow      = errors.New("Blob store too slow")
+	errQuorumNotReached = errors.New("Write quorum not reached")
+)
+
+// blobSink streams a BLOB to one blob store, through a bounded queue of chunks
+type blobSink struct {
+	rec    blobRecord
+	queue  chan []byte
+	pw     *io.PipeWriter
+	result chan blobRecord
+	failed int32
+}
+
+// sinkGroup feeds several blob stores at once. The upload progresses at the
+// pace of the quorum-th fastest sink, and the sinks lagging by a whole queue
+// behind it are abandoned instead of stalling their peers.
+type sinkGroup struct {
+	sinks    []*blobSink
+	quorum   uint
+	progress chan struct{}
+
+	// The blob stores used or tried so far, never polled again
+	placement gunkan.Placement
+	lock      sync.Mutex
+	used      []string
+}
+
+func (srv *service) newSinkGroup(ctx context.Context, urls []string, ids []gunkan.BlobId, size int64, quorum uint, placement gunkan.Placement) *sinkGroup {
+	g := &sinkGroup{
+		quorum:    quorum,
+		progress:  make(chan struct{}, 1),
+		placement: placement,
+		used:      append([]string{}, urls...),
+	}
+	deadline := time.Now().Add(srv.config.failoverDelay)
+	for i, url := range urls {
+		g.sinks = append(g.sinks, srv.newBlobSink(ctx, g, url, ids[i], size, deadline))
+	}
+	return g
+}
+
+// Poll a blob store to replace one that failed
+func (g *sinkGroup) replace(srv *service) (string, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	urls, err := srv.lb.PollBlobStoresExcluding(1, g.placement, g.used)
+	if err != nil {
+		return "", err
+	}
+	g.used = append(g.used, urls[0])
+	return urls[0], nil
+}
+
+func (srv *service) newBlobSink(ctx context.Context, g *sinkGroup, url string, id gunkan.BlobId, size int64, deadline time.Time) *blobSink {
+	progress := g.progress
+	pr, pw := io.Pipe()
+	s := &blobSink{
+		rec:    blobRecord{Url: url, Position: id.Position},
+		queue:  make(chan []byte, srv.config.sinkQueue),
+		pw:     pw,
+		result: make(chan blobRecord, 1),
+	}
+	notify := func() {
+		select {
+		case progress <- struct{}{}:
+		default:
+		}
+	}
+
+	// Forward the queued chunks to the pipe. On error, keep consuming the
+	// queue so that the producer never blocks on a dead sink.
+	go func() {
+		for chunk := range s.queue {
+			if atomic.LoadInt32(&s.failed) == 0 {
+				if _, err := pw.Write(chunk); err != nil {
+					atomic.StoreInt32(&s.failed, 1)
+				}
+			}
+			notify()
+		}
+		_ = pw.Close()
+	}()
+
+	// Upload the content of the pipe. The upload fails over another blob
+	// store until the deadline, as long as no data has been consumed.
+	go func() {
+		rec := s.rec
+		in := &countingReader{in: pr}
+		var err error
+		for {
+			var client gunkan.BlobClient
+			rec.Url = url
+			client, err = srv.dialBlob(url)
+			if err == nil {
+				if size >= 0 {
+					rec.Real, err = client.PutN(ctx, id, in, size)
+				} else {
+					rec.Real, err = client.Put(ctx, id, in)
+				}
+			}
+			if err == nil || in.size > 0 || ctx.Err() != nil || time.Now().After(deadline) {
+				break
+			}
+			next, errPoll := g.replace(srv)
+			if errPoll != nil {
+				break
+			}
+			gunkan.Logger.Info().Str("url", url).Str("next", next).Err(err).Msg("Blob store failover")
+			url = next
+		}
+		if err != nil {
+			atomic.StoreInt32(&s.failed, 1)
+			rec.Error = err.Error()
+			_ = pr.CloseWithError(err)
+			notify()
+		}
+		s.result <- rec
+	}()
+
+	return s
+}
+
+func (s *blobSink) ok() bool {
+	return atomic.LoadInt32(&s.failed) == 0
+}
+
+// Interrupt the upload. The blob store sees a truncated body and discards it.
+func (s *blobSink) abort(err error) {
+	if atomic.SwapInt32(&s.failed, 1) == 0 {
+		_ = s.pw.CloseWithError(err)
+	}
+}
+
+// Hand chunks[i] to the i-th sink. The call returns once the quorum of sinks
+// accepted their chunk, and the sinks still full at that time are aborted.
+func (g *sinkGroup) push(ctx context.Context, chunks [][]byte) error {
+	pending := make([]int, 0, len(g.sinks))
+	for i := range g.sinks {
+		pending = append(pending, i)
+	}
+
+	accepted := uint(0)
+	for {
+		alive := accepted
+		remaining := pending[:0]
+		for _, i := range pending {
+			s := g.sinks[i]
+			if !s.ok() {
+				continue
+			}
+			select {
+			case s.queue <- chunks[i]:
+				accepted++
+			default:
+				remaining = append(remaining, i)
+			}
+			alive++
+		}
+		pending = remaining
+
+		if len(pending) == 0 || accepted >= g.quorum {
+			break
+		}
+		if alive < g.quorum {
+			return errQuorumNotReached
+		}
+		select {
+		case <-g.progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, i := range pending {
+		g.sinks[i].abort(errSinkTooSlow)
+	}
+	if accepted < g.quorum {
+		return errQuorumNotReached
+	}
+	return nil
+}
+
+// Abort all the uploads still running
+func (g *sinkGroup) abort(err error) {
+	for _, s := range g.sinks {
+		s.abort(err)
+	}
+}
+
+// Signal the end of the data and wait for the outcome of each upload.
+// Returns the number of BLOB's successfully uploaded.
+func (g *sinkGroup) close() ([]blobRecord, uint) {
+	for _, s := range g.sinks {
+		close(s.queue)
+	}
+	blobs := make([]blobRecord, 0, len(g.sinks))
+	succeeded := uint(0)
+	for _, s := range g.sinks {
+		rec := <-s.result
+		if rec.ok() {
+			succeeded++
+		}
+		blobs = append(blobs, rec)
+	}
+	return blobs, succeeded
+}
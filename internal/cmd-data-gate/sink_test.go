@@ -0,0 +1,43 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bytes"
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"testing"
+	"time"
+)
+
+func TestSinkFailover(t *testing.T) {
+	srv, stores := newTestService(4)
+	policy, _ := parsePolicy("replicated:3:3")
+	stores[0].down = true
+
+	// Without failover, the quorum cannot be reached
+	var rec partRecord
+	err := policy.put(context.Background(), srv, &rec, gunkan.BlobId{}, bytes.NewReader(make([]byte, 5000)), 5000)
+	if err != errQuorumNotReached {
+		t.Fatal("Upload should have failed", err)
+	}
+
+	srv.config.failoverDelay = time.Second
+	err = policy.put(context.Background(), srv, &rec, gunkan.BlobId{}, bytes.NewReader(make([]byte, 5000)), 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range rec.Blobs {
+		if !b.ok() || b.Url == "127.0.0.1:6000" {
+			t.Fatal("Unexpected BLOB", b)
+		}
+	}
+	for _, s := range stores[1:] {
+		if len(s.blobs) != 1 {
+			t.Fatal("Unexpected BLOB's", len(s.blobs))
+		}
+	}
+}
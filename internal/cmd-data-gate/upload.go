@@ -0,0 +1,501 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multipart uploads live in the gunkan.IndexBaseUploads base of the index.
+// The session of an upload is stored under its id, and each uploaded part
+// under "ID,NUMBER" with the number zero-padded, so that the parts of an
+// upload are listed in order right after the session.
+
+var (
+	errInvalidUploadId = errors.New("Invalid upload id")
+	errInvalidPartNum  = errors.New("Invalid part number")
+)
+
+// The session of a multipart upload
+type uploadRecord struct {
+	// The part published when the upload completes
+	Bucket  string `json:"bucket"`
+	Content string `json:"content"`
+	Part    string `json:"part"`
+
+	// Resolved at the initiation, applied to all the parts
+	Policy string `json:"policy"`
+	CTime  int64  `json:"ctime"`
+
+	// Given at the initiation, applied to the completed part
+	Meta map[string]string `json:"meta,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type uploadPart struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+	MTime  int64  `json:"mtime"`
+
+	rec *partRecord
+}
+
+type uploadListReply struct {
+	Bucket  string       `json:"bucket"`
+	Content string       `json:"content"`
+	Part    string       `json:"part"`
+	Policy  string       `json:"policy"`
+	Parts   []uploadPart `json:"parts"`
+}
+
+// The body of a completion request, the parts in ascending order
+type uploadCompletion struct {
+	Parts []struct {
+		Number int    `json:"number"`
+		ETag   string `json:"etag,omitempty"`
+	} `json:"parts"`
+}
+
+func (up *uploadRecord) partId() gunkan.PartId {
+	return gunkan.PartId{Bucket: up.Bucket, Content: up.Content, PartId: up.Part}
+}
+
+func uploadKey(id string) gunkan.BaseKey {
+	return gunkan.BK(gunkan.IndexBaseUploads, id)
+}
+
+func uploadPartKey(id string, number int) gunkan.BaseKey {
+	return gunkan.BK(gunkan.IndexBaseUploads, fmt.Sprintf("%s,%05d", id, number))
+}
+
+func newUploadId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validateUploadId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+func parseUploadPartNumber(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > uploadMaxParts {
+		return 0, errInvalidPartNum
+	}
+	return n, nil
+}
+
+func (srv *service) loadUpload(ctx context.Context, id string) (*uploadRecord, error) {
+	value, err := srv.loadValue(ctx, uploadKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var up uploadRecord
+	if err = json.Unmarshal([]byte(value), &up); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (srv *service) saveUpload(ctx context.Context, id string, up *uploadRecord) error {
+	b, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	return srv.index.Put(ctx, uploadKey(id), string(b))
+}
+
+// Returns the parts already uploaded, in ascending order
+func (srv *service) listUploadParts(ctx context.Context, id string) ([]uploadPart, error) {
+	parts := make([]uploadPart, 0)
+	prefix := id + ","
+	marker := id
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseUploads, marker), gunkan.ListHardMax)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return parts, nil
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				return parts, nil
+			}
+			marker = key
+			number, err := parseUploadPartNumber(key[len(prefix):])
+			if err != nil {
+				continue
+			}
+			value, err := srv.loadValue(ctx, gunkan.BK(gunkan.IndexBaseUploads, key))
+			if err == gunkan.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			rec, err := decodePartRecord(value)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, uploadPart{Number: number, Size: rec.Size, ETag: rec.ETag, MTime: rec.MTime, rec: rec})
+		}
+	}
+}
+
+// Forget an upload and reclaim the BLOB's of its parts, except those
+// referenced by the part it published if it completed.
+func (srv *service) reclaimUpload(ctx context.Context, id string, up *uploadRecord) error {
+	parts, err := srv.listUploadParts(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[blobRecord]bool)
+	published, err := srv.loadPart(ctx, up.partId())
+	if err == nil && published.Upload == id {
+		for _, b := range published.allBlobs() {
+			kept[b] = true
+		}
+	} else if err != nil && err != gunkan.ErrNotFound {
+		return err
+	}
+
+	for _, p := range parts {
+		blobs := make([]blobRecord, 0)
+		for _, b := range p.rec.allBlobs() {
+			if !kept[b] {
+				blobs = append(blobs, b)
+			}
+		}
+		srv.deleteBlobs(ctx, blobs)
+		if err = srv.index.Delete(ctx, uploadPartKey(id, p.Number)); err != nil {
+			return err
+		}
+	}
+	// The session goes last, so that an interrupted reclamation is resumed
+	// by the janitor.
+	return srv.index.Delete(ctx, uploadKey(id))
+}
+
+func (srv *service) handleUpload() ghttp.RequestHandler {
+	return func(ctx *ghttp.RequestContext) {
+		pre := time.Now()
+		tail := ctx.Req.URL.Path[len(prefixUpload):]
+		tokens := strings.SplitN(tail, "/", 2)
+		switch {
+		case ctx.Method() == "POST" && strings.Count(tail, "/") >= 2:
+			srv.handleUploadInit(ctx, tail)
+		case len(tokens) == 2 && ctx.Method() == "PUT":
+			srv.handleUploadPart(ctx, tokens[0], tokens[1])
+		case len(tokens) == 1:
+			switch ctx.Method() {
+			case "GET", "HEAD":
+				srv.handleUploadList(ctx, tail)
+			case "POST":
+				srv.handleUploadComplete(ctx, tail)
+			case "DELETE":
+				srv.handleUploadAbort(ctx, tail)
+			default:
+				ctx.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			ctx.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		srv.timeUpload.Observe(time.Since(pre).Seconds())
+	}
+}
+
+// Open an upload session, its id is returned in the HeaderNameUploadId header
+func (srv *service) handleUploadInit(ctx *ghttp.RequestContext, tail string) {
+	id, err := parsePartId(tail)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	policy, err := srv.resolvePolicy(ctx.Req.Context(), id.Bucket, ctx.Req.Header.Get(HeaderNameObjectPolicy))
+	if err == errInvalidPolicy {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	} else if err == errBucketPurging {
+		ctx.ReplyCodeError(http.StatusConflict, err)
+		return
+	} else if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	md, err := parseMetadata(ctx.Req.Header)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	up := uploadRecord{
+		Bucket:  id.Bucket,
+		Content: id.Content,
+		Part:    id.PartId,
+		Policy:  policy.String(),
+		CTime:   time.Now().Unix(),
+		Meta:    md.Meta,
+		Tags:    md.Tags,
+	}
+	uploadId := newUploadId()
+	if err = srv.saveUpload(ctx.Req.Context(), uploadId, &up); err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	ctx.SetHeader(HeaderNameUploadId, uploadId)
+	ctx.SetHeader(HeaderNameObjectPolicy, up.Policy)
+	ctx.WriteHeader(http.StatusCreated)
+}
+
+// Store one part of the upload, replacing any previous part with the same
+// number.
+func (srv *service) handleUploadPart(ctx *ghttp.RequestContext, uploadId, snum string) {
+	if !validateUploadId(uploadId) {
+		ctx.ReplyCodeError(http.StatusBadRequest, errInvalidUploadId)
+		return
+	}
+	number, err := parseUploadPartNumber(snum)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+
+	up, err := srv.loadUpload(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	policy, err := srv.lookupPolicy(up.Policy)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var previous *partRecord
+	value, err := srv.loadValue(ctx.Req.Context(), uploadPartKey(uploadId, number))
+	if err == nil {
+		previous, err = decodePartRecord(value)
+	}
+	if err != nil && err != gunkan.ErrNotFound {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	var rec partRecord
+	blobid := gunkan.BlobId{Bucket: up.Bucket, Content: up.Content, PartId: fmt.Sprintf("%s.%s.%05d", up.Part, uploadId, number)}
+	in := newDigestReader(ctx.Input())
+	err = srv.putSegmented(ctx.Req.Context(), policy, &rec, blobid, in, ctx.Req.ContentLength)
+	if err != nil {
+		srv.replyUploadError(ctx, in, err)
+		return
+	}
+
+	rec.Policy = up.Policy
+	rec.Size = in.size
+	rec.ETag = in.etag()
+	rec.MTime = time.Now().Unix()
+	value, err = rec.encode()
+	if err == nil {
+		err = srv.index.Put(ctx.Req.Context(), uploadPartKey(uploadId, number), value)
+	}
+	if err != nil {
+		srv.deleteBlobs(context.Background(), rec.allBlobs())
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if previous != nil {
+		srv.deleteBlobs(ctx.Req.Context(), previous.allBlobs())
+	}
+
+	ctx.SetHeader("ETag", rec.ETag)
+	ctx.WriteHeader(http.StatusCreated)
+}
+
+func (srv *service) handleUploadList(ctx *ghttp.RequestContext, uploadId string) {
+	if !validateUploadId(uploadId) {
+		ctx.ReplyCodeError(http.StatusBadRequest, errInvalidUploadId)
+		return
+	}
+	up, err := srv.loadUpload(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	parts, err := srv.listUploadParts(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	ctx.SetHeader("Content-Type", "application/json")
+	ctx.WriteHeader(http.StatusOK)
+	ctx.JSON(uploadListReply{
+		Bucket:  up.Bucket,
+		Content: up.Content,
+		Part:    up.Part,
+		Policy:  up.Policy,
+		Parts:   parts,
+	})
+}
+
+// Publish the part made of the listed parts, at once, then reclaim the
+// session and the parts that were not listed.
+func (srv *service) handleUploadComplete(ctx *ghttp.RequestContext, uploadId string) {
+	if !validateUploadId(uploadId) {
+		ctx.ReplyCodeError(http.StatusBadRequest, errInvalidUploadId)
+		return
+	}
+	var req uploadCompletion
+	if err := json.NewDecoder(ctx.Input()).Decode(&req); err != nil {
+		ctx.ReplyCodeError(http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Parts) == 0 {
+		ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "No part")
+		return
+	}
+
+	up, err := srv.loadUpload(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	parts, err := srv.listUploadParts(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	byNumber := make(map[int]*partRecord)
+	for _, p := range parts {
+		byNumber[p.Number] = p.rec
+	}
+
+	// The ETag is computed the S3 way, from the MD5 of the parts
+	manifest := partRecord{Policy: up.Policy, Upload: uploadId, Meta: up.Meta, Tags: up.Tags}
+	digest := md5.New()
+	last := 0
+	for _, p := range req.Parts {
+		if p.Number <= last {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Parts not in ascending order")
+			return
+		}
+		last = p.Number
+		rec, ok := byNumber[p.Number]
+		if !ok || (p.ETag != "" && p.ETag != rec.ETag) {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, fmt.Sprintf("Invalid part %d", p.Number))
+			return
+		}
+		bin, _ := hex.DecodeString(rec.ETag)
+		_, _ = digest.Write(bin)
+		manifest.Layout = rec.Layout
+		manifest.Compression = rec.Compression
+		manifest.Class = rec.Class
+		manifest.Size += rec.Size
+		manifest.Segments = append(manifest.Segments, rec.segments()...)
+	}
+	manifest.ETag = fmt.Sprintf("%s-%d", hex.EncodeToString(digest.Sum(nil)), len(req.Parts))
+	manifest.MTime = time.Now().Unix()
+
+	id := up.partId()
+	if err = srv.publishPart(ctx.Req.Context(), id, &manifest); err != nil {
+		srv.replyPublishError(ctx, err)
+		return
+	}
+	if err = srv.reclaimUpload(ctx.Req.Context(), uploadId, up); err != nil {
+		// The janitor will finish the job
+		gunkan.Logger.Warn().Str("upload", uploadId).Err(err).Msg("Upload reclamation")
+	}
+
+	srv.replyPublished(ctx, &manifest)
+}
+
+func (srv *service) handleUploadAbort(ctx *ghttp.RequestContext, uploadId string) {
+	if !validateUploadId(uploadId) {
+		ctx.ReplyCodeError(http.StatusBadRequest, errInvalidUploadId)
+		return
+	}
+	up, err := srv.loadUpload(ctx.Req.Context(), uploadId)
+	if err != nil {
+		ctx.ReplyError(err)
+		return
+	}
+	if err = srv.reclaimUpload(ctx.Req.Context(), uploadId, up); err != nil {
+		ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+		return
+	}
+	ctx.ReplySuccess()
+}
+
+// Periodically reclaim the uploads abandoned for longer than uploadTTL
+func (srv *service) runUploadJanitor(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(uploadJanitorPeriod):
+		case <-ctx.Done():
+			return
+		}
+		if err := srv.reclaimExpiredUploads(ctx, time.Now().Add(-srv.config.uploadTTL)); err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Upload janitor")
+		}
+	}
+}
+
+func (srv *service) reclaimExpiredUploads(ctx context.Context, deadline time.Time) error {
+	marker := ""
+	last := ""
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseUploads, marker), gunkan.ListHardMax)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			id := key
+			if i := strings.IndexByte(key, ','); i >= 0 {
+				id = key[:i]
+			}
+			// Skip the parts of the session, at once for the next page
+			marker = id + "," + lastRune
+			if id == last {
+				continue
+			}
+			last = id
+
+			up, err := srv.loadUpload(ctx, id)
+			if err == gunkan.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if up.CTime < deadline.Unix() {
+				gunkan.Logger.Info().Str("upload", id).Msg("Upload expired")
+				if err = srv.reclaimUpload(ctx, id, up); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, srv *service) *httptest.Server {
+	srv.timeGet = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"})
+	srv.timePut = srv.timeGet
+	srv.timeDel = srv.timeGet
+	srv.timeUpload = srv.timeGet
+	srv.timeBucket = srv.timeGet
+	srv.timeList = srv.timeGet
+	srv.lifecycleExpired = prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	srv.lifecycleNoncurrent = srv.lifecycleExpired
+	api := ghttp.NewHttpApi("", "")
+	api.Route(prefixData, srv.withPresign(srv.handlePart()))
+	api.Route(prefixUpload, srv.handleUpload())
+	api.Route(prefixBucket, srv.handleBucket())
+	api.Route(routeVersions, srv.handleVersions())
+	api.Route(routeList, srv.handleList())
+	return httptest.NewServer(api.Handler())
+}
+
+func testCall(t *testing.T, method, url string, body io.Reader, expected int) *http.Response {
+	req, _ := http.NewRequest(method, url, body)
+	rep, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.StatusCode != expected {
+		t.Fatal(method, url, rep.StatusCode, rep.Header.Get("X-Error"))
+	}
+	return rep
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	rep := testCall(t, "POST", ts.URL+prefixUpload+"b/c/0", nil, http.StatusCreated)
+	id := rep.Header.Get(HeaderNameUploadId)
+	testCall(t, "PUT", ts.URL+prefixUpload+id+"/2", strings.NewReader("world"), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixUpload+id+"/1", strings.NewReader("hello "), http.StatusCreated)
+	testCall(t, "PUT", ts.URL+prefixUpload+id+"/3", strings.NewReader("unused"), http.StatusCreated)
+
+	testCall(t, "POST", ts.URL+prefixUpload+id, strings.NewReader(`{"parts":[{"number":2},{"number":1}]}`), http.StatusBadRequest)
+	testCall(t, "POST", ts.URL+prefixUpload+id, strings.NewReader(`{"parts":[{"number":1},{"number":2}]}`), http.StatusCreated)
+	testCall(t, "GET", ts.URL+prefixUpload+id, nil, http.StatusNotFound)
+
+	rep = testCall(t, "GET", ts.URL+prefixData+"b/c/0", nil, http.StatusOK)
+	got, _ := ioutil.ReadAll(rep.Body)
+	rep.Body.Close()
+	if string(got) != "hello world" {
+		t.Fatal("Unexpected content", string(got))
+	}
+	if !strings.HasSuffix(rep.Header.Get("ETag"), "-2") {
+		t.Fatal("Unexpected ETag", rep.Header.Get("ETag"))
+	}
+	// The unused part has been reclaimed
+	if len(stores[0].blobs) != 2 {
+		t.Fatal("Unexpected BLOB's", len(stores[0].blobs))
+	}
+
+	// An abandoned upload is reclaimed by the janitor
+	rep = testCall(t, "POST", ts.URL+prefixUpload+"b/c/1", nil, http.StatusCreated)
+	id = rep.Header.Get(HeaderNameUploadId)
+	testCall(t, "PUT", ts.URL+prefixUpload+id+"/1", bytes.NewReader(make([]byte, 10)), http.StatusCreated)
+	if err := srv.reclaimExpiredUploads(context.Background(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	testCall(t, "GET", ts.URL+prefixUpload+id, nil, http.StatusOK)
+	if err := srv.reclaimExpiredUploads(context.Background(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	testCall(t, "GET", ts.URL+prefixUpload+id, nil, http.StatusNotFound)
+	if len(stores[0].blobs) != 2 {
+		t.Fatal("Unexpected BLOB's", len(stores[0].blobs))
+	}
+}
+
+func TestPutTruncated(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	// The HTTP client refuses to send less than its Content-Length
+	cnx, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnx.Close()
+	_, err = io.WriteString(cnx, "PUT "+prefixData+"b/c/0 HTTP/1.1\r\n"+
+		"Host: test\r\nContent-Length: 10\r\n\r\nhello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = cnx.(*net.TCPConn).CloseWrite()
+	rep, err := http.ReadResponse(bufio.NewReader(cnx), nil)
+	if err != nil || rep.StatusCode != http.StatusBadRequest {
+		t.Fatal("Unexpected reply", err, rep)
+	}
+
+	testCall(t, "HEAD", ts.URL+prefixData+"b/c/0", nil, http.StatusNotFound)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
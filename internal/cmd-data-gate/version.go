@@ -0,0 +1,477 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"errors"
+	ghttp "github.com/jfsmig/object-storage/internal/helpers-http"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// In a versioned bucket, each version of a part is recorded in the
+// gunkan.IndexBaseVersions base, under a gunkan.KeyVersion made of the bucket
+// and the index key of the part. The record of the part itself is a copy of
+// its latest version, so that the reads and the listings ignore the history.
+//
+// The BLOB's of a version belong to its entry in the history, and are only
+// released when that entry is deleted. A part saved before the versioning was
+// enabled has no version: it enters the history as the version 0, the oldest
+// one, when it is overwritten or deleted.
+
+var (
+	errInvalidVersion = errors.New("Invalid version")
+)
+
+type versionItem struct {
+	Content string `json:"content"`
+	Part    string `json:"part"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Size    int64  `json:"size"`
+	ETag    string `json:"etag,omitempty"`
+	MTime   int64  `json:"mtime"`
+}
+
+type versionListReply struct {
+	Items     []versionItem `json:"items"`
+	Truncated bool          `json:"truncated"`
+	Marker    string        `json:"marker,omitempty"`
+}
+
+func versionKey(id gunkan.PartId, version uint64, active bool) gunkan.BaseKey {
+	kv := gunkan.KeyVersion{Base: id.Bucket, Key: id.IndexKey().Key, Version: version, Active: active}
+	return gunkan.BK(gunkan.IndexBaseVersions, kv.Encode())
+}
+
+// The prefix shared by the history keys of the part
+func versionPrefix(id gunkan.PartId) string {
+	return gunkan.KeyVersionPrefix(id.Bucket, id.IndexKey().Key)
+}
+
+// Returns the version id mentioned in the query string, if any
+func parseVersionId(ctx *ghttp.RequestContext) (version uint64, set bool, err error) {
+	s := ctx.Req.URL.Query().Get("versionId")
+	if s == "" {
+		return 0, false, nil
+	}
+	version, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, true, errInvalidVersion
+	}
+	return version, true, nil
+}
+
+// Versions are the time of the update in nanoseconds, forced to increase
+func (srv *service) newVersion() uint64 {
+	for {
+		last := atomic.LoadUint64(&srv.lastVersion)
+		v := uint64(time.Now().UnixNano())
+		if v <= last {
+			v = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&srv.lastVersion, last, v) {
+			return v
+		}
+	}
+}
+
+func (srv *service) isVersioned(ctx context.Context, bucket string) (bool, error) {
+	b, err := srv.loadBucket(ctx, bucket)
+	if err == gunkan.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return b.Versioning, nil
+}
+
+func (srv *service) saveVersion(ctx context.Context, id gunkan.PartId, rec *partRecord) error {
+	encoded, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	return srv.index.Put(ctx, versionKey(id, rec.Version, !rec.Deleted), encoded)
+}
+
+// Load a version of the part, possibly a delete marker
+func (srv *service) loadVersion(ctx context.Context, id gunkan.PartId, version uint64) (*partRecord, error) {
+	rec, _, err := srv.loadVersionEntry(ctx, id, version)
+	return rec, err
+}
+
+// Like loadVersion, with the version of the entry in the index
+func (srv *service) loadVersionEntry(ctx context.Context, id gunkan.PartId, version uint64) (*partRecord, uint64, error) {
+	value, entry, err := srv.loadValueVersion(ctx, versionKey(id, version, true))
+	if err == gunkan.ErrNotFound {
+		value, entry, err = srv.loadValueVersion(ctx, versionKey(id, version, false))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	rec, err := decodePartRecord(value)
+	return rec, entry, err
+}
+
+// Replace the entry of the version, unless it changed since it was loaded
+func (srv *service) swapVersion(ctx context.Context, id gunkan.PartId, rec *partRecord, entry uint64) error {
+	encoded, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	return srv.index.CompareAndSwap(ctx, versionKey(id, rec.Version, !rec.Deleted), entry, encoded)
+}
+
+// Load the newest version in the history of the part, possibly a delete
+// marker, or gunkan.ErrNotFound
+func (srv *service) latestVersion(ctx context.Context, id gunkan.PartId) (*partRecord, error) {
+	prefix := versionPrefix(id)
+	key := id.IndexKey().Key
+	marker := prefix
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseVersions, marker), parallelismList)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, gunkan.ErrNotFound
+		}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, prefix) {
+				return nil, gunkan.ErrNotFound
+			}
+			marker = k
+			var kv gunkan.KeyVersion
+			if kv.DecodeString(k) != nil || kv.Key != key {
+				continue
+			}
+			value, err := srv.loadValue(ctx, gunkan.BK(gunkan.IndexBaseVersions, k))
+			if err == gunkan.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			return decodePartRecord(value)
+		}
+	}
+}
+
+// Move a part saved without versioning in the history, as the version 0. The
+// version 0 left by a period of suspended versioning is replaced, on the
+// condition it did not change since it was loaded, so that its BLOB's are
+// released once.
+func (srv *service) archiveUnversioned(ctx context.Context, id gunkan.PartId, previous *partRecord) error {
+	if previous == nil || previous.Version != 0 {
+		return nil
+	}
+	older, entry, err := srv.loadVersionEntry(ctx, id, 0)
+	if err != nil && err != gunkan.ErrNotFound {
+		return err
+	}
+	encoded, err := previous.encode()
+	if err != nil {
+		return err
+	}
+	if older == nil {
+		return srv.index.PutIfAbsent(ctx, versionKey(id, 0, true), encoded)
+	}
+	if archived, _ := older.encode(); archived == encoded {
+		// Already archived by a concurrent write
+		return nil
+	}
+	if err = srv.swapVersion(ctx, id, previous, entry); err != nil {
+		return err
+	}
+	if !older.Deleted {
+		srv.releaseBlobs(ctx, older.allBlobs())
+	}
+	return nil
+}
+
+// Save the record of a new version of the part. Outside the versioned buckets
+// the BLOB's of the previous version are released, unless they are part of a
+// history. The retry of the completion of a multipart upload changes nothing.
+// The part record is replaced on the condition it did not change since it was
+// loaded: of several concurrent writes, only the one that replaced a record
+// releases its BLOB's, the others start again, then fail with
+// gunkan.ErrPrecondition.
+func (srv *service) publishPart(ctx context.Context, id gunkan.PartId, rec *partRecord) error {
+	versioned, err := srv.isVersioned(ctx, id.Bucket)
+	if err != nil {
+		return err
+	}
+	if err = srv.scheduleExpiry(ctx, id, rec); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		err = srv.replacePart(ctx, id, rec, versioned)
+		if err != gunkan.ErrPrecondition || i >= publishRetries {
+			return err
+		}
+	}
+}
+
+func (srv *service) replacePart(ctx context.Context, id gunkan.PartId, rec *partRecord, versioned bool) error {
+	previous, version, err := srv.loadPartVersion(ctx, id)
+	if err != nil && err != gunkan.ErrNotFound {
+		return err
+	}
+	if previous != nil && rec.Upload != "" && previous.Upload == rec.Upload {
+		rec.Version = previous.Version
+		return nil
+	}
+
+	if versioned {
+		if err = srv.archiveUnversioned(ctx, id, previous); err != nil {
+			return err
+		}
+		rec.Version = srv.newVersion()
+		if err = srv.saveVersion(ctx, id, rec); err != nil {
+			return err
+		}
+	} else {
+		rec.Version = 0
+	}
+	if previous == nil {
+		var encoded string
+		if encoded, err = rec.encode(); err == nil {
+			err = srv.index.PutIfAbsent(ctx, id.IndexKey(), encoded)
+		}
+	} else {
+		err = srv.swapPart(ctx, id, rec, version)
+	}
+	if err != nil {
+		if versioned {
+			_ = srv.index.Delete(context.Background(), versionKey(id, rec.Version, true))
+		}
+		return err
+	}
+
+	if previous != nil {
+		srv.invalidateCache(id)
+		if !versioned && previous.Version == 0 {
+			srv.releaseBlobs(ctx, previous.allBlobs())
+		}
+	}
+	return nil
+}
+
+// Delete the latest version of the part. In a versioned bucket, a delete
+// marker is added to the history and its version returned.
+// The part record is removed first, on the condition it did not change since
+// it was loaded: of several concurrent deletions, only the one that removed it
+// adds a marker, the others fail with gunkan.ErrPrecondition.
+func (srv *service) deleteLatest(ctx context.Context, id gunkan.PartId) (uint64, error) {
+	versioned, err := srv.isVersioned(ctx, id.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	if !versioned {
+		return 0, srv.deletePart(ctx, id)
+	}
+
+	rec, version, err := srv.loadPartVersion(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = srv.index.CompareAndDelete(ctx, id.IndexKey(), version); err != nil {
+		return 0, err
+	}
+	srv.invalidateCache(id)
+
+	marker := partRecord{Version: srv.newVersion(), Deleted: true, MTime: time.Now().Unix()}
+	err = srv.archiveUnversioned(ctx, id, rec)
+	if err == nil {
+		err = srv.saveVersion(ctx, id, &marker)
+	}
+	if err != nil {
+		// Restore the part, unless it has been written again meanwhile
+		if encoded, e := rec.encode(); e == nil {
+			_ = srv.index.PutIfAbsent(context.Background(), id.IndexKey(), encoded)
+		}
+		return 0, err
+	}
+	return marker.Version, nil
+}
+
+// Remove a version from the history for good, and release its BLOB's. When it
+// was the latest, the part record is restored from the newest version left.
+// The version is removed on the condition it did not change since it was
+// loaded: of several concurrent removals, only the one that removed it
+// releases its BLOB's, the others fail with gunkan.ErrPrecondition.
+func (srv *service) deleteVersion(ctx context.Context, id gunkan.PartId, version uint64) error {
+	rec, entry, err := srv.loadVersionEntry(ctx, id, version)
+	if err != nil {
+		return err
+	}
+	current, currentVersion, err := srv.loadPartVersion(ctx, id)
+	if err != nil && err != gunkan.ErrNotFound {
+		return err
+	}
+
+	if err = srv.index.CompareAndDelete(ctx, versionKey(id, version, !rec.Deleted), entry); err != nil {
+		return err
+	}
+
+	if current == nil || current.Version == version {
+		latest, err := srv.latestVersion(ctx, id)
+		if err != nil && err != gunkan.ErrNotFound {
+			return err
+		}
+		if latest != nil && !latest.Deleted {
+			if current == nil {
+				var encoded string
+				if encoded, err = latest.encode(); err == nil {
+					err = srv.index.PutIfAbsent(ctx, id.IndexKey(), encoded)
+				}
+			} else {
+				err = srv.swapPart(ctx, id, latest, currentVersion)
+			}
+		} else if current != nil {
+			err = srv.index.CompareAndDelete(ctx, id.IndexKey(), currentVersion)
+		}
+		if err != nil && err != gunkan.ErrPrecondition {
+			// The part written again meanwhile is left as is
+			return err
+		}
+		srv.invalidateCache(id)
+	}
+
+	if !rec.Deleted {
+		srv.releaseBlobs(ctx, rec.allBlobs())
+	}
+	return nil
+}
+
+// Tells if the bucket has a history, even made of delete markers only
+func (srv *service) hasVersions(ctx context.Context, bucket string) (bool, error) {
+	page, err := srv.listVersions(ctx, bucket, "", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(page.Items) > 0, nil
+}
+
+// Page through the history of the parts of the bucket, whose content name
+// starts with the prefix. The marker is an encoded gunkan.KeyVersion.
+func (srv *service) listVersions(ctx context.Context, bucket, prefix, marker string, max uint32) (*versionListReply, error) {
+	rep := versionListReply{Items: make([]versionItem, 0)}
+	start := gunkan.KeyVersionStart(bucket, prefix)
+	if marker < start {
+		marker = start
+	}
+	for {
+		keys, err := srv.index.List(ctx, gunkan.BK(gunkan.IndexBaseVersions, marker), max-uint32(len(rep.Items))+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return &rep, nil
+		}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, start) {
+				return &rep, nil
+			}
+			value, err := srv.loadValue(ctx, gunkan.BK(gunkan.IndexBaseVersions, k))
+			if err == gunkan.ErrNotFound {
+				marker = k
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			var kv gunkan.KeyVersion
+			if err = kv.DecodeString(k); err != nil {
+				return nil, err
+			}
+			rec, err := decodePartRecord(value)
+			if err != nil {
+				return nil, err
+			}
+			if uint32(len(rep.Items)) >= max {
+				rep.Truncated = true
+				rep.Marker = marker
+				return &rep, nil
+			}
+			content, part := splitIndexKey(kv.Key)
+			rep.Items = append(rep.Items, versionItem{
+				Content: content,
+				Part:    part,
+				Version: kv.Version,
+				Deleted: !kv.Active,
+				Size:    rec.Size,
+				ETag:    rec.ETag,
+				MTime:   rec.MTime,
+			})
+			marker = k
+		}
+	}
+}
+
+// Remove the whole history of the parts of the bucket
+func (srv *service) purgeVersions(ctx context.Context, bucket string) error {
+	for {
+		page, err := srv.listVersions(ctx, bucket, "", "", defaultListMax)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			id := gunkan.PartId{Bucket: bucket, Content: item.Content, PartId: item.Part}
+			err = srv.deleteVersion(ctx, id, item.Version)
+			if err != nil && err != gunkan.ErrNotFound && err != gunkan.ErrPrecondition {
+				return err
+			}
+		}
+		if !page.Truncated {
+			return nil
+		}
+	}
+}
+
+func (srv *service) handleVersions() ghttp.RequestHandler {
+	h := func(ctx *ghttp.RequestContext) {
+		q := ctx.Req.URL.Query()
+		bucket := q.Get("b")
+		if !gunkan.ValidateBucketName(bucket) {
+			ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid bucket name")
+			return
+		}
+		max := uint32(defaultListMax)
+		if smax := q.Get("max"); smax != "" {
+			max64, err := strconv.ParseUint(smax, 10, 32)
+			if err != nil || max64 == 0 {
+				ctx.ReplyCodeErrorMsg(http.StatusBadRequest, "Invalid max")
+				return
+			}
+			max = uint32(max64)
+		}
+		if max > gunkan.ListHardMax {
+			max = gunkan.ListHardMax
+		}
+
+		rep, err := srv.listVersions(ctx.Req.Context(), bucket, q.Get("prefix"), q.Get("m"), max)
+		if err != nil {
+			ctx.ReplyCodeError(http.StatusServiceUnavailable, err)
+			return
+		}
+		ctx.SetHeader(HeaderNameListTruncated, strconv.FormatBool(rep.Truncated))
+		if rep.Truncated {
+			ctx.SetHeader(HeaderNameListMarker, url.QueryEscape(rep.Marker))
+		}
+		ctx.WriteHeader(http.StatusOK)
+		ctx.JSON(rep)
+	}
+	return func(ctx *ghttp.RequestContext) {
+		pre := time.Now()
+		h(ctx)
+		srv.timeList.Observe(time.Since(pre).Seconds())
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_data_gate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVersioning(t *testing.T) {
+	srv, stores := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	check := func(url, expected string) {
+		rep := testCall(t, "GET", url, nil, http.StatusOK)
+		got, _ := ioutil.ReadAll(rep.Body)
+		rep.Body.Close()
+		if string(got) != expected {
+			t.Fatal("Unexpected content", url, string(got))
+		}
+	}
+	part := ts.URL + prefixData + "b/c/0"
+
+	// A part saved before the versioning becomes the version 0
+	testCall(t, "PUT", part, strings.NewReader("v0"), http.StatusCreated)
+	req, _ := http.NewRequest("PUT", ts.URL+prefixBucket+"b", nil)
+	req.Header.Set(HeaderNameBucketVersioning, "true")
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("versioning", err, rep)
+	}
+
+	v1 := testCall(t, "PUT", part, strings.NewReader("v1"), http.StatusCreated).Header.Get(HeaderNameVersionId)
+	v2 := testCall(t, "PUT", part, strings.NewReader("v2"), http.StatusCreated).Header.Get(HeaderNameVersionId)
+	if v1 == "" || v2 == "" || v1 == v2 {
+		t.Fatal("Unexpected versions", v1, v2)
+	}
+	check(part, "v2")
+	check(part+"?versionId="+v1, "v1")
+	check(part+"?versionId=0", "v0")
+
+	marker := testCall(t, "DELETE", part, nil, http.StatusNoContent).Header.Get(HeaderNameVersionId)
+	testCall(t, "GET", part, nil, http.StatusNotFound)
+	testCall(t, "GET", part+"?versionId="+marker, nil, http.StatusNotFound)
+
+	rep := testCall(t, "GET", ts.URL+routeVersions+"?b=b", nil, http.StatusOK)
+	var list versionListReply
+	err := json.NewDecoder(rep.Body).Decode(&list)
+	rep.Body.Close()
+	if err != nil || len(list.Items) != 4 || !list.Items[0].Deleted || list.Items[3].Version != 0 {
+		t.Fatal("Unexpected history", err, list)
+	}
+
+	// Removing the newest versions restores the previous ones
+	testCall(t, "DELETE", part+"?versionId="+marker, nil, http.StatusNoContent)
+	check(part, "v2")
+	testCall(t, "DELETE", part+"?versionId="+v2, nil, http.StatusNoContent)
+	check(part, "v1")
+	testCall(t, "DELETE", part+"?versionId="+v1, nil, http.StatusNoContent)
+	testCall(t, "DELETE", part+"?versionId=0", nil, http.StatusNoContent)
+	testCall(t, "GET", part, nil, http.StatusNotFound)
+	for i, s := range stores {
+		if len(s.blobs) != 0 {
+			t.Fatal("Orphan BLOB's", i, len(s.blobs))
+		}
+	}
+}
+
+// Of the concurrent removals of a version, a single one releases its BLOB's
+func TestVersionDeleteConcurrent(t *testing.T) {
+	srv, _ := newTestService(3)
+	ts := newTestServer(t, srv)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+prefixBucket+"b", nil)
+	req.Header.Set(HeaderNameBucketVersioning, "true")
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("versioning", err, rep)
+	}
+	part := ts.URL + prefixData + "b/src/0"
+	v1 := testCall(t, "PUT", part, strings.NewReader("v1"), http.StatusCreated).Header.Get(HeaderNameVersionId)
+	req, _ = http.NewRequest("PUT", ts.URL+prefixData+"b/dst/0", nil)
+	req.Header.Set(HeaderNameCopySource, "b/src/0")
+	if rep, err := http.DefaultClient.Do(req); err != nil || rep.StatusCode != http.StatusCreated {
+		t.Fatal("copy", err, rep)
+	}
+	testCall(t, "PUT", part, strings.NewReader("v2"), http.StatusCreated)
+
+	version, _ := strconv.ParseUint(v1, 10, 64)
+	id := gunkan.PartId{Bucket: "b", Content: "src", PartId: "0"}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	removed := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := srv.deleteVersion(context.Background(), id, version)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				removed++
+			} else if err != gunkan.ErrNotFound && err != gunkan.ErrPrecondition {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if removed != 1 {
+		t.Fatal("Version removed", removed, "times")
+	}
+
+	// The BLOB's shared by the copy are still referenced once
+	rep := testCall(t, "GET", ts.URL+prefixData+"b/dst/0", nil, http.StatusOK)
+	got, _ := ioutil.ReadAll(rep.Body)
+	rep.Body.Close()
+	if string(got) != "v1" {
+		t.Fatal("Unexpected content", string(got))
+	}
+	testCall(t, "DELETE", ts.URL+prefixData+"b/dst/0", nil, http.StatusNoContent)
+}
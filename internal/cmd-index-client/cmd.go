@@ -7,6 +7,7 @@ package cmd_index_client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/jfsmig/object-storage/pkg/gunkan"
@@ -14,6 +15,8 @@ import (
 	"github.com/spf13/pflag"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 func MainCommand() *cobra.Command {
@@ -29,6 +32,7 @@ func MainCommand() *cobra.Command {
 	cmd.AddCommand(GetCommand())
 	cmd.AddCommand(DeleteCommand())
 	cmd.AddCommand(ListCommand())
+	cmd.AddCommand(SyncCommand())
 	return cmd
 }
 
@@ -55,6 +59,7 @@ func (cfg *config) dial() (gunkan.IndexClient, error) {
 func PutCommand() *cobra.Command {
 	var cfg config
 	var flagStdIn bool
+	var batchSize, pipeline uint = 100, 4
 
 	cmd := &cobra.Command{
 		Use:     "put",
@@ -66,28 +71,7 @@ func PutCommand() *cobra.Command {
 				return err
 			}
 			if flagStdIn {
-				r := bufio.NewReader(os.Stdin)
-				var base, key, value string
-				for {
-					n, err := fmt.Fscanln(r, &base, &key, &value)
-					if err == io.EOF {
-						return nil
-					}
-					if err != nil {
-						return err
-					}
-					if n != 3 {
-						return errors.New("Invalid line")
-					}
-
-					k := gunkan.BK(base, key)
-					err = client.Put(cmd.Context(), k, value)
-					if err != nil {
-						gunkan.Logger.Warn().
-							Str("base", base).Str("key", key).Str("value", value).
-							Err(err)
-					}
-				}
+				return putBatches(cmd.Context(), client, os.Stdin, batchSize, pipeline)
 			} else {
 				if len(args) != 3 {
 					return errors.New("Missing BASE, KEY or VALUE")
@@ -101,9 +85,93 @@ func PutCommand() *cobra.Command {
 
 	cfg.prepare(cmd.Flags())
 	cmd.Flags().BoolVarP(&flagStdIn, "stdin", "i", flagStdIn, "Consume triples from stdin")
+	cmd.Flags().UintVar(&batchSize, "batch", batchSize, "Number of triples from stdin per request")
+	cmd.Flags().UintVar(&pipeline, "pipeline", pipeline, "Number of batches sent in parallel")
 	return cmd
 }
 
+// Send the "BASE KEY VALUE" triples of the input in batches, several batches
+// being in flight at once.
+func putBatches(ctx context.Context, client gunkan.IndexClient, in io.Reader, batchSize, pipeline uint) error {
+	if batchSize == 0 {
+		batchSize = 1
+	}
+	if pipeline == 0 {
+		pipeline = 1
+	}
+
+	var wg sync.WaitGroup
+	var failures int64
+	slots := make(chan bool, pipeline)
+	send := func(keys []gunkan.BaseKey, values []string) {
+		defer wg.Done()
+		defer func() { <-slots }()
+		errs, err := client.BatchPut(ctx, keys, values)
+		if err != nil {
+			gunkan.Logger.Warn().Int("count", len(keys)).Err(err).Msg("Batch failed")
+			atomic.AddInt64(&failures, int64(len(keys)))
+			return
+		}
+		for i, err := range errs {
+			if err != nil {
+				gunkan.Logger.Warn().
+					Str("base", keys[i].Base).Str("key", keys[i].Key).Str("value", values[i]).
+					Err(err).Msg("Put failed")
+				atomic.AddInt64(&failures, 1)
+			}
+		}
+	}
+
+	r := bufio.NewReader(in)
+	keys := make([]gunkan.BaseKey, 0, batchSize)
+	values := make([]string, 0, batchSize)
+	flush := func() {
+		if len(keys) == 0 {
+			return
+		}
+		slots <- true
+		wg.Add(1)
+		go send(keys, values)
+		keys = make([]gunkan.BaseKey, 0, batchSize)
+		values = make([]string, 0, batchSize)
+	}
+
+	var err error
+	for {
+		var base, key, value string
+		var n int
+		n, err = fmt.Fscanln(r, &base, &key, &value)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		if n != 3 {
+			err = errors.New("Invalid line")
+			break
+		}
+		keys = append(keys, gunkan.BK(base, key))
+		values = append(values, value)
+		if uint(len(keys)) >= batchSize {
+			flush()
+		}
+	}
+	if err == nil {
+		flush()
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d puts failed", failures)
+	}
+	return nil
+}
+
 func ListCommand() *cobra.Command {
 	var cfg config
 	var maxItems uint32 = gunkan.ListHardMax
@@ -0,0 +1,62 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_client
+
+import (
+	"errors"
+	"fmt"
+	helpers_grpc "github.com/jfsmig/object-storage/internal/helpers-grpc"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+func SyncCommand() *cobra.Command {
+	var cfg config
+	var flagDryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Synchronize the replicas of a base through an index gate",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("Missing BASE")
+			}
+
+			url := cfg.url
+			if url == "" {
+				lb, err := gunkan.NewBalancerDefault()
+				if err != nil {
+					return err
+				}
+				if url, err = lb.PollIndexGate(); err != nil {
+					return err
+				}
+			}
+			cnx, err := helpers_grpc.DialTLSInsecure(url)
+			if err != nil {
+				return err
+			}
+			defer cnx.Close()
+
+			req := proto.SyncRequest{Base: args[0], DryRun: flagDryRun}
+			rep, err := proto.NewIndexClient(cnx).Sync(cmd.Context(), &req)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("stores %s\n", strings.Join(rep.Stores, ","))
+			fmt.Printf("buckets %d\n", rep.Buckets)
+			fmt.Printf("differing %d\n", rep.Differing)
+			fmt.Printf("repaired %d\n", rep.Repaired)
+			return nil
+		},
+	}
+
+	cfg.prepare(cmd.Flags())
+	cmd.Flags().BoolVarP(&flagDryRun, "dry-run", "n", flagDryRun, "Only report the differences")
+	return cmd
+}
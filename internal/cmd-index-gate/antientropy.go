@@ -0,0 +1,261 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"time"
+)
+
+// The anti-entropy compares the replicas of each base. The gate asks each
+// store holding the base for a digest of its keys, one hash per bucket of
+// keys, then fetches the keys of the buckets that differ and copies the
+// latest version of each key to the stores that miss it. The copies carry
+// their version, so that they never overwrite a newer write.
+
+var (
+	antiEntropyDiffering = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_index_antientropy_differing",
+		Help: "Number of buckets of keys found different among the replicas",
+	})
+
+	antiEntropyRepaired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_index_antientropy_repaired",
+		Help: "Number of keys copied to the replicas that missed them",
+	})
+)
+
+// The entries of the replicas of a base, by key then by store
+type syncEntries map[string]map[string]*proto.Entry
+
+// The copies needed by the stores
+type syncCopy struct {
+	addr  string
+	entry *proto.Entry
+}
+
+// Returns the buckets whose digests differ among the stores
+func differingBuckets(digests [][]uint64) []uint32 {
+	out := make([]uint32, 0)
+	if len(digests) == 0 {
+		return out
+	}
+	for b, h := range digests[0] {
+		for _, d := range digests[1:] {
+			if b >= len(d) || d[b] != h {
+				out = append(out, uint32(b))
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Returns the copies that bring each store up to date
+func (entries syncEntries) plan(addrs []string) []syncCopy {
+	out := make([]syncCopy, 0)
+	for _, byAddr := range entries {
+		var best *proto.Entry
+		for _, e := range byAddr {
+			if best == nil || e.Version > best.Version ||
+				(e.Version == best.Version && e.Value > best.Value) {
+				best = e
+			}
+		}
+		for _, addr := range addrs {
+			if e, ok := byAddr[addr]; !ok || e.Version < best.Version ||
+				(e.Version == best.Version && e.Value != best.Value) {
+				out = append(out, syncCopy{addr, best})
+			}
+		}
+	}
+	return out
+}
+
+func (srv *service) Digest(ctx context.Context, req *proto.DigestRequest) (*proto.DigestReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Served by the index stores")
+}
+
+func (srv *service) Fetch(req *proto.FetchRequest, stream proto.Index_FetchServer) error {
+	return status.Errorf(codes.Unimplemented, "Served by the index stores")
+}
+
+// List the bases known by any store
+func (srv *service) Bases(ctx context.Context, req *proto.ListRequest) (*proto.ListReply, error) {
+	if req.Max <= 0 {
+		req.Max = 1
+	} else if req.Max > gunkan.ListHardMax {
+		req.Max = gunkan.ListHardMax
+	}
+
+	srv.rw.RLock()
+	targets := make([]targetInput, 0, len(srv.back))
+	for addr := range srv.back {
+		targets = append(targets, targetInput{addr: addr, cnx: srv.conn(addr)})
+	}
+	srv.rw.RUnlock()
+
+	tabs := make([][]string, 0)
+	for _, t := range targets {
+		if t.cnx == nil {
+			continue
+		}
+		rep, err := proto.NewIndexClient(t.cnx).Bases(ctx, req)
+		if err != nil {
+			gunkan.Logger.Info().Str("op", "BASES").Str("srv", t.addr).Err(err).Msg("Bases")
+			continue
+		}
+		tabs = append(tabs, rep.Items)
+	}
+	if len(tabs) == 0 {
+		return nil, status.Errorf(codes.Unavailable, "No backend replied")
+	}
+
+	rep := proto.ListReply{}
+	for x := range keepSingleDedup(tabs, req.Max) {
+		rep.Items = append(rep.Items, x)
+	}
+	return &rep, nil
+}
+
+func (srv *service) Sync(ctx context.Context, req *proto.SyncRequest) (*proto.SyncReply, error) {
+	if req.Base == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+	return srv.syncBase(ctx, req.Base, req.DryRun)
+}
+
+func (srv *service) syncBase(ctx context.Context, base string, dryRun bool) (*proto.SyncReply, error) {
+	// The connections are never closed, they outlive the lock
+	srv.rw.RLock()
+	targets := srv.targets(base)
+	srv.rw.RUnlock()
+
+	rep := proto.SyncReply{Buckets: gunkan.DigestBucketsDefault}
+	addrs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if t.cnx == nil {
+			return nil, status.Errorf(codes.Unavailable, "No connection to %s", t.addr)
+		}
+		addrs = append(addrs, t.addr)
+	}
+	rep.Stores = addrs
+	if len(targets) < 2 {
+		return &rep, nil
+	}
+
+	digests := make([][]uint64, 0, len(targets))
+	for _, t := range targets {
+		d, err := proto.NewIndexClient(t.cnx).Digest(ctx, &proto.DigestRequest{Base: base, Buckets: rep.Buckets})
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, d.Hashes)
+	}
+	selected := differingBuckets(digests)
+	rep.Differing = uint32(len(selected))
+	if len(selected) == 0 {
+		return &rep, nil
+	}
+
+	entries := make(syncEntries)
+	for _, t := range targets {
+		stream, err := proto.NewIndexClient(t.cnx).Fetch(ctx, &proto.FetchRequest{Base: base, Buckets: rep.Buckets, Selected: selected})
+		if err != nil {
+			return nil, err
+		}
+		for {
+			e, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if entries[e.Key] == nil {
+				entries[e.Key] = make(map[string]*proto.Entry)
+			}
+			entries[e.Key][t.addr] = e
+		}
+	}
+
+	copies := entries.plan(addrs)
+	rep.Repaired = uint32(len(copies))
+	if !dryRun {
+		antiEntropyDiffering.Add(float64(rep.Differing))
+		for _, c := range copies {
+			if err := srv.syncCopy(ctx, base, c); err != nil {
+				return nil, err
+			}
+			antiEntropyRepaired.Inc()
+		}
+	}
+	return &rep, nil
+}
+
+func (srv *service) syncCopy(ctx context.Context, base string, c syncCopy) error {
+	srv.rw.RLock()
+	cnx := srv.conn(c.addr)
+	srv.rw.RUnlock()
+	if cnx == nil {
+		return errNoConnection
+	}
+
+	cli := proto.NewIndexClient(cnx)
+	var err error
+	if c.entry.Deleted {
+		_, err = cli.Delete(ctx, &proto.DeleteRequest{Base: base, Key: c.entry.Key, Version: c.entry.Version})
+	} else {
+		_, err = cli.Put(ctx, &proto.PutRequest{Base: base, Key: c.entry.Key, Value: c.entry.Value, Version: c.entry.Version})
+	}
+	// The store got a newer version since the digests were compared
+	if status.Code(err) == codes.Aborted {
+		return nil
+	}
+	return err
+}
+
+// Periodically synchronize all the bases
+func (srv *service) runAntiEntropy() {
+	for srv.flag_running {
+		<-time.After(srv.cfg.antiEntropyPeriod)
+		if err := srv.antiEntropyPass(context.Background()); err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Anti-entropy")
+		}
+	}
+}
+
+func (srv *service) antiEntropyPass(ctx context.Context) error {
+	marker := ""
+	for srv.flag_running {
+		bases, err := srv.Bases(ctx, &proto.ListRequest{Marker: marker, Max: gunkan.ListHardMax})
+		if err != nil {
+			return err
+		}
+		if len(bases.Items) == 0 {
+			return nil
+		}
+		for _, base := range bases.Items {
+			rep, err := srv.syncBase(ctx, base, false)
+			if err != nil {
+				gunkan.Logger.Warn().Str("base", base).Err(err).Msg("Anti-entropy")
+			} else if rep.Repaired > 0 {
+				gunkan.Logger.Info().Str("base", base).
+					Uint32("differing", rep.Differing).Uint32("repaired", rep.Repaired).
+					Msg("Anti-entropy")
+			}
+			marker = base
+		}
+	}
+	return nil
+}
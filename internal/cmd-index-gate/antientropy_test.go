@@ -0,0 +1,53 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"testing"
+)
+
+func TestDifferingBuckets(t *testing.T) {
+	got := differingBuckets([][]uint64{{1, 2, 3, 4}, {1, 2, 0, 4}, {1, 5, 3, 4}})
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatal(got)
+	}
+	if got := differingBuckets([][]uint64{{1, 2}, {1, 2}}); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestSyncPlan(t *testing.T) {
+	entries := syncEntries{
+		"k0": {
+			"a": {Key: "k0", Version: 2, Value: "new"},
+			"b": {Key: "k0", Version: 1, Value: "old"},
+		},
+		"k1": {
+			"b": {Key: "k1", Version: 3, Deleted: true},
+		},
+		"k2": {
+			"a": {Key: "k2", Version: 1},
+			"b": {Key: "k2", Version: 1},
+			"c": {Key: "k2", Version: 1},
+		},
+	}
+	copies := entries.plan([]string{"a", "b", "c"})
+	expected := map[string]*proto.Entry{
+		"k0@b": entries["k0"]["a"],
+		"k0@c": entries["k0"]["a"],
+		"k1@a": entries["k1"]["b"],
+		"k1@c": entries["k1"]["b"],
+	}
+	if len(copies) != len(expected) {
+		t.Fatal(copies)
+	}
+	for _, c := range copies {
+		if expected[c.entry.Key+"@"+c.addr] != c.entry {
+			t.Fatal(c)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// A batch is split per store, each store receiving in one RPC the items of
+// the bases it holds. The replies are then gathered per item and each item
+// gets the outcome of a single request, with its own quorum. The conditional
+// items are written one by one after the others, through the coordinator of
+// their key, and the items with a version ahead of the clock are rejected.
+
+// The items of a batch held by each store
+type batchPlan struct {
+	// The indices of the items, per store
+	items map[string][]int
+	cnx   map[string]*grpc.ClientConn
+	// The number of stores holding each item
+	owners []int
+	// The former owners of each item also read during a handoff
+	former []map[string]bool
+}
+
+// Plan the items on the stores holding their base, and for the reads on the
+// former owners as well
+func (srv *service) shard(bases []string, read bool) batchPlan {
+	srv.rw.RLock()
+	defer srv.rw.RUnlock()
+
+	plan := batchPlan{
+		items:  make(map[string][]int),
+		cnx:    make(map[string]*grpc.ClientConn),
+		owners: make([]int, len(bases)),
+		former: make([]map[string]bool, len(bases)),
+	}
+	for i, base := range bases {
+		targets := srv.targets(base)
+		plan.owners[i] = len(targets)
+		if read {
+			targets = srv.withFormerOwners(base, targets)
+			for _, t := range targets[plan.owners[i]:] {
+				if plan.former[i] == nil {
+					plan.former[i] = make(map[string]bool)
+				}
+				plan.former[i][t.addr] = true
+			}
+		}
+		for _, t := range targets {
+			plan.items[t.addr] = append(plan.items[t.addr], i)
+			plan.cnx[t.addr] = t.cnx
+		}
+	}
+	return plan
+}
+
+// Call the hook once per store, in parallel
+func (plan batchPlan) run(hook func(cli proto.IndexClient, addr string, idx []int)) {
+	var wg sync.WaitGroup
+	for addr, idx := range plan.items {
+		cnx := plan.cnx[addr]
+		if cnx == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string, idx []int) {
+			defer wg.Done()
+			hook(proto.NewIndexClient(cnx), addr, idx)
+		}(addr, idx)
+	}
+	wg.Wait()
+}
+
+func itemStatus(err error) *proto.ItemStatus {
+	st := status.Convert(err)
+	return &proto.ItemStatus{Code: int32(st.Code()), Message: st.Message()}
+}
+
+func itemError(st *proto.ItemStatus) error {
+	if st == nil {
+		return status.Error(codes.Internal, "Missing item status")
+	}
+	return status.Error(codes.Code(st.Code), st.Message)
+}
+
+// Send the writes of a batch and report the outcome of each one
+func (srv *service) batchWrite(op string, quorums []uint32, plan batchPlan,
+	send func(cli proto.IndexClient, idx []int) (*proto.BatchReply, error)) *proto.BatchReply {
+	var lock sync.Mutex
+	accepted := make([]int, len(quorums))
+	superseded := make([]int, len(quorums))
+	plan.run(func(cli proto.IndexClient, addr string, idx []int) {
+		rep, err := send(cli, idx)
+		if err != nil || len(rep.Items) != len(idx) {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for j, i := range idx {
+			switch codes.Code(rep.Items[j].GetCode()) {
+			case codes.OK:
+				accepted[i]++
+			case codes.Aborted:
+				superseded[i]++
+			}
+		}
+	})
+
+	rep := proto.BatchReply{Items: make([]*proto.ItemStatus, len(quorums))}
+	for i, q := range quorums {
+		w, err := quorum(srv.cfg.writeQuorum, q, plan.owners[i])
+		if err == nil {
+			err = reportWrite(op, accepted[i], superseded[i], w)
+		}
+		rep.Items[i] = itemStatus(err)
+	}
+	return &rep
+}
+
+// Merge the statuses of the items handled one by one, the conditional items
+// and the rejected ones, and of the other items sent in the batch
+func mergeBatch(conditional map[int]error, plain []int, rep *proto.BatchReply) *proto.BatchReply {
+	out := proto.BatchReply{Items: make([]*proto.ItemStatus, len(conditional)+len(plain))}
+	for i, err := range conditional {
+		out.Items[i] = itemStatus(err)
+	}
+	for j, i := range plain {
+		out.Items[i] = rep.Items[j]
+	}
+	return &out
+}
+
+func (srv *service) BatchPut(ctx context.Context, req *proto.BatchPutRequest) (*proto.BatchReply, error) {
+	conditional := make(map[int]error)
+	plain := make([]int, 0, len(req.Items))
+	for i, item := range req.Items {
+		if err := checkVersion(item.Version); err != nil {
+			conditional[i] = err
+		} else if item.IfAbsent || item.IfVersion != 0 {
+			conditional[i] = nil
+		} else {
+			plain = append(plain, i)
+		}
+	}
+
+	bases := make([]string, len(plain))
+	quorums := make([]uint32, len(plain))
+	for j, i := range plain {
+		item := req.Items[i]
+		bases[j], quorums[j] = item.Base, item.Quorum
+		if item.Version == 0 {
+			item.Version = srv.clock.Now()
+		} else {
+			srv.clock.Observe(item.Version)
+		}
+	}
+	rep := srv.batchWrite("put", quorums, srv.shard(bases, false), func(cli proto.IndexClient, idx []int) (*proto.BatchReply, error) {
+		sub := proto.BatchPutRequest{Items: make([]*proto.PutRequest, 0, len(idx))}
+		for _, j := range idx {
+			sub.Items = append(sub.Items, req.Items[plain[j]])
+		}
+		return cli.BatchPut(ctx, &sub)
+	})
+	for i, err := range conditional {
+		if err == nil {
+			_, conditional[i] = srv.Put(ctx, req.Items[i])
+		}
+	}
+	return mergeBatch(conditional, plain, rep), nil
+}
+
+func (srv *service) BatchDelete(ctx context.Context, req *proto.BatchDeleteRequest) (*proto.BatchReply, error) {
+	conditional := make(map[int]error)
+	plain := make([]int, 0, len(req.Items))
+	for i, item := range req.Items {
+		if err := checkVersion(item.Version); err != nil {
+			conditional[i] = err
+		} else if item.IfVersion != 0 {
+			conditional[i] = nil
+		} else {
+			plain = append(plain, i)
+		}
+	}
+
+	bases := make([]string, len(plain))
+	quorums := make([]uint32, len(plain))
+	for j, i := range plain {
+		item := req.Items[i]
+		bases[j], quorums[j] = item.Base, item.Quorum
+		if item.Version == 0 {
+			item.Version = srv.clock.Now()
+		} else {
+			srv.clock.Observe(item.Version)
+		}
+	}
+	rep := srv.batchWrite("delete", quorums, srv.shard(bases, false), func(cli proto.IndexClient, idx []int) (*proto.BatchReply, error) {
+		sub := proto.BatchDeleteRequest{Items: make([]*proto.DeleteRequest, 0, len(idx))}
+		for _, j := range idx {
+			sub.Items = append(sub.Items, req.Items[plain[j]])
+		}
+		return cli.BatchDelete(ctx, &sub)
+	})
+	for i, err := range conditional {
+		if err == nil {
+			_, conditional[i] = srv.Delete(ctx, req.Items[i])
+		}
+	}
+	return mergeBatch(conditional, plain, rep), nil
+}
+
+// Each item waits for the replies of all its stores
+func (srv *service) BatchGet(ctx context.Context, req *proto.BatchGetRequest) (*proto.BatchGetReply, error) {
+	bases := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		bases[i] = item.Base
+	}
+	plan := srv.shard(bases, true)
+
+	var lock sync.Mutex
+	replies := make([][]targetErrorValue, len(req.Items))
+	owned := make([]int, len(req.Items))
+	plan.run(func(cli proto.IndexClient, addr string, idx []int) {
+		sub := proto.BatchGetRequest{Items: make([]*proto.GetRequest, 0, len(idx))}
+		for _, i := range idx {
+			sub.Items = append(sub.Items, req.Items[i])
+		}
+		rep, err := cli.BatchGet(ctx, &sub)
+		if err != nil || len(rep.Items) != len(idx) {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for j, i := range idx {
+			x := targetErrorValue{value: rep.Items[j].Value, version: rep.Items[j].Version, deleted: rep.Items[j].Deleted}
+			x.addr = addr
+			switch codes.Code(rep.Items[j].Status.GetCode()) {
+			case codes.OK:
+			case codes.NotFound:
+				x.missing = true
+			default:
+				continue
+			}
+			replies[i] = append(replies[i], x)
+			if !plan.former[i][addr] {
+				owned[i]++
+			}
+		}
+	})
+
+	rep := proto.BatchGetReply{Items: make([]*proto.GetItem, len(req.Items))}
+	for i, item := range req.Items {
+		var best *targetErrorValue
+		for _, x := range replies[i] {
+			if betterValue(best, x) {
+				x := x
+				best = &x
+			}
+		}
+		r, err := quorum(srv.cfg.readQuorum, item.Quorum, plan.owners[i])
+		if err == nil {
+			err = reportQuorum("get", owned[i], r)
+		}
+		switch {
+		case err != nil:
+			rep.Items[i] = &proto.GetItem{Status: itemStatus(err)}
+		case best.missing:
+			rep.Items[i] = &proto.GetItem{Status: itemStatus(status.Error(codes.NotFound, "Not found"))}
+		default:
+			srv.clock.Observe(best.version)
+			srv.rw.RLock()
+			srv.maybeRepair(ctx, item, best, replies[i])
+			srv.rw.RUnlock()
+			if best.deleted {
+				rep.Items[i] = &proto.GetItem{Status: itemStatus(status.Error(codes.NotFound, "Not found"))}
+			} else {
+				rep.Items[i] = &proto.GetItem{Status: itemStatus(nil), Version: best.version, Value: best.value}
+			}
+		}
+	}
+	return &rep, nil
+}
@@ -14,10 +14,12 @@ import (
 	"github.com/spf13/cobra"
 	"net"
 	"net/http"
+	"time"
 )
 
 func MainCommand() *cobra.Command {
 	var cfg serviceConfig
+	var shutdown helpers_grpc.Shutdown
 
 	server := &cobra.Command{
 		Use:     "gate",
@@ -52,6 +54,7 @@ func MainCommand() *cobra.Command {
 			}
 
 			gunkan_index_proto.RegisterIndexServer(httpServer, service)
+			helpers_grpc.RegisterHealth(httpServer, shutdown)
 			grpc_prometheus.Register(httpServer)
 			http.Handle("/metrics", promhttp.Handler())
 			http.HandleFunc("/info", func(rep http.ResponseWriter, req *http.Request) {
@@ -64,8 +67,36 @@ func MainCommand() *cobra.Command {
 	const (
 		publicUsage = "Public address of the service."
 		tlsUsage    = "Path to a directory with the TLS configuration"
+		wUsage      = "Number of index stores that must accept a write, 0 for a majority"
+		rUsage      = "Number of index stores that must reply to a read, 0 for a majority"
+		rfUsage     = "Number of index stores holding each base, 0 for all the stores"
+		vnodesUsage = "Number of virtual nodes of each index store on the hash ring"
+		repairUsage = "Read repair mode: off, async or inline"
+		periodUsage = "Minimal delay between two read repairs of a key"
+		syncUsage   = "Delay between two passes of the anti-entropy, 0 to disable it"
+		ejectUsage  = "Number of failed calls in a row ejecting an index store, 0 to never eject"
+		coolUsage   = "Delay before a call probes an ejected index store"
+		slowUsage   = "Latency of a call counted as a failure, 0 to disable it"
+		healthUsage = "Delay between two health checks of the index stores, 0 to disable them"
+		checkUsage  = "Timeout of a health check of an index store"
+		drainUsage  = "Delay the gate reports NOT_SERVING before it stops"
+		stopUsage   = "Delay the calls in flight have to finish when the gate stops"
 	)
 	server.Flags().StringVar(&cfg.dirConfig, "tls", "", tlsUsage)
 	server.Flags().StringVar(&cfg.addrAnnounce, "pub", "", publicUsage)
+	server.Flags().Uint32Var(&cfg.writeQuorum, "w", 0, wUsage)
+	server.Flags().Uint32Var(&cfg.readQuorum, "r", 0, rUsage)
+	server.Flags().UintVar(&cfg.replicas, "rf", 3, rfUsage)
+	server.Flags().UintVar(&cfg.virtualNodes, "vnodes", 64, vnodesUsage)
+	server.Flags().StringVar(&cfg.readRepair, "repair", repairAsync, repairUsage)
+	server.Flags().DurationVar(&cfg.repairPeriod, "repair-period", time.Second, periodUsage)
+	server.Flags().DurationVar(&cfg.antiEntropyPeriod, "anti-entropy", 10*time.Minute, syncUsage)
+	server.Flags().UintVar(&cfg.ejectAfter, "eject-after", 5, ejectUsage)
+	server.Flags().DurationVar(&cfg.ejectFor, "eject-for", 10*time.Second, coolUsage)
+	server.Flags().DurationVar(&cfg.slowCall, "slow", time.Second, slowUsage)
+	server.Flags().DurationVar(&cfg.healthPeriod, "health", 5*time.Second, healthUsage)
+	server.Flags().DurationVar(&cfg.healthTimeout, "health-timeout", time.Second, checkUsage)
+	server.Flags().DurationVar(&shutdown.Drain, "drain", 5*time.Second, drainUsage)
+	server.Flags().DurationVar(&shutdown.Timeout, "stop-timeout", 30*time.Second, stopUsage)
 	return server
 }
@@ -0,0 +1,142 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// The conditional writes of a key are serialized by the first store of its
+// base on the ring, the coordinator, the same for all the gates: only the
+// coordinator checks the condition, then the write goes to the other stores
+// without condition. A rejected write is then written nowhere, and a write
+// that misses its quorum is reported as such, like the other writes. While
+// the coordinator is unavailable, the conditional writes of its bases fail.
+// The gate first checks the condition against a read quorum and brings a
+// lagging coordinator up to date, so that the coordinator decides on the
+// latest version of the key.
+
+type condition struct {
+	ifAbsent  bool
+	ifVersion uint64
+}
+
+func (c condition) set() bool {
+	return c.ifAbsent || c.ifVersion != 0
+}
+
+func (c condition) check(best *targetErrorValue) error {
+	live := !best.missing && !best.deleted
+	if c.ifAbsent && live {
+		return status.Error(codes.FailedPrecondition, "Key present")
+	}
+	if c.ifVersion != 0 && (!live || best.version != c.ifVersion) {
+		return status.Error(codes.FailedPrecondition, "Version mismatch")
+	}
+	return nil
+}
+
+// Send one write of the key to a store, with its condition or without
+type condSender func(cli proto.IndexClient, conditional bool) error
+
+// The caller holds srv.rw
+func (srv *service) condWrite(ctx context.Context, op string, req *proto.GetRequest, cond condition,
+	targets []targetInput, w int, send condSender) error {
+	r, err := quorum(srv.cfg.readQuorum, 0, len(targets))
+	if err != nil {
+		return err
+	}
+
+	// Read the key on all its stores, and on its former ones during a handoff
+	readers := srv.withFormerOwners(req.Base, targets)
+	replies := make([]*targetErrorValue, len(readers))
+	var wg sync.WaitGroup
+	for i, t := range readers {
+		if t.cnx == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t targetInput) {
+			defer wg.Done()
+			x := targetErrorValue{}
+			x.addr = t.addr
+			rep, err := proto.NewIndexClient(t.cnx).Get(ctx, req)
+			if err == nil {
+				x.value, x.version, x.deleted = rep.Value, rep.Version, rep.Deleted
+			} else if status.Code(err) == codes.NotFound {
+				x.missing = true
+			} else {
+				return
+			}
+			replies[i] = &x
+		}(i, t)
+	}
+	wg.Wait()
+
+	var best *targetErrorValue
+	count := 0
+	for i, x := range replies {
+		if x != nil {
+			if i < len(targets) {
+				count++
+			}
+			if betterValue(best, *x) {
+				best = x
+			}
+		}
+	}
+	if err = reportQuorum(op, count, r); err != nil {
+		return err
+	}
+	if err = cond.check(best); err != nil {
+		return err
+	}
+
+	coordinator := targets[0]
+	if replies[0] == nil {
+		return status.Errorf(codes.Unavailable, "Coordinator %s unavailable", coordinator.addr)
+	}
+	if x := replies[0]; !best.missing && (x.missing || x.version < best.version) {
+		srv.repair(ctx, req, best, []string{coordinator.addr})
+	}
+
+	err = send(proto.NewIndexClient(coordinator.cnx), true)
+	if err != nil {
+		if c := status.Code(err); c != codes.FailedPrecondition && c != codes.Aborted {
+			gunkan.Logger.Warn().Str("op", op).Str("k", req.Key).Str("srv", coordinator.addr).Err(err).Msg("Coordinator")
+		}
+		return err
+	}
+
+	accepted, superseded := 1, 0
+	var lock sync.Mutex
+	for i, t := range targets {
+		if i == 0 || t.cnx == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(t targetInput) {
+			defer wg.Done()
+			err := send(proto.NewIndexClient(t.cnx), false)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				accepted++
+			} else if status.Code(err) == codes.Aborted {
+				superseded++
+			} else {
+				gunkan.Logger.Warn().Str("op", op).Str("k", req.Key).Str("srv", t.addr).Err(err).Msg("Replica")
+			}
+		}(t)
+	}
+	wg.Wait()
+	return reportWrite(op, accepted, superseded, w)
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+)
+
+// When the catalog of the index stores changes, the ring is rebuilt and some
+// bases get new owners, while their keys are still on the former ones. The
+// gate then hands these bases off: it fetches the keys of each store of the
+// former rings, and copies those of the bases the store does not own anymore
+// to their new owners. The copies carry their version, like the ones of the
+// anti-entropy, so that they never overwrite a newer write.
+// Until a handoff pass completes, the former rings are kept: the reads also
+// reach the former owners of the base, and wait for all the stores, while
+// the writes only go to the new owners. A change of the catalog during a
+// pass adds a ring to the former ones and starts the pass again.
+
+var (
+	errStopping = errors.New("Gate stopping")
+
+	handoffCopied = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gunkan_index_handoff_copied",
+		Help: "Number of keys copied from their former index stores to the new ones",
+	})
+)
+
+// Replace the ring, keeping the current one until its bases are handed off.
+// The caller holds srv.rw.
+func (srv *service) setRing(ring *hashRing) {
+	if srv.ring.equal(ring) {
+		return
+	}
+	if srv.ring.nodes > 0 {
+		srv.former = append(srv.former, srv.ring)
+		srv.ringChanges++
+	}
+	srv.ring = ring
+}
+
+// Tells if the store is an owner on a former ring. The caller holds srv.rw.
+func (srv *service) isFormerOwner(addr string) bool {
+	for _, ring := range srv.former {
+		if ring.has(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the stores holding the base, then its former owners while it is
+// handed off. The caller holds srv.rw.
+func (srv *service) readTargets(base string) []targetInput {
+	return srv.withFormerOwners(base, srv.targets(base))
+}
+
+// The caller holds srv.rw
+func (srv *service) withFormerOwners(base string, targets []targetInput) []targetInput {
+	if len(srv.former) == 0 {
+		return targets
+	}
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		seen[t.addr] = true
+	}
+	out := targets
+	for _, ring := range srv.former {
+		for _, addr := range ring.owners(base, int(srv.cfg.replicas)) {
+			if !seen[addr] {
+				seen[addr] = true
+				out = append(out, targetInput{addr: addr, cnx: srv.conn(addr)})
+			}
+		}
+	}
+	return out
+}
+
+// Start a handoff pass when a former ring is pending and no pass runs
+func (srv *service) maybeHandoff() {
+	srv.rw.Lock()
+	defer srv.rw.Unlock()
+	if len(srv.former) == 0 || srv.handingOff {
+		return
+	}
+	srv.handingOff = true
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		if err := srv.handoffPass(context.Background()); err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Handoff")
+		}
+		srv.rw.Lock()
+		srv.handingOff = false
+		srv.rw.Unlock()
+	}()
+}
+
+// Hand off the bases of all the stores of the former rings, then forget the
+// rings unless the catalog changed meanwhile
+func (srv *service) handoffPass(ctx context.Context) error {
+	srv.rw.RLock()
+	changes := srv.ringChanges
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, ring := range srv.former {
+		for _, p := range ring.points {
+			if !seen[p.addr] {
+				seen[p.addr] = true
+				addrs = append(addrs, p.addr)
+			}
+		}
+	}
+	srv.rw.RUnlock()
+
+	for _, addr := range addrs {
+		if err := srv.handoffStore(ctx, addr); err != nil {
+			return err
+		}
+	}
+
+	srv.rw.Lock()
+	defer srv.rw.Unlock()
+	if srv.ringChanges == changes {
+		srv.former = nil
+		gunkan.Logger.Info().Int("stores", len(addrs)).Msg("Handoff done")
+	}
+	return nil
+}
+
+// Copy the bases of the store it does not own anymore to their owners
+func (srv *service) handoffStore(ctx context.Context, addr string) error {
+	srv.rw.RLock()
+	cnx := srv.conn(addr)
+	srv.rw.RUnlock()
+	if cnx == nil {
+		return errNoConnection
+	}
+	cli := proto.NewIndexClient(cnx)
+
+	marker := ""
+	for {
+		// An interrupted pass must not forget the former rings
+		if !srv.flag_running {
+			return errStopping
+		}
+		bases, err := cli.Bases(ctx, &proto.ListRequest{Marker: marker, Max: gunkan.ListHardMax})
+		if err != nil {
+			return err
+		}
+		if len(bases.Items) == 0 {
+			return nil
+		}
+		for _, base := range bases.Items {
+			if err = srv.handoffBase(ctx, cli, addr, base); err != nil {
+				return err
+			}
+			marker = base
+		}
+	}
+}
+
+func (srv *service) handoffBase(ctx context.Context, cli proto.IndexClient, addr, base string) error {
+	srv.rw.RLock()
+	owners := srv.ring.owners(base, int(srv.cfg.replicas))
+	srv.rw.RUnlock()
+	for _, o := range owners {
+		if o == addr {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A single bucket selects all the keys
+	stream, err := cli.Fetch(ctx, &proto.FetchRequest{Base: base, Buckets: 1, Selected: []uint32{0}})
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, o := range owners {
+			if err = srv.syncCopy(ctx, base, syncCopy{o, e}); err != nil {
+				return err
+			}
+			handoffCopied.Inc()
+		}
+	}
+}
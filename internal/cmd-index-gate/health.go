@@ -0,0 +1,246 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// Each index store is behind a circuit breaker fed by the outcome and the
+// latency of every RPC sent to it, and by periodic gRPC health checks.
+//  - healthy: the last call succeeded;
+//  - suspect: the last calls failed or were slow, the store is still used;
+//  - ejected: ejectAfter calls in a row failed, the store is not used until
+//    ejectFor elapses (0 never ejects);
+//  - probing: the circuit is half-open, a single call is let through and its
+//    outcome either closes the circuit or ejects the store again.
+// An ejected store counts as a failure in the quorums. The breaker lets the
+// calls through and counts them in the interceptors of the connection, around
+// the RPC actually sent, so that picking the stores of a request has no effect
+// on their state. A health check replying NOT_SERVING counts as a failure.
+
+type backendState int
+
+const (
+	backendHealthy backendState = iota
+	backendSuspect
+	backendEjected
+	backendProbing
+)
+
+var (
+	errNotServing = errors.New("Not serving")
+	errEjected    = status.Error(codes.Unavailable, "Index store ejected")
+
+	backendStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gunkan_index_backend_state",
+		Help: "State of the index stores: 0 healthy, 1 suspect, 2 ejected, 3 probing",
+	}, []string{"addr"})
+
+	backendEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gunkan_index_backend_ejected",
+		Help: "Number of times the index stores were ejected",
+	}, []string{"addr"})
+)
+
+type breakerConfig struct {
+	ejectAfter uint
+	ejectFor   time.Duration
+	slowCall   time.Duration
+}
+
+type backend struct {
+	addr    string
+	cnx     *grpc.ClientConn
+	breaker breakerConfig
+
+	lock     sync.Mutex
+	state    backendState
+	failures uint
+	// When the store was ejected, or when the probe was let through
+	since time.Time
+}
+
+func newBackend(addr string, cfg breakerConfig) *backend {
+	b := &backend{addr: addr, breaker: cfg}
+	backendStates.WithLabelValues(addr).Set(float64(backendHealthy))
+	return b
+}
+
+// The caller holds b.lock
+func (b *backend) setState(state backendState, now time.Time) {
+	if state == backendEjected && b.state != backendEjected {
+		backendEjections.WithLabelValues(b.addr).Inc()
+		gunkan.Logger.Warn().Str("srv", b.addr).Uint("failures", b.failures).Msg("Index store ejected")
+	} else if state == backendHealthy && b.state != backendHealthy && b.state != backendSuspect {
+		gunkan.Logger.Info().Str("srv", b.addr).Msg("Index store restored")
+	}
+	if state == backendEjected || state == backendProbing {
+		b.since = now
+	}
+	b.state = state
+	backendStates.WithLabelValues(b.addr).Set(float64(state))
+}
+
+// Tells if a call could be sent to the store, without changing its state
+func (b *backend) available(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case backendEjected, backendProbing:
+		return now.Sub(b.since) >= b.breaker.ejectFor
+	default:
+		return true
+	}
+}
+
+// Tells if a call may be sent to the store, the call being the probe when
+// the circuit is half-open
+func (b *backend) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case backendEjected, backendProbing:
+		// A probe that never reported is replaced
+		if now.Sub(b.since) < b.breaker.ejectFor {
+			return false
+		}
+		b.setState(backendProbing, now)
+		return true
+	default:
+		return true
+	}
+}
+
+// Only the errors caused by the store count, not the ones of the request nor
+// the writes superseded by a newer version
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.OK, codes.Canceled, codes.InvalidArgument, codes.NotFound,
+		codes.AlreadyExists, codes.FailedPrecondition, codes.Aborted,
+		codes.OutOfRange, codes.Unimplemented:
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *backend) report(err error, latency time.Duration, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	slow := b.breaker.slowCall > 0 && latency >= b.breaker.slowCall
+	if !isBackendFailure(err) && !slow {
+		b.failures = 0
+		b.setState(backendHealthy, now)
+		return
+	}
+	b.failures++
+	if b.state == backendProbing || (b.breaker.ejectAfter > 0 && b.failures >= b.breaker.ejectAfter) {
+		b.setState(backendEjected, now)
+	} else if b.state != backendEjected {
+		b.setState(backendSuspect, now)
+	}
+}
+
+func (b *backend) unary(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !b.allow(time.Now()) {
+		return errEjected
+	}
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	outcome := err
+	if rep, ok := reply.(*healthpb.HealthCheckResponse); ok && err == nil && rep.Status != healthpb.HealthCheckResponse_SERVING {
+		outcome = errNotServing
+	}
+	b.report(outcome, time.Since(start), time.Now())
+	return err
+}
+
+// Only the opening of the streams counts, they may last long
+func (b *backend) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if !b.allow(time.Now()) {
+		return nil, errEjected
+	}
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	b.report(err, 0, time.Now())
+	return s, err
+}
+
+// The options to dial the store, for its calls to feed the breaker
+func (b *backend) dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(b.unary),
+		grpc.WithChainStreamInterceptor(b.stream),
+	}
+}
+
+// Send a health check, if the breaker allows it. The interceptors count it.
+func (b *backend) check(ctx context.Context, timeout time.Duration) {
+	if !b.available(time.Now()) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, _ = healthpb.NewHealthClient(b.cnx).Check(ctx, &healthpb.HealthCheckRequest{})
+}
+
+func (b *backend) close() {
+	backendStates.DeleteLabelValues(b.addr)
+	if b.cnx != nil {
+		_ = b.cnx.Close()
+	}
+}
+
+// Returns the connection to the store, nil when it is unknown or ejected.
+// The caller holds srv.rw.
+func (srv *service) conn(addr string) *grpc.ClientConn {
+	b := srv.back[addr]
+	if b == nil || !b.available(time.Now()) {
+		return nil
+	}
+	return b.cnx
+}
+
+// Check the health of all the stores
+func (srv *service) checkHealth() {
+	srv.rw.RLock()
+	backends := make([]*backend, 0, len(srv.back))
+	for _, b := range srv.back {
+		backends = append(backends, b)
+	}
+	srv.rw.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			b.check(context.Background(), srv.cfg.healthTimeout)
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (srv *service) breakerConfig() breakerConfig {
+	return breakerConfig{
+		ejectAfter: srv.cfg.ejectAfter,
+		ejectFor:   srv.cfg.ejectFor,
+		slowCall:   srv.cfg.slowCall,
+	}
+}
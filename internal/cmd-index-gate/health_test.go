@@ -0,0 +1,141 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendBreaker(t *testing.T) {
+	b := newBackend("test-breaker", breakerConfig{ejectAfter: 2, ejectFor: time.Minute, slowCall: time.Second})
+	defer b.close()
+	now := time.Now()
+	failure := status.Error(codes.Unavailable, "down")
+
+	check := func(expected backendState) {
+		if b.state != expected {
+			t.Fatal("unexpected state", b.state, "expected", expected)
+		}
+	}
+
+	// The errors of the requests do not count, nor the superseded writes
+	b.report(status.Error(codes.NotFound, "missing"), 0, now)
+	b.report(status.Error(codes.FailedPrecondition, "version"), 0, now)
+	for i := 0; i < 8; i++ {
+		b.report(status.Error(codes.Aborted, "newer version"), 0, now)
+	}
+	check(backendHealthy)
+
+	b.report(failure, 0, now)
+	check(backendSuspect)
+	b.report(nil, 0, now)
+	check(backendHealthy)
+
+	// Slow calls count as failures
+	b.report(nil, 2*time.Second, now)
+	b.report(failure, 0, now)
+	check(backendEjected)
+	if b.allow(now.Add(time.Second)) {
+		t.Fatal("ejected store allowed")
+	}
+
+	// Looking at the store does not start the probe
+	if !b.available(now.Add(time.Minute)) {
+		t.Fatal("store not available for a probe")
+	}
+	check(backendEjected)
+
+	// A single probe is let through, and its failure ejects again
+	if !b.allow(now.Add(time.Minute)) {
+		t.Fatal("probe denied")
+	}
+	check(backendProbing)
+	if b.allow(now.Add(time.Minute + time.Second)) {
+		t.Fatal("second probe allowed")
+	}
+	b.report(failure, 0, now.Add(time.Minute+time.Second))
+	check(backendEjected)
+
+	// A successful probe closes the circuit
+	if !b.allow(now.Add(3 * time.Minute)) {
+		t.Fatal("probe denied")
+	}
+	b.report(nil, 0, now.Add(3*time.Minute))
+	check(backendHealthy)
+	if !b.allow(now.Add(3 * time.Minute)) {
+		t.Fatal("healthy store denied")
+	}
+}
+
+func TestGateEjection(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{ejectAfter: 2, ejectFor: time.Hour})
+	defer tc.Close()
+
+	down := tc.addrs[0]
+	tc.servers[0].Stop()
+	for i := 0; i < 3; i++ {
+		if _, err := tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tc.srv.back[down].state != backendEjected {
+		t.Fatal("store not ejected")
+	}
+	if tc.srv.conn(down) != nil {
+		t.Fatal("ejected store still used")
+	}
+
+	// The health checks skip the ejected store
+	tc.srv.checkHealth()
+	if tc.srv.back[down].state != backendEjected {
+		t.Fatal("store not ejected")
+	}
+	if _, err := tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A store replying NOT_SERVING to the health checks is ejected
+func TestBackendNotServing(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, hs)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	addr := lis.Addr().String()
+	b := newBackend(addr, breakerConfig{ejectAfter: 1, ejectFor: time.Hour})
+	b.cnx, err = grpc.Dial(addr, append(b.dialOptions(), grpc.WithInsecure())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	b.check(context.Background(), time.Second)
+	if b.state != backendEjected {
+		t.Fatal("store not ejected", b.state)
+	}
+	// The calls are refused without reaching the store
+	b.check(context.Background(), time.Second)
+	if _, err = healthpb.NewHealthClient(b.cnx).Check(context.Background(), &healthpb.HealthCheckRequest{}); err != errEjected {
+		t.Fatal(err)
+	}
+}
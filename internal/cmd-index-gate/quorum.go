@@ -0,0 +1,89 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A write succeeds when W of the stores holding the base accepted it, a read
+// returns as soon as R of them replied, a "not found" being a valid reply.
+// With W + R above the number of replicas, a read always reaches a store that
+// accepted the last successful write. A quorum set to 0 means a majority of
+// the replicas.
+
+var (
+	errNoConnection = errors.New("No connection")
+
+	quorumReached = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gunkan_index_quorum_reached",
+		Help: "Number of requests that reached their quorum of index stores",
+	}, []string{"op"})
+
+	quorumFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gunkan_index_quorum_failed",
+		Help: "Number of requests that did not reach their quorum of index stores",
+	}, []string{"op"})
+)
+
+// Returns the number of replies required among n stores, the quorum of the
+// request overriding the one of the gate
+func quorum(configured, requested uint32, n int) (int, error) {
+	q := int(configured)
+	if requested > 0 {
+		q = int(requested)
+	}
+	if q <= 0 {
+		q = n/2 + 1
+	}
+	if q > n {
+		return 0, status.Errorf(codes.Unavailable, "Quorum %d above the %d replicas", q, n)
+	}
+	return q, nil
+}
+
+func reportQuorum(op string, replies, q int) error {
+	if replies < q {
+		quorumFailed.WithLabelValues(op).Inc()
+		return status.Errorf(codes.Unavailable, "Quorum not reached (%d/%d)", replies, q)
+	}
+	quorumReached.WithLabelValues(op).Inc()
+	return nil
+}
+
+// A write that lost against a newer version on too many stores fails with
+// codes.Aborted. The conditional writes are rejected before, see condWrite.
+func reportWrite(op string, accepted, superseded, q int) error {
+	if accepted < q && superseded > 0 {
+		quorumFailed.WithLabelValues(op).Inc()
+		return status.Errorf(codes.Aborted, "Newer version on %d stores", superseded)
+	}
+	return reportQuorum(op, accepted, q)
+}
+
+// Keep the most relevant of the replies to a Get: the highest version, then
+// a value or a deletion rather than a missing key, then a deletion rather
+// than a value. The ties between values of the same version are broken on
+// the values, so that all the gates pick the same.
+func betterValue(best *targetErrorValue, x targetErrorValue) bool {
+	if best == nil {
+		return true
+	}
+	if best.version != x.version {
+		return x.version > best.version
+	}
+	if best.missing != x.missing {
+		return best.missing
+	}
+	if best.deleted != x.deleted {
+		return x.deleted
+	}
+	return x.value > best.value
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		configured, requested uint32
+		n, expected           int
+	}{
+		{0, 0, 1, 1},
+		{0, 0, 3, 2},
+		{0, 0, 4, 3},
+		{1, 0, 3, 1},
+		{1, 3, 3, 3},
+	} {
+		q, err := quorum(tc.configured, tc.requested, tc.n)
+		if err != nil || q != tc.expected {
+			t.Fatalf("quorum(%v) = %d, %v", tc, q, err)
+		}
+	}
+	if _, err := quorum(4, 0, 3); err == nil {
+		t.Fatal("quorum above the stores accepted")
+	}
+	if _, err := quorum(0, 0, 0); err == nil {
+		t.Fatal("quorum without stores accepted")
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	if err := reportWrite("put", 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := reportWrite("put", 1, 0, 2); status.Code(err) != codes.Unavailable {
+		t.Fatal(err)
+	}
+	if err := reportWrite("put", 1, 2, 2); status.Code(err) != codes.Aborted {
+		t.Fatal(err)
+	}
+}
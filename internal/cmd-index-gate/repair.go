@@ -0,0 +1,151 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// When the replies to a Get disagree, the gate writes the winning value and
+// version back to the stores that replied an older version or no value, and
+// a winning deletion is written back as a deletion at its version. In
+// the "inline" mode, the Get waits for all the replies and for the repairs.
+// In the "async" mode, the Get returns at the read quorum and only the stores
+// that replied before are repaired, in the background.
+// A key is repaired at most once per period, so that a hot key read while a
+// store lags does not trigger a storm of repairs.
+
+const (
+	repairOff    = "off"
+	repairAsync  = "async"
+	repairInline = "inline"
+
+	repairTimeout = 5 * time.Second
+	// Size of the history of repairs above which the old entries are purged
+	repairHistoryMax = 16384
+)
+
+var (
+	repairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gunkan_index_repair",
+		Help: "Number of replicas repaired after a read, by outcome",
+	}, []string{"result"})
+)
+
+func checkRepairMode(mode string) error {
+	switch mode {
+	case repairOff, repairAsync, repairInline:
+		return nil
+	default:
+		return errors.New("Invalid read repair mode")
+	}
+}
+
+// repairLimiter remembers the last repair of each key
+type repairLimiter struct {
+	lock   sync.Mutex
+	period time.Duration
+	last   map[gunkan.BaseKey]time.Time
+}
+
+func newRepairLimiter(period time.Duration) *repairLimiter {
+	return &repairLimiter{period: period, last: make(map[gunkan.BaseKey]time.Time)}
+}
+
+// Tells if the key may be repaired now, and then records the repair
+func (l *repairLimiter) allow(key gunkan.BaseKey, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.period {
+		return false
+	}
+	if len(l.last) >= repairHistoryMax {
+		for k, t := range l.last {
+			if now.Sub(t) >= l.period {
+				delete(l.last, k)
+			}
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// Returns the stores whose reply is older than the winner
+func lagging(best *targetErrorValue, replies []targetErrorValue) []string {
+	if best == nil || best.missing {
+		return nil
+	}
+	out := make([]string, 0)
+	for _, x := range replies {
+		if x.missing || x.version < best.version {
+			out = append(out, x.addr)
+		}
+	}
+	return out
+}
+
+// Write the winner back to the lagging stores. The caller holds srv.rw.
+func (srv *service) repair(ctx context.Context, req *proto.GetRequest, best *targetErrorValue, addrs []string) {
+	put := proto.PutRequest{Base: req.Base, Key: req.Key, Value: best.value, Version: best.version}
+	del := proto.DeleteRequest{Base: req.Base, Key: req.Key, Version: best.version}
+	for _, addr := range addrs {
+		cnx := srv.conn(addr)
+		if cnx == nil {
+			repairs.WithLabelValues("failed").Inc()
+			continue
+		}
+		var err error
+		if best.deleted {
+			_, err = proto.NewIndexClient(cnx).Delete(ctx, &del)
+		} else {
+			_, err = proto.NewIndexClient(cnx).Put(ctx, &put)
+		}
+		if status.Code(err) == codes.Aborted {
+			// The store got a newer version meanwhile
+			repairs.WithLabelValues("superseded").Inc()
+		} else if err != nil {
+			gunkan.Logger.Warn().Str("op", "REPAIR").Str("k", req.Key).Str("srv", addr).Err(err).Msg("Read repair")
+			repairs.WithLabelValues("failed").Inc()
+		} else {
+			repairs.WithLabelValues("done").Inc()
+		}
+	}
+}
+
+// Start the repairs according to the mode of the gate
+func (srv *service) maybeRepair(ctx context.Context, req *proto.GetRequest, best *targetErrorValue, replies []targetErrorValue) {
+	addrs := lagging(best, replies)
+	if len(addrs) == 0 || srv.cfg.readRepair == repairOff {
+		return
+	}
+	if !srv.repairs.allow(gunkan.BK(req.Base, req.Key), time.Now()) {
+		repairs.WithLabelValues("skipped").Add(float64(len(addrs)))
+		return
+	}
+	if srv.cfg.readRepair == repairInline {
+		srv.repair(ctx, req, best, addrs)
+		return
+	}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		srv.rw.RLock()
+		defer srv.rw.RUnlock()
+		ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+		defer cancel()
+		srv.repair(ctx, req, best, addrs)
+	}()
+}
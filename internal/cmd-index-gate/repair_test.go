@@ -0,0 +1,61 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"testing"
+	"time"
+)
+
+func TestRepairLagging(t *testing.T) {
+	reply := func(addr string, version uint64, missing bool) targetErrorValue {
+		x := targetErrorValue{version: version, missing: missing}
+		x.addr = addr
+		return x
+	}
+	replies := []targetErrorValue{
+		reply("a", 2, false),
+		reply("b", 3, false),
+		reply("c", 0, true),
+		reply("d", 3, false),
+	}
+	var best *targetErrorValue
+	for _, x := range replies {
+		if betterValue(best, x) {
+			x := x
+			best = &x
+		}
+	}
+	if best.addr != "b" {
+		t.Fatal(best)
+	}
+	if got := lagging(best, replies); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Fatal(got)
+	}
+	missing := reply("c", 0, true)
+	if got := lagging(&missing, replies); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestRepairLimiter(t *testing.T) {
+	l := newRepairLimiter(time.Second)
+	k := gunkan.BK("b", "k")
+	now := time.Now()
+	if !l.allow(k, now) {
+		t.Fatal()
+	}
+	if l.allow(k, now.Add(time.Second/2)) {
+		t.Fatal()
+	}
+	if !l.allow(gunkan.BK("b", "other"), now) {
+		t.Fatal()
+	}
+	if !l.allow(k, now.Add(2*time.Second)) {
+		t.Fatal()
+	}
+}
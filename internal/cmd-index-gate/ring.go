@@ -0,0 +1,107 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// The bases are placed on the index stores with a consistent hash ring. Each
+// store owns several virtual nodes on the ring, and a base is held by the RF
+// distinct stores met clockwise from the hash of its name. All the keys of a
+// base are on the same stores, so that a List only has to merge their replies.
+// Adding or removing a store only moves the bases of its neighbours, and the
+// moved bases are handed off to their new owners, see setRing().
+
+type ringPoint struct {
+	hash uint64
+	addr string
+}
+
+type hashRing struct {
+	points []ringPoint
+	// Number of distinct stores on the ring
+	nodes int
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func newHashRing(addrs []string, vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	ring := hashRing{points: make([]ringPoint, 0, len(addrs)*vnodes)}
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		ring.nodes++
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{ringHash(a + "#" + strconv.Itoa(i)), a})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash == ring.points[j].hash {
+			return ring.points[i].addr < ring.points[j].addr
+		}
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return &ring
+}
+
+// Returns the stores holding the base, the first one being the preferred.
+// rf <= 0 means all the stores.
+func (ring *hashRing) owners(base string, rf int) []string {
+	if rf <= 0 || rf > ring.nodes {
+		rf = ring.nodes
+	}
+	if rf == 0 {
+		return nil
+	}
+	h := ringHash(base)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= h })
+	out := make([]string, 0, rf)
+	seen := make(map[string]bool)
+	for i := 0; len(out) < rf; i++ {
+		p := ring.points[(start+i)%len(ring.points)]
+		if !seen[p.addr] {
+			seen[p.addr] = true
+			out = append(out, p.addr)
+		}
+	}
+	return out
+}
+
+// Tells if both rings place the bases the same way
+func (ring *hashRing) equal(other *hashRing) bool {
+	if len(ring.points) != len(other.points) {
+		return false
+	}
+	for i, p := range ring.points {
+		if p != other.points[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Tells if the store is on the ring
+func (ring *hashRing) has(addr string) bool {
+	for _, p := range ring.points {
+		if p.addr == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+	ring := newHashRing(addrs, 64)
+
+	if got := ring.owners("x", 0); len(got) != len(addrs) {
+		t.Fatalf("unexpected owners %v", got)
+	}
+	if got := ring.owners("x", 10); len(got) != len(addrs) {
+		t.Fatalf("unexpected owners %v", got)
+	}
+
+	count := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		base := fmt.Sprintf("base-%d", i)
+		owners := ring.owners(base, 3)
+		if len(owners) != 3 || owners[0] == owners[1] || owners[1] == owners[2] || owners[0] == owners[2] {
+			t.Fatalf("unexpected owners %v", owners)
+		}
+		for _, o := range owners {
+			count[o]++
+		}
+	}
+	for _, a := range addrs {
+		if count[a] < 300 {
+			t.Fatalf("unbalanced ring %v", count)
+		}
+	}
+
+	// Adding a store only moves the bases it now owns
+	bigger := newHashRing(append(addrs, "f:1"), 64)
+	for i := 0; i < 1000; i++ {
+		base := fmt.Sprintf("base-%d", i)
+		before, after := ring.owners(base, 1)[0], bigger.owners(base, 1)[0]
+		if before != after && after != "f:1" {
+			t.Fatalf("%s moved from %s to %s", base, before, after)
+		}
+	}
+
+	if got := newHashRing(nil, 64).owners("x", 3); len(got) != 0 {
+		t.Fatalf("unexpected owners %v", got)
+	}
+}
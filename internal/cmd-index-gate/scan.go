@@ -0,0 +1,116 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+)
+
+// The gate merges the streams of the stores holding the base, each one
+// already sorted, and removes the items present on several replicas.
+
+type scanSource interface {
+	Recv() (*proto.ScanItem, error)
+}
+
+// A source and its next item, nil once exhausted
+type scanHead struct {
+	src  scanSource
+	item *proto.ScanItem
+}
+
+func (h *scanHead) advance() error {
+	item, err := h.src.Recv()
+	if err == io.EOF {
+		h.item = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.item = item
+	return nil
+}
+
+// Merge the sorted sources into the hook, until the limit if not 0
+func mergeScan(sources []scanSource, reverse bool, limit uint32, hook func(*proto.ScanItem) error) error {
+	heads := make([]*scanHead, 0, len(sources))
+	for _, src := range sources {
+		h := &scanHead{src: src}
+		if err := h.advance(); err != nil {
+			return err
+		}
+		heads = append(heads, h)
+	}
+
+	before := func(a, b *proto.ScanItem) bool {
+		if reverse {
+			return a.Key > b.Key
+		}
+		return a.Key < b.Key
+	}
+
+	var sent uint32
+	for limit == 0 || sent < limit {
+		var next *proto.ScanItem
+		for _, h := range heads {
+			if h.item != nil && (next == nil || before(h.item, next)) {
+				next = h.item
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		if err := hook(next); err != nil {
+			return err
+		}
+		sent++
+		for _, h := range heads {
+			if h.item != nil && h.item.Key == next.Key {
+				if err := h.advance(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (srv *service) Scan(req *proto.ScanRequest, stream proto.Index_ScanServer) error {
+	if req.Base == "" {
+		return status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+
+	srv.rw.RLock()
+	targets := srv.readTargets(req.Base)
+	srv.rw.RUnlock()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	sources := make([]scanSource, 0, len(targets))
+	for _, t := range targets {
+		if t.cnx == nil {
+			continue
+		}
+		src, err := proto.NewIndexClient(t.cnx).Scan(ctx, req)
+		if err != nil {
+			gunkan.Logger.Info().Str("op", "SCAN").Str("srv", t.addr).Err(err).Msg("Scan")
+			continue
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return status.Errorf(codes.Unavailable, "No backend replied")
+	}
+
+	return mergeScan(sources, req.Reverse, req.Limit, stream.Send)
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type sliceSource []string
+
+func (s *sliceSource) Recv() (*proto.ScanItem, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	item := &proto.ScanItem{Key: (*s)[0]}
+	*s = (*s)[1:]
+	return item, nil
+}
+
+func TestMergeScan(t *testing.T) {
+	run := func(reverse bool, limit uint32, tabs ...[]string) []string {
+		sources := make([]scanSource, 0)
+		for _, tab := range tabs {
+			src := sliceSource(tab)
+			sources = append(sources, &src)
+		}
+		out := make([]string, 0)
+		err := mergeScan(sources, reverse, limit, func(item *proto.ScanItem) error {
+			out = append(out, item.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	got := run(false, 0, []string{"a", "c", "d"}, []string{"b", "c"}, []string{}, []string{"a", "e"})
+	if !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatal(got)
+	}
+	got = run(true, 3, []string{"d", "c", "a"}, []string{"c", "b"})
+	if !reflect.DeepEqual(got, []string{"d", "c", "b"}) {
+		t.Fatal(got)
+	}
+}
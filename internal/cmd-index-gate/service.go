@@ -12,6 +12,8 @@ import (
 	"github.com/jfsmig/object-storage/pkg/gunkan"
 	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"sync"
 	"time"
 )
@@ -28,6 +30,28 @@ type serviceConfig struct {
 	addrBind     string
 	addrAnnounce string
 	dirConfig    string
+
+	// See quorum()
+	writeQuorum uint32
+	readQuorum  uint32
+
+	// See repair()
+	readRepair   string
+	repairPeriod time.Duration
+
+	// Delay between two passes of the anti-entropy, 0 to disable it
+	antiEntropyPeriod time.Duration
+
+	// See hashRing
+	replicas     uint
+	virtualNodes uint
+
+	// See backend
+	ejectAfter    uint
+	ejectFor      time.Duration
+	slowCall      time.Duration
+	healthPeriod  time.Duration
+	healthTimeout time.Duration
 }
 
 type service struct {
@@ -38,8 +62,16 @@ type service struct {
 
 	wg           sync.WaitGroup
 	rw           sync.RWMutex
-	back         map[string]*grpc.ClientConn
+	back         map[string]*backend
+	ring         *hashRing
+	clock        gunkan.HLC
+	repairs      *repairLimiter
 	flag_running bool
+
+	// The rings whose bases are not handed off yet, see setRing()
+	former      []*hashRing
+	ringChanges uint64
+	handingOff  bool
 }
 
 func NewService(config serviceConfig) (*service, error) {
@@ -48,7 +80,13 @@ func NewService(config serviceConfig) (*service, error) {
 	srv := service{}
 	srv.cfg = config
 	srv.flag_running = true
-	srv.back = make(map[string]*grpc.ClientConn)
+	srv.back = make(map[string]*backend)
+	srv.ring = newHashRing(nil, 0)
+	srv.repairs = newRepairLimiter(config.repairPeriod)
+
+	if err = checkRepairMode(config.readRepair); err != nil {
+		return nil, err
+	}
 
 	srv.catalog, err = gunkan.NewCatalogDefault()
 	if err != nil {
@@ -63,12 +101,25 @@ func NewService(config serviceConfig) (*service, error) {
 	srv.wg.Add(1)
 	go func() {
 		defer srv.wg.Done()
+		lastCheck := time.Now()
 		for srv.flag_running {
 			tick := time.After(1 * time.Second)
 			<-tick
 			srv.reload()
+			srv.maybeHandoff()
+			if srv.cfg.healthPeriod > 0 && time.Since(lastCheck) >= srv.cfg.healthPeriod {
+				srv.checkHealth()
+				lastCheck = time.Now()
+			}
 		}
 	}()
+	if config.antiEntropyPeriod > 0 {
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.runAntiEntropy()
+		}()
+	}
 	return &srv, nil
 }
 
@@ -85,18 +136,52 @@ func (srv *service) reload() {
 
 	// Open a connection to each new declared backend.
 	// We avoid closing/reopening connections to stable backends
+	declared := make(map[string]bool)
 	for _, a := range addrs {
-		if c, ok := srv.back[a]; ok && c != nil {
+		declared[a] = true
+		if _, ok := srv.back[a]; ok {
 			continue
 		}
-		c, err := helpers_grpc.DialTLSInsecure(a)
+		b := newBackend(a, srv.breakerConfig())
+		c, err := helpers_grpc.DialTLSInsecure(a, b.dialOptions()...)
 		if err != nil {
 			gunkan.Logger.Warn().Err(err).Str("to", a).Msg("Connection error to index")
-			srv.back[a] = nil
-		} else {
-			srv.back[a] = c
+			b.close()
+			continue
+		}
+		b.cnx = c
+		srv.back[a] = b
+	}
+
+	// Close the connections to the backends that left the catalog, once
+	// their bases are handed off
+	srv.setRing(newHashRing(addrs, int(srv.cfg.virtualNodes)))
+	for a, b := range srv.back {
+		if !declared[a] && !srv.isFormerOwner(a) {
+			b.close()
+			delete(srv.back, a)
+		}
+	}
+}
+
+// Returns the stores holding the base. The caller holds srv.rw.
+func (srv *service) targets(base string) []targetInput {
+	owners := srv.ring.owners(base, int(srv.cfg.replicas))
+	out := make([]targetInput, 0, len(owners))
+	for _, addr := range owners {
+		out = append(out, targetInput{addr: addr, cnx: srv.conn(addr)})
+	}
+	return out
+}
+
+// Tells if the store is among the targets
+func isTarget(targets []targetInput, addr string) bool {
+	for _, t := range targets {
+		if t.addr == addr {
+			return true
 		}
 	}
+	return false
 }
 
 func (srv *service) Join() {
@@ -113,6 +198,9 @@ type targetErrorValue struct {
 	targetError
 	value   string
 	version uint64
+	// The store replied the key is absent, or deleted at version
+	missing bool
+	deleted bool
 }
 
 type targetErrorList struct {
@@ -194,11 +282,26 @@ func mergeTargetValueList(chans ...<-chan targetErrorList) <-chan targetErrorLis
 	return out
 }
 
+var errVersionAhead = status.Error(codes.InvalidArgument, "Version ahead of the clock")
+
+// A version set by the client may not be far ahead of the clock, lest it
+// stamps a key that no later write could replace
+func checkVersion(version uint64) error {
+	if version != 0 && !gunkan.HLCValid(version) {
+		return errVersionAhead
+	}
+	return nil
+}
+
 func (srv *service) Put(ctx context.Context, req *proto.PutRequest) (*proto.None, error) {
 	work := func(input <-chan targetInput) <-chan targetError {
 		out := make(chan targetError, 1)
 		go func() {
 			for i := range input {
+				if i.cnx == nil {
+					out <- targetError{i.addr, errNoConnection}
+					continue
+				}
 				cli := proto.NewIndexClient(i.cnx)
 				_, err := cli.Put(ctx, req)
 				out <- targetError{i.addr, err}
@@ -211,34 +314,69 @@ func (srv *service) Put(ctx context.Context, req *proto.PutRequest) (*proto.None
 	srv.rw.RLock()
 	defer srv.rw.RUnlock()
 
-	in := make(chan targetInput, len(srv.back))
+	targets := srv.targets(req.Base)
+	w, err := quorum(srv.cfg.writeQuorum, req.Quorum, len(targets))
+	if err != nil {
+		return nil, err
+	}
+
+	// All the replicas get the same version, newer than the one the write
+	// depends on
+	if err = checkVersion(req.Version); err != nil {
+		return nil, err
+	}
+	srv.clock.Observe(req.IfVersion)
+	if req.Version == 0 {
+		req.Version = srv.clock.Now()
+	} else {
+		srv.clock.Observe(req.Version)
+	}
+
+	if cond := (condition{req.IfAbsent, req.IfVersion}); cond.set() {
+		err = srv.condWrite(ctx, "put", &proto.GetRequest{Base: req.Base, Key: req.Key}, cond, targets, w,
+			func(cli proto.IndexClient, conditional bool) error {
+				put := proto.PutRequest{Base: req.Base, Key: req.Key, Value: req.Value, Version: req.Version}
+				if conditional {
+					put.IfAbsent, put.IfVersion = req.IfAbsent, req.IfVersion
+				}
+				_, err := cli.Put(ctx, &put)
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+		return &proto.None{}, nil
+	}
+
+	in := make(chan targetInput, len(targets))
 	outv := make([]<-chan targetError, 0)
 	for i := 0; i < parallelismPut; i++ {
 		outv = append(outv, work(in))
 	}
 	out := mergeTargetError(outv...)
 
-	for addr, cnx := range srv.back {
-		in <- targetInput{addr: addr, cnx: cnx}
+	for _, t := range targets {
+		in <- t
 	}
 	close(in)
-	any := false
+	accepted, superseded := 0, 0
 	for err := range out {
 		if err.err == nil {
 			gunkan.Logger.Debug().
 				Str("op", "PUT").Str("k", req.Key).Str("srv", err.addr)
-			any = true
+			accepted++
+		} else if status.Code(err.err) == codes.Aborted {
+			superseded++
 		} else {
 			gunkan.Logger.Warn().
 				Str("op", "PUT").Str("k", req.Key).Str("srv", err.addr).Err(err.err)
 		}
 	}
 
-	if !any {
-		return nil, errors.New("No backend replied")
-	} else {
-		return &proto.None{}, nil
+	if err = reportWrite("put", accepted, superseded, w); err != nil {
+		return nil, err
 	}
+	return &proto.None{}, nil
 }
 
 func (srv *service) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.None, error) {
@@ -246,6 +384,10 @@ func (srv *service) Delete(ctx context.Context, req *proto.DeleteRequest) (*prot
 		out := make(chan targetError)
 		go func() {
 			for i := range input {
+				if i.cnx == nil {
+					out <- targetError{i.addr, errNoConnection}
+					continue
+				}
 				cli := proto.NewIndexClient(i.cnx)
 				_, err := cli.Delete(ctx, req)
 				out <- targetError{i.addr, err}
@@ -256,34 +398,68 @@ func (srv *service) Delete(ctx context.Context, req *proto.DeleteRequest) (*prot
 	}
 
 	srv.rw.RLock()
-	in := make(chan targetInput, len(srv.back))
+	defer srv.rw.RUnlock()
+
+	targets := srv.targets(req.Base)
+	w, err := quorum(srv.cfg.writeQuorum, req.Quorum, len(targets))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkVersion(req.Version); err != nil {
+		return nil, err
+	}
+	srv.clock.Observe(req.IfVersion)
+	if req.Version == 0 {
+		req.Version = srv.clock.Now()
+	} else {
+		srv.clock.Observe(req.Version)
+	}
+
+	if cond := (condition{ifVersion: req.IfVersion}); cond.set() {
+		err = srv.condWrite(ctx, "delete", &proto.GetRequest{Base: req.Base, Key: req.Key}, cond, targets, w,
+			func(cli proto.IndexClient, conditional bool) error {
+				del := proto.DeleteRequest{Base: req.Base, Key: req.Key, Version: req.Version}
+				if conditional {
+					del.IfVersion = req.IfVersion
+				}
+				_, err := cli.Delete(ctx, &del)
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+		return &proto.None{}, nil
+	}
+
+	in := make(chan targetInput, len(targets))
 	outv := make([]<-chan targetError, 0)
 	for i := 0; i < parallelismDelete; i++ {
 		outv = append(outv, work(in))
 	}
 	out := mergeTargetError(outv...)
-	for addr, cnx := range srv.back {
-		in <- targetInput{addr: addr, cnx: cnx}
+	for _, t := range targets {
+		in <- t
 	}
 	close(in)
-	any := false
+	accepted, superseded := 0, 0
 	for err := range out {
 		if err.err == nil {
 			gunkan.Logger.Debug().
 				Str("op", "DEL").Str("k", req.Key).Str("srv", err.addr)
-			any = true
+			accepted++
+		} else if status.Code(err.err) == codes.Aborted {
+			superseded++
 		} else {
 			gunkan.Logger.Debug().
 				Str("op", "DEL").Str("k", req.Key).Str("srv", err.addr).Err(err.err)
 		}
 	}
-	srv.rw.RUnlock()
 
-	if !any {
-		return nil, errors.New("No backend replied")
-	} else {
-		return &proto.None{}, nil
+	if err = reportWrite("delete", accepted, superseded, w); err != nil {
+		return nil, err
 	}
+	return &proto.None{}, nil
 }
 
 func (srv *service) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetReply, error) {
@@ -291,14 +467,23 @@ func (srv *service) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetR
 		out := make(chan targetErrorValue, 1)
 		go func() {
 			for i := range input {
-				cli := proto.NewIndexClient(i.cnx)
-				rep, err := cli.Get(ctx, req)
 				rc := targetErrorValue{}
 				rc.addr = i.addr
-				rc.err = err
+				if i.cnx == nil {
+					rc.err = errNoConnection
+					out <- rc
+					continue
+				}
+				cli := proto.NewIndexClient(i.cnx)
+				rep, err := cli.Get(ctx, req)
 				if err == nil {
 					rc.value = rep.Value
 					rc.version = rep.Version
+					rc.deleted = rep.Deleted
+				} else if status.Code(err) == codes.NotFound {
+					rc.missing = true
+				} else {
+					rc.err = err
 				}
 				out <- rc
 			}
@@ -308,39 +493,63 @@ func (srv *service) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetR
 	}
 
 	srv.rw.RLock()
-	srv.rw.RUnlock()
+	defer srv.rw.RUnlock()
 
-	in := make(chan targetInput, len(srv.back))
+	targets := srv.targets(req.Base)
+	r, err := quorum(srv.cfg.readQuorum, req.Quorum, len(targets))
+	if err != nil {
+		return nil, err
+	}
+	readers := srv.withFormerOwners(req.Base, targets)
+
+	in := make(chan targetInput, len(readers))
 	outv := make([]<-chan targetErrorValue, 0)
 	for i := 0; i < parallelismGet; i++ {
 		outv = append(outv, work(in))
 	}
 	out := mergeTargetValueError(outv...)
 
-	for addr, cnx := range srv.back {
-		in <- targetInput{addr: addr, cnx: cnx}
+	for _, t := range readers {
+		in <- t
 	}
 	close(in)
 
-	any := false
-	rep := proto.GetReply{Value: "", Version: 0}
+	// Return as soon as the quorum of owners is reached, the late replies are
+	// dropped unless the repairs are inline or the base is handed off.
+	var best *targetErrorValue
+	replies := make([]targetErrorValue, 0, len(readers))
+	owned := 0
 	for x := range out {
 		if x.err != nil {
 			gunkan.Logger.Warn().Str("op", "GET").Str("k", req.Key).Str("srv", x.addr).Err(x.err)
-		} else {
-			any = true
-			if x.version > rep.Version {
-				rep.Version = x.version
-				rep.Value = x.value
-			}
+			continue
+		}
+		if betterValue(best, x) {
+			x := x
+			best = &x
+		}
+		replies = append(replies, x)
+		if isTarget(targets, x.addr) {
+			owned++
+		}
+		if owned >= r && srv.cfg.readRepair != repairInline && len(readers) == len(targets) {
+			break
 		}
 	}
+	go func() {
+		for range out {
+		}
+	}()
 
-	if !any {
-		return nil, errors.New("No backend replied")
-	} else {
-		return &rep, nil
+	if err = reportQuorum("get", owned, r); err != nil {
+		return nil, err
 	}
+	srv.clock.Observe(best.version)
+	srv.maybeRepair(ctx, req, best, replies)
+	if best.missing || best.deleted {
+		return nil, status.Error(codes.NotFound, "Not found")
+	}
+	return &proto.GetReply{Value: best.value, Version: best.version}, nil
 }
 
 func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.ListReply, error) {
@@ -348,10 +557,15 @@ func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.Li
 		out := make(chan targetErrorList, 1)
 		go func() {
 			for i := range input {
-				cli := proto.NewIndexClient(i.cnx)
-				rep, err := cli.List(ctx, req)
 				rc := targetErrorList{}
 				rc.addr = i.addr
+				if i.cnx == nil {
+					rc.err = errNoConnection
+					out <- rc
+					continue
+				}
+				cli := proto.NewIndexClient(i.cnx)
+				rep, err := cli.List(ctx, req)
 				rc.err = err
 				if err == nil {
 					rc.items = rep.Items[:]
@@ -370,17 +584,18 @@ func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.Li
 	}
 
 	srv.rw.RLock()
-	srv.rw.RUnlock()
+	defer srv.rw.RUnlock()
 
-	in := make(chan targetInput, len(srv.back))
+	targets := srv.readTargets(req.Base)
+	in := make(chan targetInput, len(targets))
 	outv := make([]<-chan targetErrorList, 0)
 	for i := 0; i < parallelismList; i++ {
 		outv = append(outv, work(in))
 	}
 	out := mergeTargetValueList(outv...)
 
-	for addr, cnx := range srv.back {
-		in <- targetInput{addr: addr, cnx: cnx}
+	for _, t := range targets {
+		in <- t
 	}
 	close(in)
 
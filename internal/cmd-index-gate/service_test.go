@@ -0,0 +1,687 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory index store, keeping the latest version of each key. Like the
+// RocksDB store, it reports the deletions to Get and it iterates the keys in
+// the order of their encoded gunkan.KeyVersion.
+type memStore struct {
+	proto.UnimplementedIndexServer
+	sync.Mutex
+	kv map[gunkan.BaseKey]*proto.Entry
+	// The change log, and the channel closed at each change
+	log     []*proto.Event
+	changed chan struct{}
+	// Signaled by each Watch, once subscribed to the changes
+	watching chan struct{}
+}
+
+func (st *memStore) write(base string, e proto.Entry, ifAbsent bool, ifVersion uint64) error {
+	st.Lock()
+	defer st.Unlock()
+	prev := st.kv[gunkan.BK(base, e.Key)]
+	live := prev != nil && !prev.Deleted
+	if (ifAbsent && live) || (ifVersion != 0 && (!live || prev.Version != ifVersion)) {
+		return status.Error(codes.FailedPrecondition, "Precondition")
+	}
+	if prev != nil && prev.Version > e.Version {
+		return status.Error(codes.Aborted, "Newer version present")
+	}
+	st.kv[gunkan.BK(base, e.Key)] = &e
+	st.log = append(st.log, &proto.Event{
+		Sequence: uint64(len(st.log) + 1), Base: base, Key: e.Key,
+		Version: e.Version, Deleted: e.Deleted})
+	close(st.changed)
+	st.changed = make(chan struct{})
+	return nil
+}
+
+func (st *memStore) Watch(req *proto.WatchRequest, stream proto.Index_WatchServer) error {
+	st.Lock()
+	next := req.FromSequence
+	if next == 0 {
+		next = uint64(len(st.log) + 1)
+	}
+	st.Unlock()
+	select {
+	case st.watching <- struct{}{}:
+	default:
+	}
+	for {
+		st.Lock()
+		pending := st.log[next-1:]
+		changed := st.changed
+		st.Unlock()
+		for _, e := range pending {
+			next++
+			if e.Base == req.Base && strings.HasPrefix(e.Key, req.Prefix) {
+				if err := stream.Send(e); err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (st *memStore) Put(ctx context.Context, req *proto.PutRequest) (*proto.None, error) {
+	e := proto.Entry{Key: req.Key, Value: req.Value, Version: req.Version}
+	return &proto.None{}, st.write(req.Base, e, req.IfAbsent, req.IfVersion)
+}
+
+func (st *memStore) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.None, error) {
+	e := proto.Entry{Key: req.Key, Version: req.Version, Deleted: true}
+	return &proto.None{}, st.write(req.Base, e, false, req.IfVersion)
+}
+
+func (st *memStore) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetReply, error) {
+	st.Lock()
+	defer st.Unlock()
+	e := st.kv[gunkan.BK(req.Base, req.Key)]
+	if e == nil {
+		return nil, status.Error(codes.NotFound, "Not found")
+	}
+	return &proto.GetReply{Value: e.Value, Version: e.Version, Deleted: e.Deleted}, nil
+}
+
+func (st *memStore) BatchPut(ctx context.Context, req *proto.BatchPutRequest) (*proto.BatchReply, error) {
+	rep := proto.BatchReply{}
+	for _, item := range req.Items {
+		_, err := st.Put(ctx, item)
+		rep.Items = append(rep.Items, itemStatus(err))
+	}
+	return &rep, nil
+}
+
+func (st *memStore) BatchDelete(ctx context.Context, req *proto.BatchDeleteRequest) (*proto.BatchReply, error) {
+	rep := proto.BatchReply{}
+	for _, item := range req.Items {
+		_, err := st.Delete(ctx, item)
+		rep.Items = append(rep.Items, itemStatus(err))
+	}
+	return &rep, nil
+}
+
+func (st *memStore) BatchGet(ctx context.Context, req *proto.BatchGetRequest) (*proto.BatchGetReply, error) {
+	rep := proto.BatchGetReply{}
+	for _, item := range req.Items {
+		r, err := st.Get(ctx, item)
+		if err != nil {
+			rep.Items = append(rep.Items, &proto.GetItem{Status: itemStatus(err)})
+		} else {
+			rep.Items = append(rep.Items, &proto.GetItem{Status: itemStatus(nil), Value: r.Value, Version: r.Version, Deleted: r.Deleted})
+		}
+	}
+	return &rep, nil
+}
+
+func (st *memStore) Bases(ctx context.Context, req *proto.ListRequest) (*proto.ListReply, error) {
+	st.Lock()
+	seen := make(map[string]bool)
+	for k := range st.kv {
+		if k.Base > req.Marker {
+			seen[k.Base] = true
+		}
+	}
+	st.Unlock()
+	rep := proto.ListReply{}
+	for b := range seen {
+		rep.Items = append(rep.Items, b)
+	}
+	sort.Strings(rep.Items)
+	if uint32(len(rep.Items)) > req.Max {
+		rep.Items = rep.Items[:req.Max]
+	}
+	return &rep, nil
+}
+
+func (st *memStore) Fetch(req *proto.FetchRequest, stream proto.Index_FetchServer) error {
+	st.Lock()
+	entries := make([]proto.Entry, 0)
+	for k, e := range st.kv {
+		if k.Base == req.Base {
+			entries = append(entries, *e)
+		}
+	}
+	st.Unlock()
+	for i := range entries {
+		if err := stream.Send(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *memStore) Scan(req *proto.ScanRequest, stream proto.Index_ScanServer) error {
+	st.Lock()
+	entries := make([]string, 0)
+	for k, e := range st.kv {
+		if k.Base == req.Base && !e.Deleted {
+			kv := gunkan.KeyVersion{Base: k.Base, Key: k.Key, Version: e.Version, Active: true}
+			entries = append(entries, kv.Encode())
+		}
+	}
+	st.Unlock()
+	sort.Strings(entries)
+	if req.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(entries)))
+	}
+	scanner := gunkan.NewIndexScanner(gunkan.IndexScanOptions{
+		Start: req.Start, End: req.End, Prefix: req.Prefix, Delimiter: req.Delimiter,
+		Reverse: req.Reverse, Limit: req.Limit})
+	for _, encoded := range entries {
+		var k gunkan.KeyVersion
+		if err := k.DecodeString(encoded); err != nil {
+			return err
+		}
+		item, emit, done := scanner.Feed(k.Key)
+		if done {
+			break
+		}
+		if emit {
+			if err := stream.Send(&proto.ScanItem{Key: item.Key, Prefix: item.Prefix}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type testCluster struct {
+	srv     *service
+	stores  []*memStore
+	servers []*grpc.Server
+	addrs   []string
+}
+
+// Start a gate with n in-memory stores, each one holding all the bases
+func newTestCluster(t *testing.T, n int, cfg serviceConfig) *testCluster {
+	tc := testCluster{}
+	back := make(map[string]*backend)
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := &memStore{
+			kv:       make(map[gunkan.BaseKey]*proto.Entry),
+			changed:  make(chan struct{}),
+			watching: make(chan struct{}, 16),
+		}
+		server := grpc.NewServer()
+		proto.RegisterIndexServer(server, st)
+		go server.Serve(lis)
+		addr := lis.Addr().String()
+		b := newBackend(addr, breakerConfig{ejectAfter: cfg.ejectAfter, ejectFor: cfg.ejectFor})
+		b.cnx, err = grpc.Dial(addr, append(b.dialOptions(), grpc.WithInsecure())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back[addr] = b
+		tc.stores = append(tc.stores, st)
+		tc.servers = append(tc.servers, server)
+		tc.addrs = append(tc.addrs, addr)
+	}
+	if cfg.readRepair == "" {
+		cfg.readRepair = repairOff
+	}
+	tc.srv = &service{
+		cfg:          cfg,
+		back:         back,
+		ring:         newHashRing(tc.addrs, 16),
+		repairs:      newRepairLimiter(time.Second),
+		flag_running: true,
+	}
+	return &tc
+}
+
+func (tc *testCluster) Close() {
+	tc.srv.wg.Wait()
+	for _, s := range tc.servers {
+		s.Stop()
+	}
+	for _, b := range tc.srv.back {
+		b.close()
+	}
+}
+
+func TestGateQuorum(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{})
+	defer tc.Close()
+
+	if _, err := tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"})
+	if err != nil || rep.Value != "v1" || rep.Version == 0 {
+		t.Fatal(rep, err)
+	}
+	if _, err = tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatal(err)
+	}
+
+	// A majority is still there, with the coordinator of the conditional writes
+	down := 0
+	if tc.addrs[down] == tc.srv.targets("b")[0].addr {
+		down = 1
+	}
+	tc.servers[down].Stop()
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v3", Quorum: 3}); status.Code(err) != codes.Unavailable {
+		t.Fatal(err)
+	}
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v3", Quorum: 4}); status.Code(err) != codes.Unavailable {
+		t.Fatal(err)
+	}
+	if rep, err = tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k", Quorum: 2}); err != nil || rep.Value != "v3" {
+		t.Fatal(rep, err)
+	}
+
+	// Conditional writes
+	_, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "x", IfAbsent: true})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatal(err)
+	}
+	_, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v4", IfVersion: rep.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tc.srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "k", IfVersion: rep.Version})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatal(err)
+	}
+
+	// A write older than the latest version loses
+	_, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "stale", Version: rep.Version})
+	if status.Code(err) != codes.Aborted {
+		t.Fatal(err)
+	}
+
+	// A version far ahead of the clock is refused, lest no later write could
+	// replace it
+	_, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "x", Version: math.MaxUint64})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatal(err)
+	}
+	brep, err := tc.srv.BatchDelete(ctx, &proto.BatchDeleteRequest{Items: []*proto.DeleteRequest{
+		{Base: "b", Key: "k", Version: math.MaxUint64},
+	}})
+	if err != nil || codes.Code(brep.Items[0].Code) != codes.InvalidArgument {
+		t.Fatal(brep, err)
+	}
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v5"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateReadRepair(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{readRepair: repairInline})
+	defer tc.Close()
+
+	_, _ = tc.stores[0].Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "old", Version: 1})
+	_, _ = tc.stores[1].Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "new", Version: 2})
+	rep, err := tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"})
+	if err != nil || rep.Value != "new" || rep.Version != 2 {
+		t.Fatal(rep, err)
+	}
+	for i, st := range tc.stores {
+		if r, err := st.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); err != nil || r.Version != 2 {
+			t.Fatal(i, r, err)
+		}
+	}
+
+	// A deletion wins and is repaired as a deletion
+	_, _ = tc.stores[2].Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "k", Version: 3})
+	tc.srv.repairs = newRepairLimiter(time.Second)
+	if _, err = tc.srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Fatal(err)
+	}
+	for i, st := range tc.stores {
+		if r, err := st.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); err != nil || r.Version != 3 || !r.Deleted {
+			t.Fatal(i, r, err)
+		}
+	}
+}
+
+// A conditional write rejected by the latest version is written nowhere,
+// even on a lagging coordinator that would accept it
+func TestGateConditional(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{})
+	defer tc.Close()
+
+	coordinator := tc.srv.targets("b")[0].addr
+	for i, st := range tc.stores {
+		_, _ = st.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v1", Version: 10})
+		if tc.addrs[i] != coordinator {
+			_, _ = st.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v2", Version: 20})
+		}
+	}
+
+	_, err := tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "x", IfVersion: 10})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatal(err)
+	}
+	for i, st := range tc.stores {
+		if r, err := st.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); err != nil || r.Version > 20 {
+			t.Fatal(i, r, err)
+		}
+	}
+
+	// The coordinator is brought up to date, then accepts the write
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v3", IfVersion: 20}); err != nil {
+		t.Fatal(err)
+	}
+	for i, st := range tc.stores {
+		if r, err := st.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"}); err != nil || r.Value != "v3" {
+			t.Fatal(i, r, err)
+		}
+	}
+
+	// Likewise in a batch
+	rep, err := tc.srv.BatchPut(ctx, &proto.BatchPutRequest{Items: []*proto.PutRequest{
+		{Base: "b", Key: "k", Value: "x", IfVersion: 20},
+		{Base: "b", Key: "other", Value: "y"},
+	}})
+	if err != nil || codes.Code(rep.Items[0].Code) != codes.FailedPrecondition || codes.Code(rep.Items[1].Code) != codes.OK {
+		t.Fatal(rep, err)
+	}
+
+	// No other store replaces an unavailable coordinator
+	for i, addr := range tc.addrs {
+		if addr == coordinator {
+			tc.servers[i].Stop()
+		}
+	}
+	_, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "new", Value: "x", IfAbsent: true})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatal(err)
+	}
+	if _, err = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v4"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateBatch(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{replicas: 2})
+	defer tc.Close()
+
+	put := proto.BatchPutRequest{}
+	get := proto.BatchGetRequest{}
+	for _, b := range []string{"b0", "b1", "b2", "b3"} {
+		put.Items = append(put.Items, &proto.PutRequest{Base: b, Key: "k", Value: b})
+		get.Items = append(get.Items, &proto.GetRequest{Base: b, Key: "k"})
+	}
+	put.Items = append(put.Items, &proto.PutRequest{Base: "b0", Key: "k", Value: "x", IfAbsent: true})
+	get.Items = append(get.Items, &proto.GetRequest{Base: "b0", Key: "missing"})
+
+	rep, err := tc.srv.BatchPut(ctx, &put)
+	if err != nil || len(rep.Items) != len(put.Items) {
+		t.Fatal(rep, err)
+	}
+	for i, item := range rep.Items[:4] {
+		if codes.Code(item.Code) != codes.OK {
+			t.Fatal(i, item)
+		}
+	}
+	if codes.Code(rep.Items[4].Code) != codes.FailedPrecondition {
+		t.Fatal(rep.Items[4])
+	}
+
+	grep, err := tc.srv.BatchGet(ctx, &get)
+	if err != nil || len(grep.Items) != len(get.Items) {
+		t.Fatal(grep, err)
+	}
+	for i, item := range grep.Items[:4] {
+		if codes.Code(item.Status.Code) != codes.OK || item.Value != put.Items[i].Value {
+			t.Fatal(i, item)
+		}
+	}
+	if codes.Code(grep.Items[4].Status.Code) != codes.NotFound {
+		t.Fatal(grep.Items[4])
+	}
+
+	// Each base is on 2 stores only
+	total := 0
+	for _, st := range tc.stores {
+		total += len(st.kv)
+	}
+	if total != 8 {
+		t.Fatal(total)
+	}
+
+	// The deletions are kept by the stores, and read as missing
+	del := proto.BatchDeleteRequest{}
+	for _, item := range get.Items[:2] {
+		del.Items = append(del.Items, &proto.DeleteRequest{Base: item.Base, Key: item.Key})
+	}
+	drep, err := tc.srv.BatchDelete(ctx, &del)
+	if err != nil || len(drep.Items) != 2 || codes.Code(drep.Items[0].Code) != codes.OK || codes.Code(drep.Items[1].Code) != codes.OK {
+		t.Fatal(drep, err)
+	}
+	if grep, err = tc.srv.BatchGet(ctx, &get); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range grep.Items {
+		if deleted := i < 2 || i == 4; deleted != (codes.Code(item.Status.Code) == codes.NotFound) {
+			t.Fatal(i, item)
+		}
+	}
+	total = 0
+	for _, st := range tc.stores {
+		total += len(st.kv)
+	}
+	if total != 8 {
+		t.Fatal(total)
+	}
+}
+
+func TestGateScan(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3, serviceConfig{})
+	defer tc.Close()
+
+	// The stores diverge, the merge hides it
+	for i, k := range []string{"a", "a,1", "b/1", "b/2", "c"} {
+		st := tc.stores[i%len(tc.stores)]
+		_, _ = st.Put(ctx, &proto.PutRequest{Base: "b", Key: k, Version: 1})
+		_, _ = tc.stores[0].Put(ctx, &proto.PutRequest{Base: "b", Key: k, Version: 1})
+	}
+	cnx, err := grpc.Dial(tc.listen(t), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnx.Close()
+
+	scan := func(req proto.ScanRequest) []string {
+		stream, err := proto.NewIndexClient(cnx).Scan(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, 0)
+		for {
+			item, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			out = append(out, item.Key)
+		}
+		return out
+	}
+	if got := scan(proto.ScanRequest{Base: "b", Delimiter: "/"}); len(got) != 4 || got[1] != "a,1" || got[2] != "b/" {
+		t.Fatal(got)
+	}
+	if got := scan(proto.ScanRequest{Base: "b", Reverse: true, Limit: 2}); len(got) != 2 || got[0] != "c" || got[1] != "b/2" {
+		t.Fatal(got)
+	}
+}
+
+// Serve the gate itself, for the streaming RPC's
+func (tc *testCluster) listen(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	proto.RegisterIndexServer(server, tc.srv)
+	go server.Serve(lis)
+	tc.servers = append(tc.servers, server)
+	return lis.Addr().String()
+}
+
+func TestGateWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc := newTestCluster(t, 3, serviceConfig{})
+	defer tc.Close()
+	cnx, err := grpc.Dial(tc.listen(t), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnx.Close()
+
+	// Start watching before the changes
+	stream, err := proto.NewIndexClient(cnx).Watch(ctx, &proto.WatchRequest{Base: "b", Prefix: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, st := range tc.stores {
+		select {
+		case <-st.watching:
+		case <-time.After(5 * time.Second):
+			t.Fatal("store not watched", i)
+		}
+	}
+
+	// Each change is on the 3 replicas, and reported once
+	_, _ = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k0", Value: "v"})
+	_, _ = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "other", Value: "v"})
+	_, _ = tc.srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "k0"})
+	_, _ = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k1", Value: "v"})
+
+	var last *proto.Event
+	for _, expected := range []struct {
+		key     string
+		deleted bool
+	}{{"k0", false}, {"k0", true}, {"k1", false}} {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != expected.key || e.Deleted != expected.deleted || e.Version == 0 || e.Cursor == "" {
+			t.Fatal(e)
+		}
+		last = e
+	}
+
+	// Resume after the last event
+	_, _ = tc.srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k2", Value: "v"})
+	resumed, err := proto.NewIndexClient(cnx).Watch(ctx, &proto.WatchRequest{Base: "b", Prefix: "k", Cursor: last.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		e, err := resumed.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The replicas whose duplicates were not forwarded replay them
+		if e.Key == "k2" {
+			break
+		}
+		if e.Key != last.Key {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestGateHandoff(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 2, serviceConfig{replicas: 1})
+	defer tc.Close()
+
+	// All the bases move from the first store to the second one
+	tc.srv.ring = newHashRing(tc.addrs[:1], 16)
+	bases := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		b := fmt.Sprintf("base-%d", i)
+		bases = append(bases, b)
+		if _, err := tc.srv.Put(ctx, &proto.PutRequest{Base: b, Key: "k", Value: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.srv.rw.Lock()
+	tc.srv.setRing(newHashRing(tc.addrs[1:], 16))
+	tc.srv.rw.Unlock()
+
+	// The former owners are still read, the new owners written
+	check := func() {
+		get := proto.BatchGetRequest{}
+		for _, b := range bases {
+			rep, err := tc.srv.Get(ctx, &proto.GetRequest{Base: b, Key: "k"})
+			if err != nil || rep.Value != b {
+				t.Fatal(b, rep, err)
+			}
+			get.Items = append(get.Items, &proto.GetRequest{Base: b, Key: "k"})
+		}
+		rep, err := tc.srv.BatchGet(ctx, &get)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, item := range rep.Items {
+			if codes.Code(item.Status.Code) != codes.OK || item.Value != bases[i] {
+				t.Fatal(bases[i], item)
+			}
+		}
+	}
+	check()
+	if _, err := tc.srv.Put(ctx, &proto.PutRequest{Base: bases[0], Key: "new", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.stores[1].Get(ctx, &proto.GetRequest{Base: bases[0], Key: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handoff copies the bases, then the former ring is forgotten
+	if err := tc.srv.handoffPass(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(tc.srv.former) != 0 {
+		t.Fatal("Former ring kept")
+	}
+	for _, b := range bases {
+		if r, err := tc.stores[1].Get(ctx, &proto.GetRequest{Base: b, Key: "k"}); err != nil || r.Value != b {
+			t.Fatal(b, r, err)
+		}
+	}
+	check()
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_gate
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"strconv"
+)
+
+// The gate watches the stores holding the base and forwards each change once,
+// whatever the number of replicas reporting it. The sequences are specific
+// to each store, so the gate stamps each event with a cursor holding the
+// position reached in the log of each store. A change is delivered at least
+// once: the duplicates are dropped while the Watch runs, not across resumes.
+
+// Number of changes remembered to drop the ones reported by several replicas
+const watchDedupMax = 16384
+
+type watchCursor map[string]uint64
+
+func parseCursor(s string) (watchCursor, error) {
+	c := make(watchCursor)
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid cursor")
+	}
+	for addr, v := range q {
+		seq, err := strconv.ParseUint(v[0], 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid cursor")
+		}
+		c[addr] = seq
+	}
+	return c, nil
+}
+
+func (c watchCursor) encode() string {
+	q := url.Values{}
+	for addr, seq := range c {
+		q.Set(addr, strconv.FormatUint(seq, 10))
+	}
+	return q.Encode()
+}
+
+// watchDedup remembers the latest changes forwarded
+type watchDedup struct {
+	seen  map[gunkan.KeyVersion]bool
+	order []gunkan.KeyVersion
+}
+
+func newWatchDedup() *watchDedup {
+	return &watchDedup{seen: make(map[gunkan.KeyVersion]bool)}
+}
+
+// Tells if the change is new, and then remembers it
+func (d *watchDedup) add(e *proto.Event) bool {
+	k := gunkan.KeyVersion{Base: e.Base, Key: e.Key, Version: e.Version, Active: !e.Deleted}
+	if d.seen[k] {
+		return false
+	}
+	if len(d.order) >= watchDedupMax {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.seen[k] = true
+	d.order = append(d.order, k)
+	return true
+}
+
+type watchEvent struct {
+	addr  string
+	event *proto.Event
+	err   error
+}
+
+func (srv *service) Watch(req *proto.WatchRequest, stream proto.Index_WatchServer) error {
+	if req.Base == "" {
+		return status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+	cursor, err := parseCursor(req.Cursor)
+	if err != nil {
+		return err
+	}
+
+	srv.rw.RLock()
+	targets := srv.targets(req.Base)
+	srv.rw.RUnlock()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	events := make(chan watchEvent, len(targets))
+	running := 0
+	for _, t := range targets {
+		if t.cnx == nil {
+			continue
+		}
+		sub := proto.WatchRequest{Base: req.Base, Prefix: req.Prefix}
+		if seq, ok := cursor[t.addr]; ok {
+			sub.FromSequence = seq + 1
+		}
+		src, err := proto.NewIndexClient(t.cnx).Watch(ctx, &sub)
+		if err != nil {
+			gunkan.Logger.Info().Str("op", "WATCH").Str("srv", t.addr).Err(err).Msg("Watch")
+			continue
+		}
+		running++
+		go func(addr string, src proto.Index_WatchClient) {
+			for {
+				e, err := src.Recv()
+				select {
+				case events <- watchEvent{addr, e, err}:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(t.addr, src)
+	}
+
+	dedup := newWatchDedup()
+	for running > 0 {
+		var x watchEvent
+		select {
+		case x = <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if x.err != nil {
+			// The client must resync when a store lost the changes
+			if status.Code(x.err) == codes.OutOfRange {
+				return x.err
+			}
+			gunkan.Logger.Info().Str("op", "WATCH").Str("srv", x.addr).Err(x.err).Msg("Watch")
+			running--
+			continue
+		}
+		cursor[x.addr] = x.event.Sequence
+		if !dedup.add(x.event) {
+			continue
+		}
+		out := *x.event
+		out.Sequence = 0
+		out.Cursor = cursor.encode()
+		if err = stream.Send(&out); err != nil {
+			return err
+		}
+	}
+	if err = stream.Context().Err(); err != nil {
+		return err
+	}
+	return status.Errorf(codes.Unavailable, "No backend replied")
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"context"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func itemStatus(err error) *proto.ItemStatus {
+	st := status.Convert(err)
+	return &proto.ItemStatus{Code: int32(st.Code()), Message: st.Message()}
+}
+
+func batchReply(errs []error) *proto.BatchReply {
+	rep := proto.BatchReply{Items: make([]*proto.ItemStatus, 0, len(errs))}
+	for _, err := range errs {
+		rep.Items = append(rep.Items, itemStatus(err))
+	}
+	return &rep
+}
+
+func (srv *service) BatchPut(ctx context.Context, req *proto.BatchPutRequest) (*proto.BatchReply, error) {
+	ops := make([]writeOp, 0, len(req.Items))
+	for _, item := range req.Items {
+		cond := precondition{ifAbsent: item.IfAbsent, ifVersion: item.IfVersion}
+		ops = append(ops, writeOp{item.Base, item.Key, item.Version, true, []byte(item.Value), cond})
+	}
+	return batchReply(srv.apply(ops)), nil
+}
+
+func (srv *service) BatchDelete(ctx context.Context, req *proto.BatchDeleteRequest) (*proto.BatchReply, error) {
+	ops := make([]writeOp, 0, len(req.Items))
+	for _, item := range req.Items {
+		ops = append(ops, writeOp{item.Base, item.Key, item.Version, false, []byte{}, precondition{ifVersion: item.IfVersion}})
+	}
+	return batchReply(srv.apply(ops)), nil
+}
+
+func (srv *service) BatchGet(ctx context.Context, req *proto.BatchGetRequest) (*proto.BatchGetReply, error) {
+	rep := proto.BatchGetReply{Items: make([]*proto.GetItem, 0, len(req.Items))}
+	for _, item := range req.Items {
+		got, value, found := srv.latest(item.Base, item.Key)
+		if !found {
+			rep.Items = append(rep.Items, &proto.GetItem{Status: itemStatus(status.Error(codes.NotFound, "Not found"))})
+		} else {
+			rep.Items = append(rep.Items, &proto.GetItem{Status: itemStatus(nil), Version: got.Version, Value: string(value), Deleted: !got.Active})
+		}
+	}
+	return &rep, nil
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/tecbot/gorocksdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+)
+
+// Each write appends an entry to the change log of the store, in the same
+// RocksDB batch, under a sequence number. The log lives under a prefix that
+// sorts before any base, and only its changelogSize latest entries are kept.
+
+const changelogPrefix = "\x00changes,"
+
+type changelogEntry struct {
+	Base    string `json:"b"`
+	Key     string `json:"k"`
+	Version uint64 `json:"v"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+func changelogKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016X", changelogPrefix, seq))
+}
+
+func isChangelogKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(changelogPrefix))
+}
+
+// Returns the sequences of the first and the last entries of the log
+func (srv *service) changelogBounds() (first, last uint64) {
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	iterator.Seek([]byte(changelogPrefix))
+	if !iterator.Valid() || !isChangelogKey(iterator.Key().Data()) {
+		return 0, 0
+	}
+	first, _ = strconv.ParseUint(string(iterator.Key().Data()[len(changelogPrefix):]), 16, 64)
+	iterator.SeekForPrev(changelogKey(^uint64(0)))
+	if iterator.Valid() && isChangelogKey(iterator.Key().Data()) {
+		last, _ = strconv.ParseUint(string(iterator.Key().Data()[len(changelogPrefix):]), 16, 64)
+	}
+	return first, last
+}
+
+// The sequences of the first and the last entries of the log
+type logBounds struct {
+	first, last uint64
+}
+
+// Append the change to the batch and returns the bounds of the log once the
+// batch is written. The entries beyond the changelogSize latest ones are
+// removed from the first one, with a range when there are several, e.g.
+// after a restart with a smaller size. The caller holds srv.rw.
+func (srv *service) logChange(batch *gorocksdb.WriteBatch, log logBounds, k gunkan.KeyVersion) logBounds {
+	log.last++
+	entry, _ := json.Marshal(changelogEntry{k.Base, k.Key, k.Version, !k.Active})
+	batch.Put(changelogKey(log.last), entry)
+	if log.first == 0 {
+		log.first = log.last
+	}
+	if size := srv.cfg.changelogSize; size > 0 && log.last-log.first >= size {
+		end := log.last - size + 1
+		if end-log.first == 1 {
+			batch.Delete(changelogKey(log.first))
+		} else {
+			batch.DeleteRange(changelogKey(log.first), changelogKey(end))
+		}
+		log.first = end
+	}
+	return log
+}
+
+// Wake up the watchers once the batch is written. The caller holds srv.rw.
+func (srv *service) notifyChanges() {
+	close(srv.changed)
+	srv.changed = make(chan struct{})
+}
+
+func (srv *service) Watch(req *proto.WatchRequest, stream proto.Index_WatchServer) error {
+	if req.Base == "" {
+		return status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+
+	srv.rw.Lock()
+	next := req.FromSequence
+	if next == 0 {
+		next = srv.log.last + 1
+	}
+	changed := srv.changed
+	srv.rw.Unlock()
+
+	if first, _ := srv.changelogBounds(); first > 0 && next < first {
+		return status.Errorf(codes.OutOfRange, "Sequence %d truncated, the log starts at %d", next, first)
+	}
+
+	for {
+		var err error
+		next, err = srv.sendChanges(req, stream, next)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+		srv.rw.Lock()
+		changed = srv.changed
+		srv.rw.Unlock()
+	}
+}
+
+// Send the changes of the log from the sequence next, and returns the
+// sequence of the first change not sent yet
+func (srv *service) sendChanges(req *proto.WatchRequest, stream proto.Index_WatchServer, next uint64) (uint64, error) {
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	opts.SetFillCache(false)
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	for iterator.Seek(changelogKey(next)); iterator.Valid(); iterator.Next() {
+		sk := iterator.Key().Data()
+		if !isChangelogKey(sk) {
+			break
+		}
+		seq, err := strconv.ParseUint(string(sk[len(changelogPrefix):]), 16, 64)
+		if err != nil {
+			return next, status.Errorf(codes.DataLoss, "Malformed change log entry")
+		}
+		next = seq + 1
+
+		var entry changelogEntry
+		if err = json.Unmarshal(iterator.Value().Data(), &entry); err != nil {
+			return next, status.Errorf(codes.DataLoss, "Malformed change log entry")
+		}
+		if entry.Base != req.Base || !bytes.HasPrefix([]byte(entry.Key), []byte(req.Prefix)) {
+			continue
+		}
+		err = stream.Send(&proto.Event{
+			Sequence: seq, Base: entry.Base, Key: entry.Key,
+			Version: entry.Version, Deleted: entry.Deleted,
+		})
+		if err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
@@ -14,10 +14,12 @@ import (
 	"github.com/spf13/cobra"
 	"net"
 	"net/http"
+	"time"
 )
 
 func MainCommand() *cobra.Command {
 	var cfg serviceConfig
+	var shutdown helpers_grpc.Shutdown
 
 	cmd := &cobra.Command{
 		Use:     "srv",
@@ -55,6 +57,7 @@ func MainCommand() *cobra.Command {
 				return err
 			}
 			gunkan_index_proto.RegisterIndexServer(httpServer, service)
+			helpers_grpc.RegisterHealth(httpServer, shutdown)
 			grpc_prometheus.Register(httpServer)
 			http.Handle("/metrics", promhttp.Handler())
 			http.HandleFunc("/info", func(rep http.ResponseWriter, req *http.Request) {
@@ -67,8 +70,16 @@ func MainCommand() *cobra.Command {
 	const (
 		publicUsage = "Public address of the service."
 		tlsUsage    = "Path to a directory with the TLS configuration"
+		logUsage    = "Number of changes kept for the watchers, 0 for no limit"
+		drainUsage  = "Delay the store reports NOT_SERVING before it stops"
+		stopUsage   = "Delay the calls in flight have to finish when the store stops"
+		graceUsage  = "Age of the deletions purged, above the delays of the anti-entropy and of the read repairs, 0 to keep them"
 	)
 	cmd.Flags().StringVar(&cfg.dirConfig, "tls", "", tlsUsage)
 	cmd.Flags().StringVar(&cfg.addrAnnounce, "pub", "", publicUsage)
+	cmd.Flags().Uint64Var(&cfg.changelogSize, "changelog", 1000000, logUsage)
+	cmd.Flags().DurationVar(&cfg.tombstoneGrace, "tombstone-grace", 24*time.Hour, graceUsage)
+	cmd.Flags().DurationVar(&shutdown.Drain, "drain", 5*time.Second, drainUsage)
+	cmd.Flags().DurationVar(&shutdown.Timeout, "stop-timeout", 30*time.Second, stopUsage)
 	return cmd
 }
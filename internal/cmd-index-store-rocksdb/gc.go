@@ -0,0 +1,99 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"github.com/tecbot/gorocksdb"
+	"time"
+)
+
+// A deletion is kept as an inactive version so that it wins over the older
+// writes still in flight, the read repairs and the copies of the anti-entropy
+// and of the handoffs. Past tombstoneGrace, longer than the delays of these
+// writes, it is purged by a periodic sweep. The digests and the fetches
+// already ignore the deletions due for the purge, so that the anti-entropy
+// does not copy them back to the replicas that purged them first.
+
+const (
+	tombstoneSweepPeriod = time.Hour
+	tombstoneSweepBatch  = 1024
+)
+
+// Tells if the entry is a deletion older than the grace period
+func (srv *service) purgeable(k gunkan.KeyVersion, now time.Time) bool {
+	return !k.Active && srv.cfg.tombstoneGrace > 0 &&
+		gunkan.HLCTime(k.Version).Before(now.Add(-srv.cfg.tombstoneGrace))
+}
+
+func (srv *service) runTombstoneSweep() {
+	for {
+		<-time.After(tombstoneSweepPeriod)
+		purged, err := srv.purgeTombstones(time.Now())
+		if err != nil {
+			gunkan.Logger.Warn().Err(err).Msg("Tombstones purge")
+		} else if purged > 0 {
+			gunkan.Logger.Info().Int("purged", purged).Msg("Tombstones purge")
+		}
+	}
+}
+
+// Remove the deletions older than the grace period, and returns how many
+func (srv *service) purgeTombstones(now time.Time) (int, error) {
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	opts.SetFillCache(false)
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	purged := 0
+	candidates := make([]gunkan.KeyVersion, 0, tombstoneSweepBatch)
+	flush := func() error {
+		n, err := srv.dropTombstones(candidates)
+		purged += n
+		candidates = candidates[:0]
+		return err
+	}
+	for iterator.Seek([]byte{internalPrefix[0] + 1}); iterator.Valid(); iterator.Next() {
+		var k gunkan.KeyVersion
+		if k.DecodeString(string(iterator.Key().Data())) != nil || !srv.purgeable(k, now) {
+			continue
+		}
+		candidates = append(candidates, k)
+		if len(candidates) >= tombstoneSweepBatch {
+			if err := flush(); err != nil {
+				return purged, err
+			}
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return purged, err
+	}
+	return purged, flush()
+}
+
+// Delete the deletions still the latest version of their key
+func (srv *service) dropTombstones(keys []gunkan.KeyVersion) (int, error) {
+	srv.rw.Lock()
+	defer srv.rw.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, k := range keys {
+		if latest, _, found := srv.latest(k.Base, k.Key); found && latest == k {
+			batch.Delete([]byte(k.Encode()))
+		}
+	}
+	if batch.Count() == 0 {
+		return 0, nil
+	}
+	opts := gorocksdb.NewDefaultWriteOptions()
+	defer opts.Destroy()
+	if err := srv.db.Write(opts, batch); err != nil {
+		return 0, err
+	}
+	return batch.Count(), nil
+}
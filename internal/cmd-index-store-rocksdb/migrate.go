@@ -0,0 +1,137 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"errors"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	"github.com/tecbot/gorocksdb"
+	"strconv"
+	"strings"
+)
+
+// The entries written by the former releases are converted once, when the
+// store opens, then the format of the store is recorded under formatKey:
+//  - "base,key" without version, the deletions being empty values;
+//  - "base,key,VERSION,FLAG", that mixes the versions of a key with the
+//    longer keys it prefixes.
+// The unversioned entries get the version legacyVersion, older than any write.
+
+const (
+	formatKey     = internalPrefix + "format"
+	formatCurrent = "2"
+	legacyVersion = 1
+	migrateBatch  = 1024
+)
+
+// Decode an entry in one of the former formats
+func decodeLegacy(sk []byte, value []byte) (gunkan.KeyVersion, error) {
+	var k gunkan.KeyVersion
+	s := string(sk)
+	first := strings.IndexByte(s, ',')
+	if first < 0 {
+		return k, errors.New("Invalid legacy key")
+	}
+	k.Base = s[:first]
+	last := strings.LastIndexByte(s, ',')
+	if last-first >= 18 && s[last-17] == ',' && (s[last+1:] == "a" || s[last+1:] == "d") {
+		if v, err := strconv.ParseUint(s[last-16:last], 16, 64); err == nil {
+			k.Key = s[first+1 : last-17]
+			k.Version = ^v
+			k.Active = s[last+1:] == "a"
+			return k, nil
+		}
+	}
+	k.Key = s[first+1:]
+	k.Version = legacyVersion
+	k.Active = len(value) > 0
+	return k, nil
+}
+
+func (srv *service) migrate() error {
+	ropts := gorocksdb.NewDefaultReadOptions()
+	defer ropts.Destroy()
+	ropts.SetFillCache(false)
+	wopts := gorocksdb.NewDefaultWriteOptions()
+	defer wopts.Destroy()
+
+	format, err := srv.db.Get(ropts, []byte(formatKey))
+	if err != nil {
+		return err
+	}
+	current := string(format.Data()) == formatCurrent
+	format.Free()
+	if current {
+		return nil
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	flush := func(force bool) error {
+		if batch.Count() == 0 || (!force && batch.Count() < migrateBatch) {
+			return nil
+		}
+		err := srv.db.Write(wopts, batch)
+		batch.Clear()
+		return err
+	}
+
+	// Rewrite the entries in the current format
+	iterator := srv.db.NewIterator(ropts)
+	for iterator.Seek([]byte{internalPrefix[0] + 1}); iterator.Valid(); iterator.Next() {
+		sk := iterator.Key().Data()
+		var k gunkan.KeyVersion
+		if k.DecodeString(string(sk)) == nil {
+			continue
+		}
+		k, err = decodeLegacy(sk, iterator.Value().Data())
+		if err != nil {
+			gunkan.Logger.Warn().Str("key", strconv.Quote(string(sk))).Msg("Malformed DB entry dropped")
+		} else {
+			batch.Put([]byte(k.Encode()), iterator.Value().Data())
+		}
+		batch.Delete(sk)
+		if err = flush(false); err != nil {
+			break
+		}
+	}
+	iterator.Close()
+	if err == nil {
+		err = flush(true)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep only the latest version of each key, now sorted first
+	var prev gunkan.KeyVersion
+	iterator = srv.db.NewIterator(ropts)
+	for iterator.Seek([]byte{internalPrefix[0] + 1}); iterator.Valid(); iterator.Next() {
+		var k gunkan.KeyVersion
+		if err = k.DecodeString(string(iterator.Key().Data())); err != nil {
+			break
+		}
+		if k.Base == prev.Base && k.Key == prev.Key {
+			batch.Delete(iterator.Key().Data())
+			if err = flush(false); err != nil {
+				break
+			}
+		} else {
+			prev = k
+		}
+	}
+	iterator.Close()
+	if err != nil {
+		return err
+	}
+
+	batch.Put([]byte(formatKey), []byte(formatCurrent))
+	if err = flush(true); err != nil {
+		return err
+	}
+	gunkan.Logger.Info().Str("format", formatCurrent).Msg("DB migrated")
+	return nil
+}
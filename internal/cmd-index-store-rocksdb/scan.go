@@ -0,0 +1,75 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"bytes"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/tecbot/gorocksdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stream the live keys of the base straight from the iterator, the encoded
+// entries being sorted like their keys. The deleted keys are skipped.
+func (srv *service) Scan(req *proto.ScanRequest, stream proto.Index_ScanServer) error {
+	if req.Base == "" {
+		return status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+	opts := gunkan.IndexScanOptions{
+		Start: req.Start, End: req.End,
+		Prefix: req.Prefix, Delimiter: req.Delimiter,
+		Reverse: req.Reverse, Limit: req.Limit,
+	}
+
+	ropts := gorocksdb.NewDefaultReadOptions()
+	defer ropts.Destroy()
+	ropts.SetFillCache(false)
+	iterator := srv.db.NewIterator(ropts)
+	defer iterator.Close()
+
+	prefix := []byte(gunkan.KeyVersionStart(req.Base, ""))
+	advance := iterator.Next
+	if !opts.Reverse {
+		iterator.Seek([]byte(gunkan.KeyVersionStart(req.Base, opts.Lower())))
+	} else {
+		advance = iterator.Prev
+		if upper := opts.Upper(); upper != "" {
+			iterator.SeekForPrev([]byte(gunkan.KeyVersionStart(req.Base, upper)))
+		} else {
+			iterator.SeekForPrev([]byte(req.Base + "-"))
+		}
+	}
+
+	scanner := gunkan.NewIndexScanner(opts)
+	for ; iterator.Valid(); advance() {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		sk := iterator.Key().Data()
+		if !bytes.HasPrefix(sk, prefix) {
+			break
+		}
+		var k gunkan.KeyVersion
+		if err := k.DecodeString(string(sk)); err != nil {
+			return status.Errorf(codes.DataLoss, "Malformed DB entry")
+		}
+		if !k.Active {
+			continue
+		}
+		item, emit, done := scanner.Feed(k.Key)
+		if done {
+			break
+		}
+		if emit {
+			if err := stream.Send(&proto.ScanItem{Key: item.Key, Prefix: item.Prefix}); err != nil {
+				return err
+			}
+		}
+	}
+	return iterator.Err()
+}
@@ -8,12 +8,12 @@ package cmd_index_store_rocksdb
 import (
 	"bytes"
 	"context"
-	"errors"
 	"github.com/jfsmig/object-storage/pkg/gunkan"
 	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
 	"github.com/tecbot/gorocksdb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"sync"
 	"time"
 )
 
@@ -26,11 +26,38 @@ type serviceConfig struct {
 
 	delayIoError   time.Duration
 	delayFullError time.Duration
+
+	// Number of entries kept in the change log, 0 for no limit
+	changelogSize uint64
+
+	// Age of the deletions purged, 0 to keep them, see purgeTombstones()
+	tombstoneGrace time.Duration
 }
 
 type service struct {
 	cfg serviceConfig
 	db  *gorocksdb.DB
+
+	// Serializes the writes, each one replacing the latest version of a key
+	rw sync.Mutex
+	// Stamps the writes that come without a version
+	clock gunkan.HLC
+	// The bounds of the change log, and the channel closed at each change
+	log     logBounds
+	changed chan struct{}
+}
+
+// Each key is stored with its version, as a gunkan.KeyVersion. Only the latest
+// version of a key is kept, a deletion being kept as an inactive version with
+// an empty value so that it wins over the older writes still in flight, until
+// it is purged, see purgeTombstones().
+// The versions are stamped by the gates, with a gunkan.HLC.
+// The internal keys of the store start with a NUL byte, before any base.
+
+const internalPrefix = "\x00"
+
+func isInternalKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(internalPrefix))
 }
 
 func NewService(cfg serviceConfig) (*service, error) {
@@ -40,21 +67,132 @@ func NewService(cfg serviceConfig) (*service, error) {
 	if err != nil {
 		return nil, err
 	}
-	srv := service{cfg: cfg, db: db}
+	srv := service{cfg: cfg, db: db, changed: make(chan struct{})}
+	if err = srv.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	srv.log.first, srv.log.last = srv.changelogBounds()
+	if cfg.tombstoneGrace > 0 {
+		go srv.runTombstoneSweep()
+	}
 	return &srv, nil
 }
 
-func (srv *service) Put(ctx context.Context, req *proto.PutRequest) (*proto.None, error) {
-	key := gunkan.BK(req.Base, req.Key)
+// Returns the latest version of the key and its value
+func (srv *service) latest(base, key string) (gunkan.KeyVersion, []byte, bool) {
+	var got gunkan.KeyVersion
+
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	opts.SetFillCache(true)
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	prefix := []byte(gunkan.KeyVersionPrefix(base, key))
+	iterator.Seek(prefix)
+	if !iterator.Valid() || !bytes.HasPrefix(iterator.Key().Data(), prefix) {
+		return got, nil, false
+	}
+	if err := got.DecodeString(string(iterator.Key().Data())); err != nil {
+		return got, nil, false
+	}
+	value := append([]byte{}, iterator.Value().Data()...)
+	return got, value, true
+}
 
-	encoded := []byte(key.Encode())
+// The conditions of a write on the latest version of the key
+type precondition struct {
+	ifAbsent  bool
+	ifVersion uint64
+}
 
-	// FIXME(jfs): check if the KV is present
+func (c precondition) check(prev gunkan.KeyVersion, found bool) error {
+	live := found && prev.Active
+	if c.ifAbsent && live {
+		return status.Error(codes.FailedPrecondition, "Key present")
+	}
+	if c.ifVersion != 0 && (!live || prev.Version != c.ifVersion) {
+		return status.Error(codes.FailedPrecondition, "Version mismatch")
+	}
+	return nil
+}
+
+// One write of a key, alone or in a batch
+type writeOp struct {
+	base    string
+	key     string
+	version uint64
+	active  bool
+	value   []byte
+	cond    precondition
+}
+
+// Replace the latest version of the key, unless it is newer: the write then
+// fails with codes.Aborted
+func (srv *service) write(base, key string, version uint64, active bool, value []byte, cond precondition) error {
+	return srv.apply([]writeOp{{base, key, version, active, value, cond}})[0]
+}
+
+// Apply the writes as a single RocksDB batch. Each write is checked against
+// the latest version of its key, including the writes before it in the batch.
+func (srv *service) apply(ops []writeOp) []error {
+	errs := make([]error, len(ops))
+
+	srv.rw.Lock()
+	defer srv.rw.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	pending := make(map[gunkan.BaseKey]gunkan.KeyVersion)
+	log := srv.log
+	for i, op := range ops {
+		if op.version == 0 {
+			op.version = srv.clock.Now()
+		} else {
+			srv.clock.Observe(op.version)
+		}
+		bk := gunkan.BK(op.base, op.key)
+		prev, found := pending[bk]
+		if !found {
+			prev, _, found = srv.latest(op.base, op.key)
+		}
+		if errs[i] = op.cond.check(prev, found); errs[i] != nil {
+			continue
+		}
+		if found {
+			if prev.Version > op.version {
+				errs[i] = status.Error(codes.Aborted, "Newer version present")
+				continue
+			}
+			batch.Delete([]byte(prev.Encode()))
+		}
+		next := gunkan.KeyVersion{Base: op.base, Key: op.key, Version: op.version, Active: op.active}
+		batch.Put([]byte(next.Encode()), op.value)
+		log = srv.logChange(batch, log, next)
+		pending[bk] = next
+	}
 
 	opts := gorocksdb.NewDefaultWriteOptions()
 	defer opts.Destroy()
 	opts.SetSync(false)
-	err := srv.db.Put(opts, encoded, []byte(req.Value))
+	if err := srv.db.Write(opts, batch); err != nil {
+		// The sequences of the batch are reused by the next write
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	srv.log = log
+	srv.notifyChanges()
+	return errs
+}
+
+func (srv *service) Put(ctx context.Context, req *proto.PutRequest) (*proto.None, error) {
+	cond := precondition{ifAbsent: req.IfAbsent, ifVersion: req.IfVersion}
+	err := srv.write(req.Base, req.Key, req.Version, true, []byte(req.Value), cond)
 	if err != nil {
 		return nil, err
 	} else {
@@ -63,15 +201,7 @@ func (srv *service) Put(ctx context.Context, req *proto.PutRequest) (*proto.None
 }
 
 func (srv *service) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.None, error) {
-	key := gunkan.BK(req.Base, req.Key)
-	encoded := []byte(key.Encode())
-
-	// FIXME(jfs): check if the KV is present
-
-	opts := gorocksdb.NewDefaultWriteOptions()
-	opts.SetSync(false)
-	defer opts.Destroy()
-	err := srv.db.Put(opts, encoded, []byte{})
+	err := srv.write(req.Base, req.Key, req.Version, false, []byte{}, precondition{ifVersion: req.IfVersion})
 	if err != nil {
 		return nil, err
 	} else {
@@ -79,31 +209,13 @@ func (srv *service) Delete(ctx context.Context, req *proto.DeleteRequest) (*prot
 	}
 }
 
+// A deleted key is returned with its version, flagged as deleted
 func (srv *service) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetReply, error) {
-	needle := gunkan.BK(req.Base, req.Key)
-	encoded := []byte(needle.Encode())
-
-	opts := gorocksdb.NewDefaultReadOptions()
-	defer opts.Destroy()
-	opts.SetFillCache(true)
-	iterator := srv.db.NewIterator(opts)
-	iterator.Seek(encoded)
-	if !iterator.Valid() {
-		return nil, errors.New("Not found")
-	}
-
-	var got gunkan.BaseKey
-	sk := iterator.Key()
-	if err := got.DecodeBytes(sk.Data()); err != nil {
-		return nil, err
+	got, value, found := srv.latest(req.Base, req.Key)
+	if !found {
+		return nil, status.Error(codes.NotFound, "Not found")
 	}
-
-	// Latest item wanted
-	if got.Base != needle.Base || got.Key != needle.Key {
-		return nil, errors.New("Not found")
-	}
-
-	return &proto.GetReply{Value: string(iterator.Value().Data())}, nil
+	return &proto.GetReply{Value: string(value), Version: got.Version, Deleted: !got.Active}, nil
 }
 
 func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.ListReply, error) {
@@ -117,29 +229,21 @@ func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.Li
 		return nil, status.Errorf(codes.InvalidArgument, "Missing base")
 	}
 
-	var needle []byte
-	if len(req.Base) > 0 {
-		if len(req.Marker) > 0 {
-			needle = []byte(gunkan.BK(req.Base, req.Marker).Encode())
-		} else {
-			needle = []byte(req.Base + ",")
-		}
+	prefix := []byte(gunkan.KeyVersionStart(req.Base, ""))
+	needle := prefix
+	if len(req.Marker) > 0 {
+		needle = []byte(gunkan.KeyVersionPrefix(req.Base, req.Marker))
 	}
 
 	opts := gorocksdb.NewDefaultReadOptions()
 	defer opts.Destroy()
 	opts.SetFillCache(true)
 	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
 
 	rep := proto.ListReply{}
 
-	iterator.Seek(needle)
-	for ; iterator.Valid(); iterator.Next() {
-		if bytes.Compare(iterator.Key().Data(), needle) > 0 {
-			break
-		}
-	}
-	for ; iterator.Valid(); iterator.Next() {
+	for iterator.Seek(needle); iterator.Valid(); iterator.Next() {
 		// Check we didn't reach the max elements
 		if uint32(len(rep.Items)) > req.Max {
 			break
@@ -147,13 +251,21 @@ func (srv *service) List(ctx context.Context, req *proto.ListRequest) (*proto.Li
 
 		// Check the base matches
 		sk := iterator.Key()
-		var k gunkan.BaseKey
-		err := k.DecodeBytes(sk.Data())
+		if !bytes.HasPrefix(sk.Data(), prefix) {
+			break
+		}
+		var k gunkan.KeyVersion
+		err := k.DecodeString(string(sk.Data()))
 		if err != nil {
 			return nil, status.Errorf(codes.DataLoss, "Malformed DB entry")
 		}
-		if k.Base != req.Base {
-			break
+		// The entries come in the order of the keys: the marker is excluded,
+		// each key has a single version and the deleted keys are skipped
+		if k.Key <= req.Marker || !k.Active {
+			continue
+		}
+		if n := len(rep.Items); n > 0 && rep.Items[n-1] == k.Key {
+			continue
 		}
 
 		rep.Items = append(rep.Items, k.Key)
@@ -0,0 +1,363 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/tecbot/gorocksdb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) (*service, func()) {
+	dir, err := ioutil.TempDir("", "gunkan-index-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewService(serviceConfig{dirBase: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, func() {
+		srv.db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// A key followed by ',' sorts like the versions of the key in the former
+// encoding, e.g. the multipart uploads and their parts
+func TestServicePrefixedKeys(t *testing.T) {
+	ctx := context.Background()
+	srv, done := newTestService(t)
+	defer done()
+
+	put := func(key, value string, version uint64) {
+		_, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: key, Value: value, Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("up", "0", 10)
+	put("up,00001", "1", 20)
+	put("up", "2", 30)
+	put("up0", "3", 40)
+
+	rep, err := srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "up"})
+	if err != nil || rep.Value != "2" || rep.Version != 30 || rep.Deleted {
+		t.Fatal(rep, err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "up,00001"}); err != nil || rep.Value != "1" {
+		t.Fatal(rep, err)
+	}
+	if _, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "u"}); status.Code(err) != codes.NotFound {
+		t.Fatal(err)
+	}
+
+	// A single version is kept per key
+	count := 0
+	_ = srv.scan("b", func(k gunkan.KeyVersion, _ []byte) error { count++; return nil })
+	if count != 3 {
+		t.Fatal(count)
+	}
+
+	// The keys are listed in their order, after the marker
+	list, err := srv.List(ctx, &proto.ListRequest{Base: "b", Max: 10})
+	if err != nil || !reflect.DeepEqual(list.Items, []string{"up", "up,00001", "up0"}) {
+		t.Fatal(list, err)
+	}
+	list, err = srv.List(ctx, &proto.ListRequest{Base: "b", Marker: "up", Max: 10})
+	if err != nil || !reflect.DeepEqual(list.Items, []string{"up,00001", "up0"}) {
+		t.Fatal(list, err)
+	}
+
+	// A deletion is reported with its version, and hidden from the listings
+	if _, err = srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "up", Version: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "up"}); err != nil || !rep.Deleted || rep.Version != 50 {
+		t.Fatal(rep, err)
+	}
+	list, err = srv.List(ctx, &proto.ListRequest{Base: "b", Max: 10})
+	if err != nil || !reflect.DeepEqual(list.Items, []string{"up,00001", "up0"}) {
+		t.Fatal(list, err)
+	}
+}
+
+func TestServiceStaleWrite(t *testing.T) {
+	ctx := context.Background()
+	srv, done := newTestService(t)
+	defer done()
+
+	if _, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "new", Version: 20}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "old", Version: 10})
+	if status.Code(err) != codes.Aborted {
+		t.Fatal(err)
+	}
+	_, err = srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "k", Version: 10})
+	if status.Code(err) != codes.Aborted {
+		t.Fatal(err)
+	}
+	rep, err := srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k"})
+	if err != nil || rep.Value != "new" || rep.Version != 20 {
+		t.Fatal(rep, err)
+	}
+
+	// The versions stamped by the store stay above the former timestamps
+	legacy := uint64(time.Now().UnixNano())
+	if _, err = srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "t", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "t"}); err != nil || rep.Version <= legacy {
+		t.Fatal(rep, err)
+	}
+}
+
+func TestServiceMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "gunkan-index-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Entries of the baseline, then of the first versioned format
+	db, err := gorocksdb.OpenDb(gorocksdb.NewDefaultOptions(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := gorocksdb.NewDefaultWriteOptions()
+	for k, v := range map[string]string{
+		"b,plain":                       "p",
+		"b,gone":                        "",
+		"b,up":                          "old",
+		"b,up,FFFFFFFFFFFFFFF0,a":       "new",
+		"b,up,00001,FFFFFFFFFFFFFFF1,a": "part",
+	} {
+		if err = db.Put(opts, []byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	srv, err := NewService(serviceConfig{dirBase: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.db.Close()
+
+	rep, err := srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "up"})
+	if err != nil || rep.Value != "new" || rep.Version != 15 {
+		t.Fatal(rep, err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "up,00001"}); err != nil || rep.Value != "part" || rep.Version != 14 {
+		t.Fatal(rep, err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "plain"}); err != nil || rep.Value != "p" || rep.Version != legacyVersion {
+		t.Fatal(rep, err)
+	}
+	if rep, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "gone"}); err != nil || !rep.Deleted {
+		t.Fatal(rep, err)
+	}
+	list, err := srv.List(ctx, &proto.ListRequest{Base: "b", Max: 10})
+	if err != nil || !reflect.DeepEqual(list.Items, []string{"plain", "up", "up,00001"}) {
+		t.Fatal(list, err)
+	}
+}
+
+type scanStream struct {
+	grpc.ServerStream
+	items []string
+}
+
+func (s *scanStream) Context() context.Context { return context.Background() }
+
+func (s *scanStream) Send(item *proto.ScanItem) error {
+	if item.Prefix {
+		s.items = append(s.items, item.Key+"*")
+	} else {
+		s.items = append(s.items, item.Key)
+	}
+	return nil
+}
+
+func TestServiceScan(t *testing.T) {
+	ctx := context.Background()
+	srv, done := newTestService(t)
+	defer done()
+
+	for i, k := range []string{"a", "a,00001", "a,00002", "a0", "b"} {
+		_, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: k, Value: "v", Version: uint64(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "a", Value: "v", Version: 10})
+	_, _ = srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: "a,00002", Version: 10})
+
+	for _, tc := range []struct {
+		req  proto.ScanRequest
+		want []string
+	}{
+		{proto.ScanRequest{}, []string{"a", "a,00001", "a0", "b"}},
+		{proto.ScanRequest{Reverse: true}, []string{"b", "a0", "a,00001", "a"}},
+		{proto.ScanRequest{Prefix: "a"}, []string{"a", "a,00001", "a0"}},
+		{proto.ScanRequest{Prefix: "a", Reverse: true}, []string{"a0", "a,00001", "a"}},
+		{proto.ScanRequest{Prefix: "a,"}, []string{"a,00001"}},
+		{proto.ScanRequest{Prefix: "a", Delimiter: ","}, []string{"a", "a,*", "a0"}},
+		{proto.ScanRequest{Start: "a,", End: "a0"}, []string{"a,00001"}},
+		{proto.ScanRequest{End: "a,", Reverse: true}, []string{"a"}},
+	} {
+		tc.req.Base = "b"
+		stream := scanStream{}
+		if err := srv.Scan(&tc.req, &stream); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stream.items, tc.want) {
+			t.Fatal(tc.req, stream.items)
+		}
+	}
+}
+
+// A batch is checked item after item, each one seeing the items before it
+func TestServiceBatch(t *testing.T) {
+	ctx := context.Background()
+	srv, done := newTestService(t)
+	defer done()
+
+	put, err := srv.BatchPut(ctx, &proto.BatchPutRequest{Items: []*proto.PutRequest{
+		{Base: "b", Key: "k", Value: "1", Version: 10},
+		{Base: "b", Key: "k", Value: "2", IfAbsent: true, Version: 11},
+		{Base: "b", Key: "k,1", Value: "3", Version: 12},
+		{Base: "b", Key: "k", Value: "4", IfVersion: 10, Version: 13},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []codes.Code{codes.OK, codes.FailedPrecondition, codes.OK, codes.OK} {
+		if codes.Code(put.Items[i].Code) != want {
+			t.Fatal(i, put.Items[i])
+		}
+	}
+
+	del, err := srv.BatchDelete(ctx, &proto.BatchDeleteRequest{Items: []*proto.DeleteRequest{
+		{Base: "b", Key: "k,1", Version: 20},
+		{Base: "b", Key: "k", IfVersion: 10, Version: 21},
+	}})
+	if err != nil || codes.Code(del.Items[0].Code) != codes.OK || codes.Code(del.Items[1].Code) != codes.FailedPrecondition {
+		t.Fatal(del, err)
+	}
+
+	get, err := srv.BatchGet(ctx, &proto.BatchGetRequest{Items: []*proto.GetRequest{
+		{Base: "b", Key: "k"}, {Base: "b", Key: "k,1"}, {Base: "b", Key: "k,2"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := get.Items[0]; codes.Code(item.Status.Code) != codes.OK || item.Value != "4" || item.Version != 13 || item.Deleted {
+		t.Fatal(item)
+	}
+	if item := get.Items[1]; codes.Code(item.Status.Code) != codes.OK || !item.Deleted || item.Version != 20 {
+		t.Fatal(item)
+	}
+	if item := get.Items[2]; codes.Code(item.Status.Code) != codes.NotFound {
+		t.Fatal(item)
+	}
+}
+
+// The change log keeps its latest entries, even when restarted smaller
+func TestServiceChangelogTrim(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "gunkan-index-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(srv *service, n int) {
+		for i := 0; i < n; i++ {
+			if _, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "k", Value: "v"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	srv, err := NewService(serviceConfig{dirBase: dir, changelogSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(srv, 8)
+	if first, last := srv.changelogBounds(); first != 4 || last != 8 {
+		t.Fatal(first, last)
+	}
+	srv.db.Close()
+
+	if srv, err = NewService(serviceConfig{dirBase: dir, changelogSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.db.Close()
+	write(srv, 1)
+	if first, last := srv.changelogBounds(); first != 8 || last != 9 {
+		t.Fatal(first, last)
+	}
+	write(srv, 1)
+	if first, last := srv.changelogBounds(); first != 9 || last != 10 {
+		t.Fatal(first, last)
+	}
+}
+
+// The deletions older than the grace period are purged, and ignored by the
+// anti-entropy meanwhile
+func TestServiceTombstonePurge(t *testing.T) {
+	ctx := context.Background()
+	srv, done := newTestService(t)
+	defer done()
+	srv.cfg.tombstoneGrace = time.Hour
+
+	recent := srv.clock.Now()
+	for i, version := range []uint64{10, 20, recent} {
+		key := "k" + strconv.Itoa(i)
+		if _, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: key, Value: "v", Version: version}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.Delete(ctx, &proto.DeleteRequest{Base: "b", Key: key, Version: version + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := srv.Put(ctx, &proto.PutRequest{Base: "b", Key: "live", Value: "v", Version: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := srv.Digest(ctx, &proto.DigestRequest{Base: "b"})
+	if err != nil || digest.Count != 2 {
+		t.Fatal(digest, err)
+	}
+	purged, err := srv.purgeTombstones(time.Now())
+	if err != nil || purged != 2 {
+		t.Fatal(purged, err)
+	}
+	keys := make([]string, 0)
+	_ = srv.scan("b", func(k gunkan.KeyVersion, _ []byte) error { keys = append(keys, k.Key); return nil })
+	if !reflect.DeepEqual(keys, []string{"k2", "live"}) {
+		t.Fatal(keys)
+	}
+	if _, err = srv.Get(ctx, &proto.GetRequest{Base: "b", Key: "k0"}); status.Code(err) != codes.NotFound {
+		t.Fatal(err)
+	}
+	if purged, err = srv.purgeTombstones(time.Now()); err != nil || purged != 0 {
+		t.Fatal(purged, err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cmd_index_store_rocksdb
+
+import (
+	"bytes"
+	"context"
+	"github.com/jfsmig/object-storage/pkg/gunkan"
+	proto "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
+	"github.com/tecbot/gorocksdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// The anti-entropy RPC's of the store. The gates compare the digests of the
+// replicas of a base, then fetch the keys of the buckets that differ.
+
+// Call the hook on each entry of the base, in the order of the keys
+func (srv *service) scan(base string, hook func(k gunkan.KeyVersion, value []byte) error) error {
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	opts.SetFillCache(false)
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	prefix := []byte(gunkan.KeyVersionStart(base, ""))
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		sk := iterator.Key().Data()
+		if !bytes.HasPrefix(sk, prefix) {
+			break
+		}
+		var k gunkan.KeyVersion
+		if err := k.DecodeString(string(sk)); err != nil {
+			return status.Errorf(codes.DataLoss, "Malformed DB entry")
+		}
+		if k.Base != base {
+			break
+		}
+		if err := hook(k, iterator.Value().Data()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBuckets(base string, buckets uint32) (uint32, error) {
+	if base == "" {
+		return 0, status.Errorf(codes.InvalidArgument, "Missing base")
+	}
+	if buckets == 0 {
+		return gunkan.DigestBucketsDefault, nil
+	}
+	if buckets > gunkan.DigestBucketsMax {
+		return 0, status.Errorf(codes.InvalidArgument, "Too many buckets")
+	}
+	return buckets, nil
+}
+
+func (srv *service) Digest(ctx context.Context, req *proto.DigestRequest) (*proto.DigestReply, error) {
+	buckets, err := checkBuckets(req.Base, req.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	rep := proto.DigestReply{Hashes: make([]uint64, buckets)}
+	now := time.Now()
+	err = srv.scan(req.Base, func(k gunkan.KeyVersion, _ []byte) error {
+		if srv.purgeable(k, now) {
+			return nil
+		}
+		rep.Hashes[gunkan.KeyBucket(k.Key, buckets)] ^= gunkan.EntryHash(k.Key, k.Version)
+		rep.Count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+func (srv *service) Fetch(req *proto.FetchRequest, stream proto.Index_FetchServer) error {
+	buckets, err := checkBuckets(req.Base, req.Buckets)
+	if err != nil {
+		return err
+	}
+	selected := make(map[uint32]bool, len(req.Selected))
+	for _, b := range req.Selected {
+		selected[b] = true
+	}
+	now := time.Now()
+	return srv.scan(req.Base, func(k gunkan.KeyVersion, value []byte) error {
+		if !selected[gunkan.KeyBucket(k.Key, buckets)] || srv.purgeable(k, now) {
+			return nil
+		}
+		return stream.Send(&proto.Entry{Key: k.Key, Version: k.Version, Value: string(value), Deleted: !k.Active})
+	})
+}
+
+func (srv *service) Bases(ctx context.Context, req *proto.ListRequest) (*proto.ListReply, error) {
+	if req.Max <= 0 {
+		req.Max = 1
+	} else if req.Max > gunkan.ListHardMax {
+		req.Max = gunkan.ListHardMax
+	}
+
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	opts.SetFillCache(false)
+	iterator := srv.db.NewIterator(opts)
+	defer iterator.Close()
+
+	// Jump from a base to the next one, past the keys of the base: ','
+	// separates the base from the key and '-' follows it. The internal keys
+	// come first, and are skipped.
+	rep := proto.ListReply{}
+	needle := []byte{}
+	if req.Marker != "" {
+		needle = []byte(req.Marker + "-")
+	}
+	for iterator.Seek(needle); iterator.Valid() && uint32(len(rep.Items)) < req.Max; iterator.Seek(needle) {
+		if isInternalKey(iterator.Key().Data()) {
+			needle = []byte{internalPrefix[0] + 1}
+			continue
+		}
+		var k gunkan.BaseKey
+		if err := k.DecodeBytes(iterator.Key().Data()); err != nil {
+			return nil, status.Errorf(codes.DataLoss, "Malformed DB entry")
+		}
+		rep.Items = append(rep.Items, k.Base)
+		needle = []byte(k.Base + "-")
+	}
+	return &rep, nil
+}
+
+func (srv *service) Sync(ctx context.Context, req *proto.SyncRequest) (*proto.SyncReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Served by the index gates")
+}
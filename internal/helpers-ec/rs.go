@@ -0,0 +1,202 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Systematic Reed-Solomon erasure coding over GF(2^8).
+// The k data shards are kept as is, the m parity shards are computed from a
+// Vandermonde matrix normalized so that its k first rows are the identity.
+// Any k shards out of the k+m are then enough to rebuild the others.
+package helpers_ec
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidParams  = errors.New("Invalid erasure coding parameters")
+	ErrShardCount     = errors.New("Invalid number of shards")
+	ErrShardSize      = errors.New("Shards of different sizes")
+	ErrTooFewShards   = errors.New("Too few shards to reconstruct")
+	errSingularMatrix = errors.New("Singular matrix")
+)
+
+type Coder struct {
+	k, m int
+
+	// (k+m) rows of k coefficients, the k first rows being the identity
+	matrix [][]byte
+}
+
+func NewCoder(k, m int) (*Coder, error) {
+	if k <= 0 || m < 0 || k+m > 256 {
+		return nil, ErrInvalidParams
+	}
+
+	vm := make([][]byte, k+m)
+	for r := range vm {
+		vm[r] = make([]byte, k)
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invert(vm[:k])
+	if err != nil {
+		return nil, err
+	}
+	return &Coder{k: k, m: m, matrix: multiply(vm, top)}, nil
+}
+
+func (c *Coder) DataShards() int { return c.k }
+
+func (c *Coder) ParityShards() int { return c.m }
+
+// Compute the m parity shards from the k data shards.
+// `shards` holds the k+m shards, all allocated and of the same size.
+func (c *Coder) Encode(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return ErrShardCount
+	}
+	size := len(shards[0])
+	for _, s := range shards {
+		if len(s) != size {
+			return ErrShardSize
+		}
+	}
+	for i := c.k; i < c.k+c.m; i++ {
+		c.combine(c.matrix[i], shards[:c.k], shards[i])
+	}
+	return nil
+}
+
+// Rebuild the missing shards, i.e. those that are nil, in place.
+// At least k shards must be present, all of the same size.
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return ErrShardCount
+	}
+
+	size := -1
+	present := make([]int, 0, c.k)
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if size < 0 {
+			size = len(s)
+		} else if len(s) != size {
+			return ErrShardSize
+		}
+		if len(present) < c.k {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.k {
+		return ErrTooFewShards
+	}
+
+	// Rebuild the data shards from the k first shards present
+	sub := make([][]byte, c.k)
+	in := make([][]byte, c.k)
+	for i, idx := range present {
+		sub[i] = c.matrix[idx]
+		in[i] = shards[idx]
+	}
+	dec, err := invert(sub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.k; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			c.combine(dec[i], in, shards[i])
+		}
+	}
+
+	// Then the missing parity shards from the data shards
+	for i := c.k; i < c.k+c.m; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			c.combine(c.matrix[i], shards[:c.k], shards[i])
+		}
+	}
+	return nil
+}
+
+// out = sum(coefs[i] * in[i])
+func (c *Coder) combine(coefs []byte, in [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for i, coef := range coefs {
+		if coef == 0 {
+			continue
+		}
+		mt := &gfMulTable[coef]
+		for j, b := range in[i] {
+			out[j] ^= mt[b]
+		}
+	}
+}
+
+func multiply(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var v byte
+			for i := range b {
+				v ^= gfMul(a[r][i], b[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// Gauss-Jordan inversion of a square matrix
+func invert(in [][]byte) ([][]byte, error) {
+	n := len(in)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], in[r])
+		work[r][n+r] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingularMatrix
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		if v := work[col][col]; v != 1 {
+			inv := gfInv(v)
+			for i := range work[col] {
+				work[col][i] = gfMul(work[col][i], inv)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			f := work[r][col]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[col][i])
+			}
+		}
+	}
+
+	out := make([][]byte, n)
+	for r := range out {
+		out[r] = work[r][n:]
+	}
+	return out, nil
+}
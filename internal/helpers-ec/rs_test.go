@@ -0,0 +1,61 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package helpers_ec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	const k, m = 6, 3
+	c, err := NewCoder(k, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := make([][]byte, k+m)
+	for i := range shards {
+		shards[i] = make([]byte, 1000)
+		if i < k {
+			rand.Read(shards[i])
+		}
+	}
+	if err = c.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every combination of up to m missing shards must be recoverable
+	for mask := 0; mask < 1<<(k+m); mask++ {
+		lost := 0
+		damaged := make([][]byte, k+m)
+		for i := range shards {
+			if mask&(1<<i) != 0 {
+				lost++
+			} else {
+				damaged[i] = shards[i]
+			}
+		}
+		if lost > m {
+			continue
+		}
+		if err = c.Reconstruct(damaged); err != nil {
+			t.Fatal(mask, err)
+		}
+		for i := range shards {
+			if !bytes.Equal(damaged[i], shards[i]) {
+				t.Fatal(mask, "shard", i, "differs")
+			}
+		}
+	}
+
+	damaged := make([][]byte, k+m)
+	copy(damaged[m+1:], shards[m+1:])
+	if err = c.Reconstruct(damaged); err != ErrTooFewShards {
+		t.Fatal("Reconstruction should have failed")
+	}
+}
@@ -45,15 +45,17 @@ func DialTLS(addrConnect, dirConfig string) (*grpc.ClientConn, error) {
 		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
 }
 
-func DialTLSInsecure(addrConnect string) (*grpc.ClientConn, error) {
+// The options are added to the defaults, e.g. to chain more interceptors
+func DialTLSInsecure(addrConnect string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	config := &tls.Config{
 		InsecureSkipVerify: true,
 	}
 	creds := credentials.NewTLS(config)
-	return grpc.Dial(addrConnect,
+	opts = append([]grpc.DialOption{
 		grpc.WithTransportCredentials(creds),
 		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor)}, opts...)
+	return grpc.Dial(addrConnect, opts...)
 }
 
 func ServerTLS(dirConfig string) (*grpc.Server, error) {
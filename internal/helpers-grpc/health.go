@@ -0,0 +1,52 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package helpers_grpc
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The stop of a server on a SIGINT or a SIGTERM: the health service reports
+// NOT_SERVING during Drain, so that the health checks notice it before the
+// listeners close, then the calls in flight have Timeout to finish before the
+// streams still open are cut. A second signal kills the process.
+type Shutdown struct {
+	Drain   time.Duration
+	Timeout time.Duration
+}
+
+// Register a health service on the server, that stops the server as told by
+// the shutdown
+func RegisterHealth(server *grpc.Server, shutdown Shutdown) {
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(server, hs)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		<-c
+		signal.Stop(c)
+
+		hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		time.Sleep(shutdown.Drain)
+
+		done := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(shutdown.Timeout):
+			server.Stop()
+		}
+	}()
+}
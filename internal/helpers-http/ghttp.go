@@ -114,11 +114,11 @@ func (ctx *RequestContext) ReplyCodeError(code int, err error) {
 
 func (ctx *RequestContext) ReplyError(err error) {
 	code := http.StatusInternalServerError
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) || err == gunkan.ErrNotFound {
 		code = http.StatusNotFound
-	} else if os.IsExist(err) {
+	} else if os.IsExist(err) || err == gunkan.ErrAlreadyExists {
 		code = http.StatusConflict
-	} else if os.IsPermission(err) {
+	} else if os.IsPermission(err) || err == gunkan.ErrForbidden {
 		code = http.StatusForbidden
 	} else if os.IsTimeout(err) {
 		code = http.StatusRequestTimeout
@@ -14,6 +14,23 @@ type Balancer interface {
 
 	// Returns the URL of an available Blob Store service.
 	PollBlobStore() (string, error)
+
+	// Returns the URL of `count` distinct Blob Store services.
+	PollBlobStores(count uint) ([]string, error)
+
+	// Returns the URL of `count` distinct Blob Store services, spread
+	// according to the given constraints.
+	PollBlobStoresPlaced(count uint, placement Placement) ([]string, error)
+
+	// Same as PollBlobStoresPlaced, but never returns the excluded addresses.
+	// With DistinctHosts, the hosts of the excluded addresses are avoided too.
+	PollBlobStoresExcluding(count uint, placement Placement, excluded []string) ([]string, error)
+}
+
+// Constraints on a set of services polled at once
+type Placement struct {
+	// At most one service per host
+	DistinctHosts bool
 }
 
 // Returns a discovery client initiated
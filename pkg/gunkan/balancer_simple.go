@@ -8,6 +8,7 @@ package gunkan
 import (
 	"errors"
 	"math/rand"
+	"net"
 )
 
 type simpleBalancer struct {
@@ -57,3 +58,59 @@ func (self *simpleBalancer) PollBlobStore() (string, error) {
 		return addrv[rand.Intn(len(addrv))], nil
 	}
 }
+
+func (self *simpleBalancer) PollBlobStores(count uint) ([]string, error) {
+	return self.PollBlobStoresPlaced(count, Placement{})
+}
+
+func (self *simpleBalancer) PollBlobStoresPlaced(count uint, placement Placement) ([]string, error) {
+	return self.PollBlobStoresExcluding(count, placement, nil)
+}
+
+func (self *simpleBalancer) PollBlobStoresExcluding(count uint, placement Placement, excluded []string) ([]string, error) {
+	addrv, err := self.catalog.ListBlobStore()
+	if err != nil {
+		return nil, err
+	}
+
+	hostOf := func(addr string) string {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		return host
+	}
+
+	avoided := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, addr := range excluded {
+		avoided[addr] = true
+		if placement.DistinctHosts {
+			hosts[hostOf(addr)] = true
+		}
+	}
+
+	rand.Shuffle(len(addrv), func(i, j int) { addrv[i], addrv[j] = addrv[j], addrv[i] })
+	out := make([]string, 0, count)
+	for _, addr := range addrv {
+		if uint(len(out)) >= count {
+			break
+		}
+		if avoided[addr] {
+			continue
+		}
+		if placement.DistinctHosts {
+			host := hostOf(addr)
+			if hosts[host] {
+				continue
+			}
+			hosts[host] = true
+		}
+		out = append(out, addr)
+	}
+
+	if uint(len(out)) < count {
+		return nil, errNotAvailableBlobStore
+	}
+	return out, nil
+}
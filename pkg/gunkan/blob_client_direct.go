@@ -92,7 +92,7 @@ func (self *httpBlobClient) PutN(ctx context.Context, id BlobId, data io.Reader,
 	}
 
 	defer rep.Body.Close()
-	return "", MapCodeToError(rep.StatusCode)
+	return rep.Header.Get("Location"), MapCodeToError(rep.StatusCode)
 }
 
 func (self *httpBlobClient) Put(ctx context.Context, id BlobId, data io.Reader) (string, error) {
@@ -114,7 +114,7 @@ func (self *httpBlobClient) Put(ctx context.Context, id BlobId, data io.Reader)
 	}
 
 	defer rep.Body.Close()
-	return "", MapCodeToError(rep.StatusCode)
+	return rep.Header.Get("Location"), MapCodeToError(rep.StatusCode)
 }
 
 func (self *httpBlobClient) List(ctx context.Context, max uint) ([]BlobListItem, error) {
@@ -33,3 +33,21 @@ const (
 const (
 	ListHardMax = 10000
 )
+
+const (
+	// Base of the index that holds one record per bucket.
+	// The leading underscore makes it an invalid bucket name.
+	IndexBaseBuckets = "_buckets"
+
+	// Base of the index that holds the multipart uploads in progress
+	IndexBaseUploads = "_uploads"
+
+	// Base of the index that counts the references to the shared BLOB's
+	IndexBaseBlobRefs = "_blobrefs"
+
+	// Base of the index that holds the history of the versioned parts
+	IndexBaseVersions = "_versions"
+
+	// Base of the index that sorts the expiring parts by date
+	IndexBaseExpiry = "_expiry"
+)
@@ -8,6 +8,7 @@ var (
 	ErrNotFound      = errors.New("404/Not-Found")
 	ErrForbidden     = errors.New("403/Forbidden")
 	ErrAlreadyExists = errors.New("409/Conflict")
+	ErrPrecondition  = errors.New("412/Precondition-Failed")
 	ErrStorageError  = errors.New("502/Backend-Error")
 	ErrInternalError = errors.New("500/Internal Error")
 )
@@ -20,6 +21,8 @@ func MapCodeToError(code int) error {
 		return ErrForbidden
 	case 409:
 		return ErrAlreadyExists
+	case 412:
+		return ErrPrecondition
 	case 200, 201, 204:
 		return nil
 	default:
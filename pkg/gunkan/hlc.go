@@ -0,0 +1,70 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// HLC is a hybrid logical clock stamping the versions of the index entries.
+// A version holds the wall time in nanoseconds, rounded up above its
+// HLCLogicalBits low bits that hold a logical counter, so that the versions
+// stay above the plain nanosecond timestamps of the former releases. The
+// versions of a clock strictly increase, even when the wall time goes
+// backward, and they stay above all the versions the clock observed, up to
+// HLCMaxOffset ahead of the wall time.
+type HLC struct {
+	last uint64
+}
+
+const HLCLogicalBits = 16
+
+// The largest offset accepted between the clocks of two hosts
+const HLCMaxOffset = time.Minute
+
+func hlcPhysical(t time.Time) uint64 {
+	const mask = 1<<HLCLogicalBits - 1
+	return (uint64(t.UnixNano()) | mask) + 1
+}
+
+// Returns a new version, above all the versions returned or observed
+func (c *HLC) Now() uint64 {
+	for {
+		old := atomic.LoadUint64(&c.last)
+		next := hlcPhysical(time.Now())
+		if next <= old {
+			next = old + 1
+		}
+		if atomic.CompareAndSwapUint64(&c.last, old, next) {
+			return next
+		}
+	}
+}
+
+// Move the clock past a version stamped elsewhere. A version too far ahead
+// is clamped, so that it cannot exhaust the versions of the clock.
+func (c *HLC) Observe(version uint64) {
+	if max := hlcPhysical(time.Now().Add(HLCMaxOffset)); version > max {
+		version = max
+	}
+	for {
+		old := atomic.LoadUint64(&c.last)
+		if version <= old || atomic.CompareAndSwapUint64(&c.last, old, version) {
+			return
+		}
+	}
+}
+
+// Tells if a version stamped elsewhere is not too far ahead of the wall time
+func HLCValid(version uint64) bool {
+	return version <= hlcPhysical(time.Now().Add(HLCMaxOffset))
+}
+
+// Returns the wall time of a version
+func HLCTime(version uint64) time.Time {
+	return time.Unix(0, int64(version&^(1<<HLCLogicalBits-1)))
+}
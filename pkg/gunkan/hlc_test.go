@@ -0,0 +1,56 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	var c HLC
+	before := time.Now().Add(-time.Millisecond)
+	legacy := uint64(time.Now().UnixNano())
+	v := c.Now()
+	if v <= legacy {
+		t.Fatal(v, legacy)
+	}
+	if HLCTime(v).Before(before) || HLCTime(v).After(time.Now().Add(time.Millisecond)) {
+		t.Fatal(HLCTime(v))
+	}
+	for i := 0; i < 1000; i++ {
+		next := c.Now()
+		if next <= v {
+			t.Fatal(v, next)
+		}
+		v = next
+	}
+
+	// A version from a clock ahead pushes the clock
+	ahead := hlcPhysical(time.Now().Add(HLCMaxOffset / 2))
+	c.Observe(ahead)
+	if v = c.Now(); v != ahead+1 {
+		t.Fatal(v, ahead)
+	}
+	c.Observe(1)
+	if next := c.Now(); next != v+1 {
+		t.Fatal(v, next)
+	}
+
+	// Unless it is too far ahead
+	if !HLCValid(v) || HLCValid(math.MaxUint64) {
+		t.Fatal(v)
+	}
+	c.Observe(math.MaxUint64)
+	v = c.Now()
+	if v == 0 || HLCTime(v).After(time.Now().Add(HLCMaxOffset+time.Second)) {
+		t.Fatal(v)
+	}
+	if next := c.Now(); next <= v {
+		t.Fatal(v, next)
+	}
+}
@@ -17,4 +17,30 @@ type IndexClient interface {
 	Delete(ctx context.Context, key BaseKey) error
 
 	List(ctx context.Context, marker BaseKey, max uint32) ([]string, error)
+
+	// Apply several writes at once, with one error per key
+	BatchPut(ctx context.Context, keys []BaseKey, values []string) ([]error, error)
+
+	// Apply several deletions at once, with one error per key
+	BatchDelete(ctx context.Context, keys []BaseKey) ([]error, error)
+
+	// Fetch several keys at once, with one value and one error per key
+	BatchGet(ctx context.Context, keys []BaseKey) ([]string, []error, error)
+
+	// Iterate over the keys of a base. The iterator must be closed.
+	Scan(ctx context.Context, base string, opts IndexScanOptions) (IndexIterator, error)
+
+	// Returns the value and its version, for the conditional writes
+	GetVersion(ctx context.Context, key BaseKey) (string, uint64, error)
+
+	// Fails with ErrPrecondition if the key has a value
+	PutIfAbsent(ctx context.Context, key BaseKey, value string) error
+
+	// Fails with ErrPrecondition if the latest version of the key is not version,
+	// with codes.InvalidArgument if version is 0
+	CompareAndSwap(ctx context.Context, key BaseKey, version uint64, value string) error
+
+	// Fails with ErrPrecondition if the latest version of the key is not version,
+	// with codes.InvalidArgument if version is 0
+	CompareAndDelete(ctx context.Context, key BaseKey, version uint64) error
 }
@@ -9,8 +9,12 @@ import (
 	"github.com/jfsmig/object-storage/internal/helpers-grpc"
 	kv "github.com/jfsmig/object-storage/pkg/gunkan-index-proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"context"
+	"errors"
+	"io"
 )
 
 func DialIndexGrpc(url, dirConfig string) (IndexClient, error) {
@@ -60,3 +64,176 @@ func (self *IndexGrpcClient) Delete(ctx context.Context, key BaseKey) error {
 	_, err := client.Delete(ctx, &req)
 	return err
 }
+
+func (self *IndexGrpcClient) BatchPut(ctx context.Context, keys []BaseKey, values []string) ([]error, error) {
+	if len(keys) != len(values) {
+		return nil, errors.New("Keys and values mismatch")
+	}
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.BatchPutRequest{Items: make([]*kv.PutRequest, 0, len(keys))}
+	for i, k := range keys {
+		req.Items = append(req.Items, &kv.PutRequest{Base: k.Base, Key: k.Key, Value: values[i]})
+	}
+	rep, err := client.BatchPut(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	return batchErrors(rep.Items, len(keys))
+}
+
+func (self *IndexGrpcClient) BatchDelete(ctx context.Context, keys []BaseKey) ([]error, error) {
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.BatchDeleteRequest{Items: make([]*kv.DeleteRequest, 0, len(keys))}
+	for _, k := range keys {
+		req.Items = append(req.Items, &kv.DeleteRequest{Base: k.Base, Key: k.Key})
+	}
+	rep, err := client.BatchDelete(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	return batchErrors(rep.Items, len(keys))
+}
+
+func (self *IndexGrpcClient) BatchGet(ctx context.Context, keys []BaseKey) ([]string, []error, error) {
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.BatchGetRequest{Items: make([]*kv.GetRequest, 0, len(keys))}
+	for _, k := range keys {
+		req.Items = append(req.Items, &kv.GetRequest{Base: k.Base, Key: k.Key})
+	}
+	rep, err := client.BatchGet(ctx, &req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rep.Items) != len(keys) {
+		return nil, nil, errors.New("Batch reply mismatch")
+	}
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	for i, item := range rep.Items {
+		values[i] = item.Value
+		errs[i] = itemError(item.Status)
+	}
+	return values, errs, nil
+}
+
+func batchErrors(items []*kv.ItemStatus, n int) ([]error, error) {
+	if len(items) != n {
+		return nil, errors.New("Batch reply mismatch")
+	}
+	errs := make([]error, n)
+	for i, item := range items {
+		errs[i] = itemError(item)
+	}
+	return errs, nil
+}
+
+// Map the status of an item of a batch to the errors of the package
+func itemError(st *kv.ItemStatus) error {
+	switch codes.Code(st.GetCode()) {
+	case codes.OK:
+		return nil
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.FailedPrecondition:
+		return ErrPrecondition
+	default:
+		return status.Error(codes.Code(st.GetCode()), st.GetMessage())
+	}
+}
+
+func (self *IndexGrpcClient) Scan(ctx context.Context, base string, opts IndexScanOptions) (IndexIterator, error) {
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.ScanRequest{
+		Base: base, Start: opts.Start, End: opts.End,
+		Prefix: opts.Prefix, Delimiter: opts.Delimiter,
+		Reverse: opts.Reverse, Limit: opts.Limit,
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := client.Scan(ctx, &req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &indexGrpcIterator{stream: stream, cancel: cancel}, nil
+}
+
+type indexGrpcIterator struct {
+	stream kv.Index_ScanClient
+	cancel context.CancelFunc
+	item   IndexItem
+	err    error
+}
+
+func (it *indexGrpcIterator) Next() bool {
+	if it.stream == nil {
+		return false
+	}
+	item, err := it.stream.Recv()
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.Close()
+		return false
+	}
+	it.item = IndexItem{Key: item.Key, Prefix: item.Prefix}
+	return true
+}
+
+func (it *indexGrpcIterator) Item() IndexItem { return it.item }
+
+func (it *indexGrpcIterator) Err() error { return it.err }
+
+func (it *indexGrpcIterator) Close() {
+	if it.stream != nil {
+		it.cancel()
+		it.stream = nil
+	}
+}
+
+func (self *IndexGrpcClient) GetVersion(ctx context.Context, key BaseKey) (string, uint64, error) {
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.GetRequest{Base: key.Base, Key: key.Key}
+	rep, err := client.Get(ctx, &req)
+	if err != nil {
+		return "", 0, err
+	}
+	return rep.Value, rep.Version, nil
+}
+
+func (self *IndexGrpcClient) PutIfAbsent(ctx context.Context, key BaseKey, value string) error {
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.PutRequest{Base: key.Base, Key: key.Key, Value: value, IfAbsent: true}
+	_, err := client.Put(ctx, &req)
+	return mapPrecondition(err)
+}
+
+// The version 0 would make the write unconditional
+var errNoVersion = status.Error(codes.InvalidArgument, "Missing version")
+
+func (self *IndexGrpcClient) CompareAndSwap(ctx context.Context, key BaseKey, version uint64, value string) error {
+	if version == 0 {
+		return errNoVersion
+	}
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.PutRequest{Base: key.Base, Key: key.Key, Value: value, IfVersion: version}
+	_, err := client.Put(ctx, &req)
+	return mapPrecondition(err)
+}
+
+func (self *IndexGrpcClient) CompareAndDelete(ctx context.Context, key BaseKey, version uint64) error {
+	if version == 0 {
+		return errNoVersion
+	}
+	client := kv.NewIndexClient(self.cnx)
+	req := kv.DeleteRequest{Base: key.Base, Key: key.Key, IfVersion: version}
+	_, err := client.Delete(ctx, &req)
+	return mapPrecondition(err)
+}
+
+func mapPrecondition(err error) error {
+	if status.Code(err) == codes.FailedPrecondition {
+		return ErrPrecondition
+	}
+	return err
+}
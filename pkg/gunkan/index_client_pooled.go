@@ -80,6 +80,86 @@ func (self *IndexPooledClient) Delete(ctx context.Context, key BaseKey) error {
 	}
 }
 
+func (self *IndexPooledClient) BatchPut(ctx context.Context, keys []BaseKey, values []string) ([]error, error) {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return nil, err
+	} else {
+		return client.BatchPut(ctx, keys, values)
+	}
+}
+
+func (self *IndexPooledClient) BatchDelete(ctx context.Context, keys []BaseKey) ([]error, error) {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return nil, err
+	} else {
+		return client.BatchDelete(ctx, keys)
+	}
+}
+
+func (self *IndexPooledClient) BatchGet(ctx context.Context, keys []BaseKey) ([]string, []error, error) {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return nil, nil, err
+	} else {
+		return client.BatchGet(ctx, keys)
+	}
+}
+
+func (self *IndexPooledClient) Scan(ctx context.Context, base string, opts IndexScanOptions) (IndexIterator, error) {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return nil, err
+	} else {
+		return client.Scan(ctx, base, opts)
+	}
+}
+
+func (self *IndexPooledClient) GetVersion(ctx context.Context, key BaseKey) (string, uint64, error) {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return "", 0, err
+	} else {
+		return client.GetVersion(ctx, key)
+	}
+}
+
+func (self *IndexPooledClient) PutIfAbsent(ctx context.Context, key BaseKey, value string) error {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return err
+	} else {
+		return client.PutIfAbsent(ctx, key, value)
+	}
+}
+
+func (self *IndexPooledClient) CompareAndSwap(ctx context.Context, key BaseKey, version uint64, value string) error {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return err
+	} else {
+		return client.CompareAndSwap(ctx, key, version, value)
+	}
+}
+
+func (self *IndexPooledClient) CompareAndDelete(ctx context.Context, key BaseKey, version uint64) error {
+	client, err := self.acquire(ctx)
+	defer self.release(client)
+	if err != nil {
+		return err
+	} else {
+		return client.CompareAndDelete(ctx, key, version)
+	}
+}
+
 func (self *IndexPooledClient) dial(ctx context.Context) (IndexClient, error) {
 	url, err := self.lb.PollIndexGate()
 	if err != nil {
@@ -0,0 +1,25 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// A conditional write without version is refused before any RPC
+func TestIndexClientNoVersion(t *testing.T) {
+	ctx := context.Background()
+	client := &IndexGrpcClient{}
+	if err := client.CompareAndSwap(ctx, BK("b", "k"), 0, "v"); status.Code(err) != codes.InvalidArgument {
+		t.Fatal(err)
+	}
+	if err := client.CompareAndDelete(ctx, BK("b", "k"), 0); status.Code(err) != codes.InvalidArgument {
+		t.Fatal(err)
+	}
+}
@@ -6,7 +6,10 @@
 package gunkan
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 )
 
@@ -74,3 +77,98 @@ const (
 	parsingBase = iota
 	parsingKey  = iota
 )
+
+// KeyVersion identifies one version of a key in a history. The encoded form
+// sorts the entries by key, then the versions of a key from the newest to the
+// oldest: the key is followed by keyVersionEnd then by the version, and the
+// NUL bytes of the key are escaped, so that nothing sorts between the versions
+// of a key and the keys after it. An inactive version is a delete marker.
+type KeyVersion struct {
+	Base    string
+	Key     string
+	Version uint64
+	Active  bool
+}
+
+const (
+	keyVersionEnd = "\x00\x00"
+	keyVersionNul = "\x00\x01"
+	// The end of the key, the version and the flag
+	keyVersionSuffix = len(keyVersionEnd) + 16 + 1
+)
+
+var errInvalidKeyVersion = errors.New("Invalid versioned key")
+
+// Returns the prefix shared by the encoded versions of all the keys of the
+// base starting with prefix
+func KeyVersionStart(base, prefix string) string {
+	return base + "," + strings.ReplaceAll(prefix, "\x00", keyVersionNul)
+}
+
+// Returns the prefix shared by the encoded versions of the key, and only them.
+// It sorts before all of them, and after the versions of the smaller keys.
+func KeyVersionPrefix(base, key string) string {
+	return KeyVersionStart(base, key) + keyVersionEnd
+}
+
+func (n KeyVersion) Encode() string {
+	flag := 'd'
+	if n.Active {
+		flag = 'a'
+	}
+	return fmt.Sprintf("%s%016X%c", KeyVersionPrefix(n.Base, n.Key), ^n.Version, flag)
+}
+
+func (n *KeyVersion) DecodeString(s string) error {
+	first := strings.IndexByte(s, ',')
+	end := len(s) - keyVersionSuffix
+	if first < 0 || end <= first || s[end:end+len(keyVersionEnd)] != keyVersionEnd {
+		return errInvalidKeyVersion
+	}
+	v, err := strconv.ParseUint(s[end+len(keyVersionEnd):len(s)-1], 16, 64)
+	if err != nil {
+		return errInvalidKeyVersion
+	}
+	switch s[len(s)-1] {
+	case 'a':
+		n.Active = true
+	case 'd':
+		n.Active = false
+	default:
+		return errInvalidKeyVersion
+	}
+	key := s[first+1 : end]
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0 {
+			if !strings.HasPrefix(key[i:], keyVersionNul) {
+				return errInvalidKeyVersion
+			}
+			i++
+		}
+	}
+	n.Base = s[:first]
+	n.Key = strings.ReplaceAll(key, keyVersionNul, "\x00")
+	n.Version = ^v
+	return nil
+}
+
+// The anti-entropy between the index stores spreads the keys of a base in
+// buckets, and compares the XOR of the hashes of the entries of each bucket.
+const (
+	DigestBucketsDefault = 256
+	DigestBucketsMax     = 65536
+)
+
+func KeyBucket(key string, buckets uint32) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32() % buckets
+}
+
+func EntryHash(key string, version uint64) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strconv.FormatUint(version, 16)))
+	return h.Sum64()
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"strings"
+)
+
+// IndexScanOptions selects the keys of a base returned by a scan
+type IndexScanOptions struct {
+	// The first key, included, and the last key, excluded. Empty for no bound.
+	Start string
+	End   string
+	// Only the keys starting with the prefix
+	Prefix string
+	// The keys with the delimiter after the prefix are rolled up in a single
+	// item, their common prefix up to the delimiter included.
+	Delimiter string
+	Reverse   bool
+	// Maximum number of items, 0 for no limit
+	Limit uint32
+}
+
+type IndexItem struct {
+	Key string
+	// The key is a common prefix
+	Prefix bool
+}
+
+// IndexIterator walks the items of a scan
+type IndexIterator interface {
+	// Advance to the next item, false at the end of the scan or on error
+	Next() bool
+
+	Item() IndexItem
+
+	// The error that stopped the scan, if any
+	Err() error
+
+	// Release the iterator, before its end if necessary
+	Close()
+}
+
+// The lowest key of the scan
+func (opts IndexScanOptions) Lower() string {
+	if opts.Prefix > opts.Start {
+		return opts.Prefix
+	}
+	return opts.Start
+}
+
+// The key above all the keys of the scan, empty if none
+func (opts IndexScanOptions) Upper() string {
+	upper := prefixSuccessor(opts.Prefix)
+	if upper == "" || (opts.End != "" && opts.End < upper) {
+		return opts.End
+	}
+	return upper
+}
+
+// Returns the lowest string above all the strings starting with the prefix
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// IndexScanner applies the options of a scan to the keys of a base, given in
+// the order of the scan.
+type IndexScanner struct {
+	opts       IndexScanOptions
+	lastPrefix string
+	count      uint32
+}
+
+func NewIndexScanner(opts IndexScanOptions) *IndexScanner {
+	return &IndexScanner{opts: opts}
+}
+
+// Returns the item of the key, emit false when the key is skipped, done true
+// when the scan is over.
+func (s *IndexScanner) Feed(key string) (item IndexItem, emit bool, done bool) {
+	o := &s.opts
+	if o.Limit > 0 && s.count >= o.Limit {
+		return item, false, true
+	}
+	below := key < o.Start || (!strings.HasPrefix(key, o.Prefix) && key < o.Prefix)
+	above := (o.End != "" && key >= o.End) || (!strings.HasPrefix(key, o.Prefix) && key > o.Prefix)
+	if below || above {
+		return item, false, below == o.Reverse
+	}
+
+	item.Key = key
+	if o.Delimiter != "" {
+		if i := strings.Index(key[len(o.Prefix):], o.Delimiter); i >= 0 {
+			cp := key[:len(o.Prefix)+i+len(o.Delimiter)]
+			if cp == s.lastPrefix {
+				return item, false, false
+			}
+			s.lastPrefix = cp
+			item = IndexItem{Key: cp, Prefix: true}
+		}
+	}
+	s.count++
+	return item, true, false
+}
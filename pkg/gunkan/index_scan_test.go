@@ -0,0 +1,72 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func scanKeys(keys []string, opts IndexScanOptions) []IndexItem {
+	out := make([]IndexItem, 0)
+	s := NewIndexScanner(opts)
+	feed := func(k string) bool {
+		item, emit, done := s.Feed(k)
+		if emit {
+			out = append(out, item)
+		}
+		return !done
+	}
+	if opts.Reverse {
+		for i := len(keys) - 1; i >= 0 && feed(keys[i]); i-- {
+		}
+	} else {
+		for i := 0; i < len(keys) && feed(keys[i]); i++ {
+		}
+	}
+	return out
+}
+
+func TestIndexScanner(t *testing.T) {
+	keys := []string{"a", "b/1", "b/2", "b/3/x", "b/3/y", "b/4", "c", "d"}
+	k := func(keys ...string) []IndexItem {
+		out := make([]IndexItem, 0)
+		for _, key := range keys {
+			out = append(out, IndexItem{Key: key, Prefix: key[len(key)-1] == '/'})
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		opts     IndexScanOptions
+		expected []IndexItem
+	}{
+		{IndexScanOptions{}, k(keys...)},
+		{IndexScanOptions{Start: "b/2", End: "c"}, k("b/2", "b/3/x", "b/3/y", "b/4")},
+		{IndexScanOptions{Prefix: "b/", Delimiter: "/"}, k("b/1", "b/2", "b/3/", "b/4")},
+		{IndexScanOptions{Prefix: "b/", Delimiter: "/", Reverse: true}, k("b/4", "b/3/", "b/2", "b/1")},
+		{IndexScanOptions{Delimiter: "/"}, k("a", "b/", "c", "d")},
+		{IndexScanOptions{Start: "b", End: "c", Reverse: true, Limit: 2}, k("b/4", "b/3/y")},
+		{IndexScanOptions{Prefix: "b/3", Start: "b/3/y"}, k("b/3/y")},
+		{IndexScanOptions{Limit: 1}, k("a")},
+	} {
+		if got := scanKeys(keys, tc.opts); !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%+v: %v", tc.opts, got)
+		}
+	}
+
+	opts := IndexScanOptions{Start: "a", Prefix: "b/", End: "b/5"}
+	if opts.Lower() != "b/" || opts.Upper() != "b/5" {
+		t.Fatal(opts.Lower(), opts.Upper())
+	}
+	opts = IndexScanOptions{Prefix: "b/"}
+	if opts.Upper() != "b0" {
+		t.Fatal(opts.Upper())
+	}
+	opts = IndexScanOptions{Prefix: "b\xff"}
+	if opts.Upper() != "c" {
+		t.Fatal(opts.Upper())
+	}
+}
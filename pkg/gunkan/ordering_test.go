@@ -7,6 +7,7 @@ package gunkan
 
 import (
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -32,9 +33,44 @@ func TestKeyOrdering(t *testing.T) {
 		{"A", "plip", 2, false},
 		{"A", "plip", 1, true},
 		{"A", "plip", 0, true},
+		{"A", "plip\x00", 2, true},
+		{"A", "plip\x00\x00", 1, true},
+		{"A", "plip\x00x", 1, true},
+		{"A", "plip\x01", 1, true},
+		{"A", "plip,00001", 1, true},
 		{"A", "plipA", 1, true},
 	}
 	if !sort.IsSorted(tab) {
 		t.Fatal()
 	}
+
+	// Only the versions of the key share its prefix, and the prefix sorts
+	// before them
+	for _, kv := range tab {
+		for _, other := range tab {
+			shared := strings.HasPrefix(other.Encode(), KeyVersionPrefix(kv.Base, kv.Key))
+			if shared != (other.Key == kv.Key) || (shared && other.Encode() < KeyVersionPrefix(kv.Base, kv.Key)) {
+				t.Fatal(kv, other)
+			}
+		}
+	}
+}
+
+func TestKeyVersionDecode(t *testing.T) {
+	for _, kv := range []KeyVersion{{"A", "plip", 3, true}, {"A", "p,l,i,p", 0, false}, {"A", "", 1, true}, {"A", "p\x00l", 1, true}} {
+		var decoded KeyVersion
+		if err := decoded.DecodeString(kv.Encode()); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != kv {
+			t.Fatal(kv, decoded)
+		}
+	}
+	for _, s := range []string{"", "A,plip", "A,0000000000000000,a", "A\x00\x000000000000000000a",
+		"A,plip\x00\x00000000000000000Ga", "A,plip\x00\x000000000000000000x", "A,p\x00l\x00\x000000000000000000a"} {
+		var kv KeyVersion
+		if kv.DecodeString(s) == nil {
+			t.Fatal(s)
+		}
+	}
 }
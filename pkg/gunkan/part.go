@@ -37,6 +37,11 @@ func (self *PartId) EncodeIn(b *strings.Builder) {
 	b.WriteString(self.Bucket)
 }
 
+// Returns the key of the part in the index, the bucket being the base.
+func (self *PartId) IndexKey() BaseKey {
+	return BK(self.Bucket, self.Content+","+self.PartId)
+}
+
 func (self *PartId) EncodeMarker() string {
 	var b strings.Builder
 	self.EncodeMarkerIn(&b)
@@ -0,0 +1,127 @@
+// Copyright (C) 2019-2020 OpenIO SAS
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gunkan
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query parameters of a pre-signed URL of the data gate. The signature is
+// the HMAC-SHA256 of the method, the path, the expiry, the key id and the other
+// query parameters of the URL, with the secret of the key.
+const (
+	PresignParamKey       = "gk-key"
+	PresignParamMethod    = "gk-method"
+	PresignParamExpires   = "gk-expires"
+	PresignParamSignature = "gk-signature"
+)
+
+var (
+	ErrPresignExpired = errors.New("Pre-signed URL expired")
+	ErrPresignInvalid = errors.New("Invalid pre-signed URL")
+)
+
+// PresignKeys maps the key ids to their secrets. Several keys may be valid at
+// once, so that a key is rotated by adding the new key, signing with it, then
+// removing the old key once the URLs it signed have expired.
+type PresignKeys map[string][]byte
+
+// Load a file with one "KEYID SECRET" pair per line. The empty lines and the
+// lines starting with '#' are ignored.
+func LoadPresignKeys(path string) (PresignKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(PresignKeys)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) != 2 {
+			return nil, errors.New("Invalid key line")
+		}
+		keys[tokens[0]] = []byte(tokens[1])
+	}
+	return keys, scanner.Err()
+}
+
+// The query parameters covered by the signature, besides the ones of the
+// signature itself, in a canonical form
+func presignParams(q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		switch k {
+		case PresignParamKey, PresignParamMethod, PresignParamExpires, PresignParamSignature:
+		default:
+			params[k] = v
+		}
+	}
+	return params.Encode()
+}
+
+func presignDigest(secret []byte, keyId, method, path, expires, params string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + expires + "\n" + keyId + "\n" + params))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the query parameters granting the method on the path until expires,
+// with the given parameters that may not be changed
+func Presign(keyId string, secret []byte, method, path string, params url.Values, expires time.Time) url.Values {
+	sexp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = append([]string{}, v...)
+	}
+	q.Set(PresignParamKey, keyId)
+	q.Set(PresignParamMethod, method)
+	q.Set(PresignParamExpires, sexp)
+	q.Set(PresignParamSignature, presignDigest(secret, keyId, method, path, sexp, presignParams(q)))
+	return q
+}
+
+// Tells if the query parameters grant the method on the path at the given
+// time. A URL signed for GET also grants HEAD. Any query parameter added to
+// the URL invalidates it.
+func (keys PresignKeys) Verify(method, path string, q url.Values, now time.Time) error {
+	keyId := q.Get(PresignParamKey)
+	signed := q.Get(PresignParamMethod)
+	sexp := q.Get(PresignParamExpires)
+	secret, ok := keys[keyId]
+	if !ok {
+		return ErrPresignInvalid
+	}
+	if signed != method && !(signed == "GET" && method == "HEAD") {
+		return ErrPresignInvalid
+	}
+	expected := presignDigest(secret, keyId, signed, path, sexp, presignParams(q))
+	if !hmac.Equal([]byte(expected), []byte(q.Get(PresignParamSignature))) {
+		return ErrPresignInvalid
+	}
+	expires, err := strconv.ParseInt(sexp, 10, 64)
+	if err != nil {
+		return ErrPresignInvalid
+	}
+	if now.Unix() > expires {
+		return ErrPresignExpired
+	}
+	return nil
+}
@@ -5,8 +5,14 @@
 
 package gunkan
 
+import (
+	"strings"
+)
+
+// The names starting with an underscore are reserved for internal purposes.
+// The comma and the slash are separators of the index keys and the URL's.
 func ValidateBucketName(n string) bool {
-	return len(n) > 0 && len(n) < 1024
+	return len(n) > 0 && len(n) < 1024 && n[0] != '_' && !strings.ContainsAny(n, ",/")
 }
 
 func ValidateContentName(n string) bool {